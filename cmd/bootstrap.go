@@ -2,16 +2,26 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/auth"
 	"github.com/captainlettuce/users-microservice/internal/domain"
 	"github.com/captainlettuce/users-microservice/internal/logging"
 	"github.com/captainlettuce/users-microservice/internal/pubsub"
 	"github.com/captainlettuce/users-microservice/internal/repository"
+	"github.com/captainlettuce/users-microservice/internal/server"
 	"github.com/captainlettuce/users-microservice/internal/server/service"
 	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/captainlettuce/users-microservice/internal/webhook"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/keepalive"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -41,7 +51,18 @@ func Bootstrap() *internal.Application {
 	app := &internal.Application{
 		Logger:         logger,
 		GRPCPort:       "8000",
+		HTTPPort:       "8080",
+		GrpcReflection: true,
 		ShutdownTimout: time.Second * 5,
+		Health:         health.NewServer(),
+		GrpcKeepalive: keepalive.ServerParameters{
+			Time:    time.Minute,
+			Timeout: 20 * time.Second,
+		},
+		GrpcKeepalivePolicy: keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		},
 	}
 
 	var (
@@ -60,37 +81,506 @@ func Bootstrap() *internal.Application {
 		collection = u
 	}
 
-	app.Repository, err = repository.NewMongoRepository(context.TODO(), uri, dbName, collection)
+	// one client is shared by the stores, so they share its connection pool and the health check of the repository
+	mongoClient, err := repository.ConnectMongo(context.TODO(), uri)
 	if err != nil {
-		app.Logger.With(slog.Any("error", err)).Error("could not connect to repository")
+		app.Logger.With(slog.Any("error", err)).Error("could not connect to mongodb")
+		os.Exit(1)
+	}
+	mongoDB := mongoClient.Database(dbName)
+
+	app.Repository, err = repository.NewMongoRepository(context.TODO(), mongoDB.Collection(collection))
+	if err != nil {
+		app.Logger.With(slog.Any("error", err)).Error("could not create repository")
 		app.GracefulShutdown()
 		os.Exit(1)
 	}
 
+	var healthOpts []server.HealthOption
+	if i, err := strconv.ParseInt(os.Getenv("HEALTH_CHECK_INTERVAL"), 10, 64); err == nil && i > 0 {
+		healthTimeout := 2 * time.Second
+		if j, err := strconv.ParseInt(os.Getenv("HEALTH_CHECK_TIMEOUT"), 10, 64); err == nil && j > 0 {
+			healthTimeout = time.Duration(j) * time.Second
+		}
+		healthOpts = append(healthOpts, server.WithHealthInterval(time.Duration(i)*time.Second, healthTimeout))
+	}
+
+	// the grpc services are only SERVING while all of their dependencies are reachable
+	healthChecker := server.NewHealthChecker(app.Health, app.Logger, []string{types.GrpcServiceName, ""}, healthOpts...)
+	healthChecker.AddCheck("mongo", app.Repository.Ping)
+
 	if i, err := strconv.ParseInt(os.Getenv("SHUTDOWN_GRACE"), 10, 64); err == nil {
 		app.ShutdownTimout = time.Duration(i) * time.Second
 	}
+	// added first so that the shared client is disconnected last
 	app.AddShutdownFunction(app.Repository.Shutdown)
 
-	var natsUri = "nats://nats:4222"
-	if n := os.Getenv("NATS_URI"); n != "" {
-		natsUri = n
+	var (
+		idempotencyCollection = "idempotency_keys"
+		idempotencyTTL        = 24 * time.Hour
+	)
+
+	if u := os.Getenv("MONGO_IDEMPOTENCY_COLLECTION"); u != "" {
+		idempotencyCollection = u
+	}
+	if i, err := strconv.ParseInt(os.Getenv("IDEMPOTENCY_TTL"), 10, 64); err == nil && i > 0 {
+		idempotencyTTL = time.Duration(i) * time.Second
 	}
-	app.PubSub, err = pubsub.NewNatsClient(app.Logger, natsUri)
+
+	app.Idempotency, err = repository.NewMongoIdempotencyStore(context.TODO(), mongoDB.Collection(idempotencyCollection), idempotencyTTL)
 	if err != nil {
-		app.Logger.With(slog.Any("error", err)).Error("could not connect to nats server")
+		app.Logger.With(slog.Any("error", err)).Error("could not create idempotency store")
 		app.GracefulShutdown()
 		os.Exit(1)
 	}
+
+	var (
+		webhookCollection  = "webhooks"
+		webhookDeliveryTTL = 7 * 24 * time.Hour
+	)
+
+	if u := os.Getenv("MONGO_WEBHOOK_COLLECTION"); u != "" {
+		webhookCollection = u
+	}
+	if i, err := strconv.ParseInt(os.Getenv("WEBHOOK_DELIVERY_LOG_TTL"), 10, 64); err == nil && i > 0 {
+		webhookDeliveryTTL = time.Duration(i) * time.Second
+	}
+
+	webhookRepo, err := repository.NewMongoWebhookRepository(context.TODO(), mongoDB.Collection(webhookCollection), webhookDeliveryTTL)
+	if err != nil {
+		app.Logger.With(slog.Any("error", err)).Error("could not create webhook repository")
+		app.GracefulShutdown()
+		os.Exit(1)
+	}
+
+	var (
+		natsUri            = "nats://nats:4222"
+		natsStream         = "USERS"
+		streamMaxAge       = 7 * 24 * time.Hour
+		subscriptionBuffer = 256
+		overflowPolicy     = pubsub.OverflowPolicyDisconnect
+	)
+	if n := os.Getenv("NATS_URI"); n != "" {
+		natsUri = n
+	}
+	if n := os.Getenv("NATS_STREAM"); n != "" {
+		natsStream = n
+	}
+	if i, err := strconv.ParseInt(os.Getenv("NATS_STREAM_MAX_AGE"), 10, 64); err == nil && i > 0 {
+		streamMaxAge = time.Duration(i) * time.Second
+	}
+	if i, err := strconv.ParseInt(os.Getenv("SUBSCRIPTION_BUFFER"), 10, 64); err == nil && i > 0 {
+		subscriptionBuffer = int(i)
+	}
+	switch p := pubsub.OverflowPolicy(os.Getenv("SUBSCRIPTION_OVERFLOW_POLICY")); p {
+	case pubsub.OverflowPolicyDropOldest, pubsub.OverflowPolicyDisconnect:
+		overflowPolicy = p
+	case "":
+	default:
+		slog.With("policy", p).Warn("Invalid subscription overflow policy supplied")
+	}
+
+	var (
+		connectTimeout   = nats.DefaultTimeout
+		maxReconnects    = nats.DefaultMaxReconnect
+		reconnectWait    = nats.DefaultReconnectWait
+		reconnectBufSize = nats.DefaultReconnectBufSize
+	)
+	if i, err := strconv.ParseInt(os.Getenv("NATS_CONNECT_TIMEOUT"), 10, 64); err == nil && i > 0 {
+		connectTimeout = time.Duration(i) * time.Second
+	}
+	if i, err := strconv.ParseInt(os.Getenv("NATS_MAX_RECONNECTS"), 10, 64); err == nil && i >= -1 {
+		maxReconnects = int(i)
+	}
+	if i, err := strconv.ParseInt(os.Getenv("NATS_RECONNECT_WAIT"), 10, 64); err == nil && i > 0 {
+		reconnectWait = time.Duration(i) * time.Second
+	}
+	if i, err := strconv.ParseInt(os.Getenv("NATS_RECONNECT_BUFFER"), 10, 64); err == nil && i > 0 {
+		reconnectBufSize = int(i)
+	}
+
+	var (
+		eventFormat = pubsub.EventFormatProtobuf
+		eventSource = "users-microservice"
+	)
+	switch f := pubsub.EventFormat(os.Getenv("NATS_EVENT_FORMAT")); f {
+	case pubsub.EventFormatProtobuf, pubsub.EventFormatCloudEventsBinary, pubsub.EventFormatCloudEventsStructured:
+		eventFormat = f
+	case "":
+	default:
+		slog.With("format", f).Warn("Invalid nats event format supplied")
+	}
+	if s := os.Getenv("NATS_EVENT_SOURCE"); s != "" {
+		eventSource = s
+	}
+
+	var (
+		publishQueueSize   = 1024
+		publishBatchSize   = 64
+		publishMaxAttempts = 5
+	)
+	if i, err := strconv.ParseInt(os.Getenv("NATS_PUBLISH_QUEUE"), 10, 64); err == nil && i >= 0 {
+		publishQueueSize = int(i)
+	}
+	if i, err := strconv.ParseInt(os.Getenv("NATS_PUBLISH_BATCH"), 10, 64); err == nil && i > 0 {
+		publishBatchSize = int(i)
+	}
+	if i, err := strconv.ParseInt(os.Getenv("NATS_PUBLISH_MAX_ATTEMPTS"), 10, 64); err == nil && i > 0 {
+		publishMaxAttempts = int(i)
+	}
+
+	natsOpts := []pubsub.Option{
+		pubsub.WithStream(natsStream, streamMaxAge),
+		pubsub.WithEventFormat(eventFormat, eventSource),
+		pubsub.WithAsyncPublish(publishQueueSize, publishBatchSize, publishMaxAttempts),
+		pubsub.WithSubscriptionBuffer(subscriptionBuffer, overflowPolicy),
+		pubsub.WithConnectTimeout(connectTimeout),
+		pubsub.WithReconnect(maxReconnects, reconnectWait, reconnectBufSize),
+		pubsub.WithStatusHandler(func(bool) {
+			healthChecker.Trigger()
+		}),
+	}
+
+	switch backend := os.Getenv("PUBSUB_BACKEND"); backend {
+	case "memory":
+		app.PubSub = pubsub.NewMemoryPubSub(app.Logger, natsOpts...)
+	case "embedded":
+		var (
+			storeDir = filepath.Join(os.TempDir(), "users-nats")
+			port     = 0
+		)
+		if d := os.Getenv("NATS_EMBEDDED_STORE_DIR"); d != "" {
+			storeDir = d
+		}
+		if i, err := strconv.ParseInt(os.Getenv("NATS_EMBEDDED_PORT"), 10, 64); err == nil && i > 0 && i <= 65535 {
+			port = int(i)
+		}
+
+		embedded, err := pubsub.StartEmbeddedNats(storeDir, port)
+		if err != nil {
+			app.Logger.With(slog.Any("error", err)).Error("could not start embedded nats server")
+			app.GracefulShutdown()
+			os.Exit(1)
+		}
+		app.AddShutdownFunction(embedded.Shutdown)
+
+		app.PubSub, err = pubsub.NewNatsClient(app.Logger, embedded.ClientURL(), append(natsOpts, pubsub.WithInProcessServer(embedded))...)
+		if err != nil {
+			app.Logger.With(slog.Any("error", err)).Error("could not connect to embedded nats server")
+			app.GracefulShutdown()
+			os.Exit(1)
+		}
+	default:
+		if backend != "" && backend != "nats" {
+			slog.With("backend", backend).Warn("Invalid pubsub backend supplied, using nats")
+		}
+
+		authOpts, err := natsAuthOptionsFromEnv()
+		if err != nil {
+			app.Logger.With(slog.Any("error", err)).Error("invalid nats authentication settings")
+			app.GracefulShutdown()
+			os.Exit(1)
+		}
+
+		app.PubSub, err = pubsub.NewNatsClient(app.Logger, natsUri, append(natsOpts, authOpts...)...)
+		if err != nil {
+			app.Logger.With(slog.Any("error", err)).Error("could not connect to nats server")
+			app.GracefulShutdown()
+			os.Exit(1)
+		}
+	}
 	app.AddShutdownFunction(app.PubSub.GracefulShutdown)
 
+	if nc, ok := pubsub.NatsConn(app.PubSub); ok {
+		healthChecker.AddCheck("nats", func(context.Context) error {
+			if !nc.IsConnected() {
+				return fmt.Errorf("nats connection is %s", nc.Status())
+			}
+			return nil
+		})
+	}
+
 	app.Domain = domain.NewUserService(app.Repository, app.PubSub)
+	webhookTargets := webhook.NewTargetPolicy(webhookTargetOptionsFromEnv()...)
+	app.Webhooks = domain.NewWebhookService(webhookRepo, webhookTargets)
+
+	webhookDelivery, err := strconv.ParseBool(os.Getenv("WEBHOOK_DELIVERY"))
+	if os.Getenv("WEBHOOK_DELIVERY") == "" {
+		webhookDelivery = true
+	} else if err != nil {
+		slog.With("webhookDelivery", os.Getenv("WEBHOOK_DELIVERY")).Warn("Invalid webhook delivery environment variable supplied")
+	}
+
+	queues, ok := app.PubSub.(internal.ChangeQueues)
+	if webhookDelivery && !ok {
+		app.Logger.Warn("Webhook delivery needs the nats or embedded pubsub backend, webhooks are not delivered")
+		webhookDelivery = false
+	}
+
+	if webhookDelivery {
+		dispatcher := webhook.NewDispatcher(app.Logger, webhookRepo, queues, append(webhookOptionsFromEnv(), webhook.WithTargetPolicy(webhookTargets))...)
+		if err := dispatcher.Start(); err != nil {
+			app.Logger.With(slog.Any("error", err)).Error("could not start webhook delivery")
+			app.GracefulShutdown()
+			os.Exit(1)
+		}
+		app.AddShutdownFunction(dispatcher.GracefulShutdown)
+	}
+
+	healthChecker.Start()
+	app.AddShutdownFunction(healthChecker.Shutdown)
+
+	if jwks := os.Getenv("AUTH_JWKS"); jwks != "" {
+		app.Authenticator, err = auth.NewAuthenticator(jwks, app.Logger, authOptionsFromEnv()...)
+		if err != nil {
+			app.Logger.With(slog.Any("error", err)).Error("could not create authenticator")
+			app.GracefulShutdown()
+			os.Exit(1)
+		}
+	} else {
+		app.Logger.Warn("AUTH_JWKS is not set, the grpc and http apis are not authenticated")
+	}
+
+	if certFile, keyFile := os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY"); certFile != "" || keyFile != "" {
+		app.GrpcTLS, err = server.NewTLSConfig(certFile, keyFile, os.Getenv("GRPC_TLS_CLIENT_CA"), app.Logger)
+		if err != nil {
+			app.Logger.With(slog.Any("error", err)).Error("could not load grpc tls certificates")
+			app.GracefulShutdown()
+			os.Exit(1)
+		}
+	}
+
+	if sanitize, err := strconv.ParseBool(os.Getenv("SANITIZE_ERRORS")); err == nil {
+		app.SanitizeErrors = sanitize
+	} else if os.Getenv("SANITIZE_ERRORS") != "" {
+		slog.With("sanitizeErrors", os.Getenv("SANITIZE_ERRORS")).Warn("Invalid sanitize errors environment variable supplied")
+	}
+
+	if reflection, err := strconv.ParseBool(os.Getenv("GRPC_REFLECTION")); err == nil {
+		app.GrpcReflection = reflection
+	}
 
 	if port := os.Getenv("GRPC_PORT"); port != "" {
 		app.GRPCPort = port
 	}
+	if port := os.Getenv("HTTP_PORT"); port != "" {
+		app.HTTPPort = port
+	}
+
+	if i, err := strconv.ParseInt(os.Getenv("GRPC_KEEPALIVE_TIME"), 10, 64); err == nil && i > 0 {
+		app.GrpcKeepalive.Time = time.Duration(i) * time.Second
+	}
+	if i, err := strconv.ParseInt(os.Getenv("GRPC_KEEPALIVE_TIMEOUT"), 10, 64); err == nil && i > 0 {
+		app.GrpcKeepalive.Timeout = time.Duration(i) * time.Second
+	}
+	if i, err := strconv.ParseInt(os.Getenv("GRPC_KEEPALIVE_MIN_TIME"), 10, 64); err == nil && i > 0 {
+		app.GrpcKeepalivePolicy.MinTime = time.Duration(i) * time.Second
+	}
+
+	var serviceOpts []service.Option
+	if i, err := strconv.ParseInt(os.Getenv("SUBSCRIPTION_HEARTBEAT_INTERVAL"), 10, 64); err == nil && i >= 0 {
+		serviceOpts = append(serviceOpts, service.WithHeartbeatInterval(time.Duration(i)*time.Second))
+	}
+
+	app.UserGrpcServer = service.NewUsersGrpc(app.Domain, app.Webhooks, app.Logger, serviceOpts...)
+
+	natsMicro, _ := strconv.ParseBool(os.Getenv("NATS_MICRO"))
+	natsCommands, _ := strconv.ParseBool(os.Getenv("NATS_COMMANDS"))
+	if !natsMicro && !natsCommands {
+		return app
+	}
+
+	nc, ok := pubsub.NatsConn(app.PubSub)
+	if !ok {
+		app.Logger.Error("nats micro service and commands require a nats pubsub backend")
+		app.GracefulShutdown()
+		os.Exit(1)
+	}
 
-	app.UserGrpcServer = service.NewUsersGrpc(app.Domain, app.Logger)
+	if natsMicro {
+		microOpts := []server.MicroOption{server.WithMicroErrorSanitization(app.SanitizeErrors)}
+		if p := os.Getenv("NATS_MICRO_SUBJECT_PREFIX"); p != "" {
+			microOpts = append(microOpts, server.WithMicroSubjectPrefix(p))
+		}
+		if i, err := strconv.ParseInt(os.Getenv("NATS_MICRO_REQUEST_TIMEOUT"), 10, 64); err == nil && i > 0 {
+			microOpts = append(microOpts, server.WithMicroRequestTimeout(time.Duration(i)*time.Second))
+		}
+		if app.Authenticator != nil {
+			microOpts = append(microOpts, server.WithMicroAuthenticator(app.Authenticator))
+		}
+
+		svc, err := server.NewNatsMicro(nc, app.UserGrpcServer, app.Logger, microOpts...)
+		if err != nil {
+			app.Logger.With(slog.Any("error", err)).Error("could not start nats micro service")
+			app.GracefulShutdown()
+			os.Exit(1)
+		}
+		app.AddShutdownFunction(func(context.Context) error { return svc.Stop() })
+	}
+
+	if natsCommands {
+		var (
+			commandSubject = "commands.users.v1"
+			queueGroup     = "users"
+			commandOpts    = []server.CommandOption{server.WithCommandErrorSanitization(app.SanitizeErrors)}
+		)
+		if s := os.Getenv("NATS_COMMAND_SUBJECT"); s != "" {
+			commandSubject = s
+		}
+		if g := os.Getenv("NATS_COMMAND_QUEUE_GROUP"); g != "" {
+			queueGroup = g
+		}
+		commandOpts = append(commandOpts, server.WithCommandSubject(commandSubject, queueGroup))
+
+		if s := os.Getenv("NATS_COMMAND_DEAD_LETTER_SUBJECT"); s != "" {
+			commandOpts = append(commandOpts, server.WithCommandDeadLetterSubject(s))
+		}
+		if i, err := strconv.ParseInt(os.Getenv("NATS_COMMAND_TIMEOUT"), 10, 64); err == nil && i > 0 {
+			commandOpts = append(commandOpts, server.WithCommandTimeout(time.Duration(i)*time.Second))
+		}
+		if app.Authenticator != nil {
+			commandOpts = append(commandOpts, server.WithCommandAuthenticator(app.Authenticator))
+		}
+
+		consumer, err := server.NewNatsCommandConsumer(nc, app.UserGrpcServer, app.Logger, commandOpts...)
+		if err != nil {
+			app.Logger.With(slog.Any("error", err)).Error("could not start nats command consumer")
+			app.GracefulShutdown()
+			os.Exit(1)
+		}
+		app.AddShutdownFunction(consumer.Shutdown)
+	}
 
 	return app
 }
+
+// webhookOptionsFromEnv configures retries and timeouts of webhook deliveries
+func webhookOptionsFromEnv() []webhook.Option {
+	var (
+		maxAttempts    = 5
+		initialBackoff = time.Second
+		maxBackoff     = time.Minute
+		opts           []webhook.Option
+	)
+
+	if i, err := strconv.ParseInt(os.Getenv("WEBHOOK_MAX_ATTEMPTS"), 10, 64); err == nil && i > 0 {
+		maxAttempts = int(i)
+	}
+	if i, err := strconv.ParseInt(os.Getenv("WEBHOOK_INITIAL_BACKOFF"), 10, 64); err == nil && i > 0 {
+		initialBackoff = time.Duration(i) * time.Second
+	}
+	if i, err := strconv.ParseInt(os.Getenv("WEBHOOK_MAX_BACKOFF"), 10, 64); err == nil && i > 0 {
+		maxBackoff = time.Duration(i) * time.Second
+	}
+	opts = append(opts, webhook.WithRetries(maxAttempts, initialBackoff, maxBackoff))
+
+	if i, err := strconv.ParseInt(os.Getenv("WEBHOOK_TIMEOUT"), 10, 64); err == nil && i > 0 {
+		opts = append(opts, webhook.WithTimeout(time.Duration(i)*time.Second))
+	}
+	if i, err := strconv.ParseInt(os.Getenv("WEBHOOK_REFRESH_INTERVAL"), 10, 64); err == nil && i > 0 {
+		opts = append(opts, webhook.WithRefreshInterval(time.Duration(i)*time.Second))
+	}
+
+	return opts
+}
+
+// webhookTargetOptionsFromEnv restricts the hosts webhooks can be registered for, by default any public host
+func webhookTargetOptionsFromEnv() []webhook.TargetOption {
+	var opts []webhook.TargetOption
+
+	if hosts := os.Getenv("WEBHOOK_ALLOWED_HOSTS"); hosts != "" {
+		opts = append(opts, webhook.WithAllowedHosts(strings.Split(hosts, ",")...))
+	}
+
+	allowPrivate, err := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE_TARGETS"))
+	if os.Getenv("WEBHOOK_ALLOW_PRIVATE_TARGETS") != "" && err != nil {
+		slog.With("allowPrivateTargets", os.Getenv("WEBHOOK_ALLOW_PRIVATE_TARGETS")).Warn("Invalid webhook allow private targets environment variable supplied")
+	}
+	if allowPrivate {
+		opts = append(opts, webhook.WithPrivateTargets())
+	}
+
+	return opts
+}
+
+// natsAuthOptionsFromEnv configures authentication and tls for an external nats server, secrets are only read from files
+func natsAuthOptionsFromEnv() ([]pubsub.Option, error) {
+	var opts []pubsub.Option
+
+	if f := os.Getenv("NATS_CREDS_FILE"); f != "" {
+		opts = append(opts, pubsub.WithCredentialsFile(f))
+	}
+	if f := os.Getenv("NATS_NKEY_SEED_FILE"); f != "" {
+		opts = append(opts, pubsub.WithNkeySeedFile(f))
+	}
+	if f := os.Getenv("NATS_PASSWORD_FILE"); f != "" || os.Getenv("NATS_USER") != "" {
+		password, err := readSecretFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read nats password: %w", err)
+		}
+		opts = append(opts, pubsub.WithUserPassword(os.Getenv("NATS_USER"), password))
+	}
+	if f := os.Getenv("NATS_TOKEN_FILE"); f != "" {
+		token, err := readSecretFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read nats token: %w", err)
+		}
+		opts = append(opts, pubsub.WithToken(token))
+	}
+
+	var (
+		caFile     = os.Getenv("NATS_TLS_CA_FILE")
+		certFile   = os.Getenv("NATS_TLS_CERT_FILE")
+		keyFile    = os.Getenv("NATS_TLS_KEY_FILE")
+		serverName = os.Getenv("NATS_TLS_SERVER_NAME")
+	)
+	if caFile != "" || certFile != "" || keyFile != "" || serverName != "" {
+		opts = append(opts, pubsub.WithTLS(caFile, certFile, keyFile, serverName))
+	}
+
+	return opts, nil
+}
+
+// readSecretFile returns the content of path without surrounding whitespace, such as the trailing newline of mounted secrets
+func readSecretFile(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("no file given")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+func authOptionsFromEnv() []auth.Option {
+	var opts []auth.Option
+
+	if issuer := os.Getenv("AUTH_ISSUER"); issuer != "" {
+		opts = append(opts, auth.WithIssuer(issuer))
+	}
+	if audience := os.Getenv("AUTH_AUDIENCE"); audience != "" {
+		opts = append(opts, auth.WithAudience(audience))
+	}
+	if i, err := strconv.ParseInt(os.Getenv("AUTH_JWKS_REFRESH_INTERVAL"), 10, 64); err == nil && i > 0 {
+		opts = append(opts, auth.WithRefreshInterval(time.Duration(i)*time.Second))
+	}
+
+	// method=scope pairs, e.g. "list=users:admin,get=users:admin"
+	if pairs := os.Getenv("AUTH_METHOD_SCOPES"); pairs != "" {
+		scopes := make(map[string]string)
+		for _, pair := range strings.Split(pairs, ",") {
+			method, scope, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || method == "" || scope == "" {
+				slog.With("pair", pair).Warn("Invalid method scope in AUTH_METHOD_SCOPES")
+				continue
+			}
+			scopes[method] = scope
+		}
+		opts = append(opts, auth.WithMethodScopes(scopes))
+	}
+
+	return opts
+}
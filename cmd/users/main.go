@@ -2,52 +2,70 @@ package main
 
 import (
 	"context"
+	"errors"
 	"github.com/captainlettuce/users-microservice/cmd"
 	"github.com/captainlettuce/users-microservice/generated"
 	"github.com/captainlettuce/users-microservice/internal/server"
-	"github.com/captainlettuce/users-microservice/internal/types"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
-	"google.golang.org/grpc/health/grpc_health_v1"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 )
 
 func main() {
 
 	killSignal := make(chan struct{})
 
+	// both servers and the signal handler may stop the app
+	stop := sync.OnceFunc(func() { close(killSignal) })
+
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		select {
 		case <-c:
-			close(killSignal)
+			stop()
 		case <-killSignal:
 			return
 		}
 	}()
 
 	app := cmd.Bootstrap()
-	grpcServer := server.NewGrpc(func(s *grpc.Server, hs *health.Server) {
-		generated.RegisterUsersServiceServer(s, app.UserGrpcServer)
-		hs.SetServingStatus(types.GrpcServiceName, grpc_health_v1.HealthCheckResponse_SERVING)
-		hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
-	})
 
+	// subscribe streams only end when their context is cancelled, so cancel them when shutting down
+	streamCtx, cancelStreams := context.WithCancel(context.Background())
+	grpcServer := server.NewGrpc(
+		func(s *grpc.Server, _ *health.Server) {
+			generated.RegisterUsersServiceServer(s, app.UserGrpcServer)
+		},
+		server.WithIdempotencyStore(app.Idempotency),
+		server.WithHealthServer(app.Health),
+		server.WithKeepalive(app.GrpcKeepalive, app.GrpcKeepalivePolicy),
+		server.WithReflection(app.GrpcReflection),
+		server.WithAuthenticator(app.Authenticator),
+		server.WithTLS(app.GrpcTLS),
+		server.WithErrorSanitization(app.SanitizeErrors),
+		server.WithStreamContext(streamCtx),
+	)
+
+	// GracefulStop waits for open streams, which would otherwise only end when pubsub is shut down after it
 	app.AddShutdownFunction(func(_ context.Context) error {
+		cancelStreams()
 		grpcServer.GracefulStop()
 		return nil
 	})
 
-	go func(s chan struct{}) {
+	go func() {
 		listen, err := net.Listen("tcp", ":"+app.GRPCPort)
 		if err != nil {
 			app.Logger.With("error", err).Error("failed to listen on grpc port")
-			close(s)
+			stop()
 			return
 		}
 
@@ -56,9 +74,44 @@ func main() {
 		err = grpcServer.Serve(listen)
 		if err != nil {
 			app.Logger.Error("failed to serve grpc server", slog.Any("error", err))
-			close(s)
+			stop()
 		}
-	}(killSignal)
+	}()
+
+	// event streams only end when their request context is cancelled, so cancel them when shutting down
+	httpCtx, cancelHttp := context.WithCancel(context.Background())
+	gateway := server.NewHttpGateway(
+		app.UserGrpcServer,
+		app.Logger,
+		server.WithHttpAuthenticator(app.Authenticator),
+		server.WithHttpErrorSanitization(app.SanitizeErrors),
+	)
+	httpServer := &http.Server{
+		Addr:              ":" + app.HTTPPort,
+		Handler:           gateway,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return httpCtx },
+	}
+	httpServer.RegisterOnShutdown(cancelHttp)
+
+	app.AddShutdownFunction(httpServer.Shutdown)
+
+	go func() {
+		app.Logger.With(slog.String("port", app.HTTPPort)).Info("http server starting")
+
+		err := httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.Logger.Error("failed to serve http server", slog.Any("error", err))
+			stop()
+		}
+	}()
+
+	// shutdown functions run in reverse order, so this runs before the servers stop and callers are routed elsewhere
+	// while in-flight requests finish, the health server ignores the status updates of later checks
+	app.AddShutdownFunction(func(context.Context) error {
+		app.Health.Shutdown()
+		return nil
+	})
 
 	<-killSignal
 	app.GracefulShutdown()
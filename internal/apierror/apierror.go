@@ -0,0 +1,158 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// Domain is the domain of the ErrorInfo detail of errors
+const Domain = types.GrpcServiceName
+
+// Reasons are the stable, machine readable causes of errors, sent as the reason of the ErrorInfo detail
+// reasons are never changed or removed once added, clients may rely on them
+const (
+	ReasonInvalidArgument          = "INVALID_ARGUMENT"
+	ReasonInvalidUserId            = "INVALID_USER_ID"
+	ReasonInvalidEmail             = "INVALID_EMAIL"
+	ReasonDuplicateUserId          = "DUPLICATE_USER_ID"
+	ReasonDuplicateEmail           = "DUPLICATE_EMAIL"
+	ReasonNotFound                 = "NOT_FOUND"
+	ReasonEmptyFilter              = "EMPTY_FILTER"
+	ReasonLimitExceeded            = "LIMIT_EXCEEDED"
+	ReasonInvalidSubscriptionStart = "INVALID_SUBSCRIPTION_START"
+	ReasonSubscriberLagging        = "SUBSCRIBER_LAGGING"
+	ReasonSubscriptionTerminated   = "SUBSCRIPTION_TERMINATED"
+	ReasonInvalidWebhookUrl        = "INVALID_WEBHOOK_URL"
+	ReasonWebhooksDisabled         = "WEBHOOKS_DISABLED"
+	ReasonIdempotencyKeyReused     = "IDEMPOTENCY_KEY_REUSED"
+	ReasonRequestInProgress        = "REQUEST_IN_PROGRESS"
+	ReasonUnauthenticated          = "UNAUTHENTICATED"
+	ReasonScopeRequired            = "SCOPE_REQUIRED"
+	ReasonMethodNotAllowed         = "METHOD_NOT_ALLOWED"
+	ReasonCanceled                 = "CANCELED"
+	ReasonDeadlineExceeded         = "DEADLINE_EXCEEDED"
+	ReasonInternal                 = "INTERNAL"
+)
+
+// catalog is the status code and reason of the errors of the domain, the first match is used
+// each error has a single code, handlers don't override it
+var catalog = []struct {
+	err    error
+	code   codes.Code
+	reason string
+}{
+	{types.ErrInvalidUserId, codes.InvalidArgument, ReasonInvalidUserId},
+	{types.ErrInvalidEmail, codes.InvalidArgument, ReasonInvalidEmail},
+	{types.ErrDuplicateUserId, codes.AlreadyExists, ReasonDuplicateUserId},
+	{types.ErrDuplicateEmail, codes.AlreadyExists, ReasonDuplicateEmail},
+	{types.ErrNotFound, codes.NotFound, ReasonNotFound},
+	{types.ErrEmptyFilter, codes.InvalidArgument, ReasonEmptyFilter},
+	{types.ErrLimitExceeded, codes.InvalidArgument, ReasonLimitExceeded},
+	{types.ErrInvalidSubscriptionStart, codes.InvalidArgument, ReasonInvalidSubscriptionStart},
+	{types.ErrSubscriberLagging, codes.ResourceExhausted, ReasonSubscriberLagging},
+	{types.ErrInvalidWebhookUrl, codes.InvalidArgument, ReasonInvalidWebhookUrl},
+	{context.DeadlineExceeded, codes.DeadlineExceeded, ReasonDeadlineExceeded},
+	{context.Canceled, codes.Canceled, ReasonCanceled},
+}
+
+// New returns a status error with an ErrorInfo detail holding reason
+func New(code codes.Code, reason, message string) error {
+	return withDetails(status.New(code, message), errorInfo(reason)).Err()
+}
+
+// FromError translates err to a status error. Status errors are returned as they are, errors of the catalog get
+// their code and reason and anything else is an Internal error
+func FromError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	code, reason := codes.Internal, ReasonInternal
+	for _, e := range catalog {
+		if errors.Is(err, e.err) {
+			code, reason = e.code, e.reason
+			break
+		}
+	}
+
+	return New(code, reason, err.Error())
+}
+
+// InvalidArgument returns an InvalidArgument error with a BadRequest field violation of field, e.g. "user.id"
+// the reason is that of err if it is an invalid argument error of the catalog, otherwise INVALID_ARGUMENT
+func InvalidArgument(field string, err error) error {
+	reason := ReasonInvalidArgument
+	for _, e := range catalog {
+		if e.code == codes.InvalidArgument && errors.Is(err, e.err) {
+			reason = e.reason
+			break
+		}
+	}
+
+	violation := &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: field, Description: err.Error()}},
+	}
+
+	return withDetails(status.New(codes.InvalidArgument, "invalid "+field+": "+err.Error()), errorInfo(reason), violation).Err()
+}
+
+// Sanitize replaces the message of Internal and Unknown errors, which may hold e.g. database errors, with a generic
+// text including requestId so that callers can refer to the logged error. Other errors are returned as they are
+func Sanitize(err error, requestId string) error {
+	if err == nil {
+		return nil
+	}
+
+	st := status.Convert(err)
+	if st.Code() != codes.Internal && st.Code() != codes.Unknown && st.Code() != codes.DataLoss {
+		return err
+	}
+
+	info := errorInfo(ReasonInternal)
+	for _, d := range st.Details() {
+		if i, ok := d.(*errdetails.ErrorInfo); ok {
+			info = i
+		}
+	}
+
+	if requestId == "" {
+		return withDetails(status.New(st.Code(), "internal error"), info).Err()
+	}
+
+	return withDetails(
+		status.New(st.Code(), "internal error, request id "+requestId),
+		info,
+		&errdetails.RequestInfo{RequestId: requestId},
+	).Err()
+}
+
+// Reason returns the reason of the ErrorInfo detail of err, or an empty string if it has none
+func Reason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if i, ok := d.(*errdetails.ErrorInfo); ok {
+			return i.GetReason()
+		}
+	}
+	return ""
+}
+
+func errorInfo(reason string) *errdetails.ErrorInfo {
+	return &errdetails.ErrorInfo{Reason: reason, Domain: Domain}
+}
+
+func withDetails(st *status.Status, details ...protoadapt.MessageV1) *status.Status {
+	withDetails, err := st.WithDetails(details...)
+	if err != nil {
+		// only happens for OK statuses or details that can't be marshalled
+		return st
+	}
+	return withDetails
+}
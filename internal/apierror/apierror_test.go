@@ -0,0 +1,212 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestFromError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCode    codes.Code
+		wantReason  string
+		wantMessage string
+	}{
+		{
+			name:        "catalog error",
+			err:         types.ErrNotFound,
+			wantCode:    codes.NotFound,
+			wantReason:  ReasonNotFound,
+			wantMessage: types.ErrNotFound.Error(),
+		},
+		{
+			name:        "wrapped catalog error",
+			err:         fmt.Errorf("%w: %w", types.ErrInvalidUserId, errors.New("invalid UUID length: 3")),
+			wantCode:    codes.InvalidArgument,
+			wantReason:  ReasonInvalidUserId,
+			wantMessage: "invalid UUID length: 3",
+		},
+		{
+			name:        "duplicate user id",
+			err:         types.ErrDuplicateUserId,
+			wantCode:    codes.AlreadyExists,
+			wantReason:  ReasonDuplicateUserId,
+			wantMessage: types.ErrDuplicateUserId.Error(),
+		},
+		{
+			name:        "duplicate email",
+			err:         types.ErrDuplicateEmail,
+			wantCode:    codes.AlreadyExists,
+			wantReason:  ReasonDuplicateEmail,
+			wantMessage: types.ErrDuplicateEmail.Error(),
+		},
+		{
+			name:        "limit exceeded",
+			err:         fmt.Errorf("filter matched 2000 users (max 1000): %w", types.ErrLimitExceeded),
+			wantCode:    codes.InvalidArgument,
+			wantReason:  ReasonLimitExceeded,
+			wantMessage: "filter matched 2000 users",
+		},
+		{
+			name:       "context error",
+			err:        fmt.Errorf("could not find users: %w", context.DeadlineExceeded),
+			wantCode:   codes.DeadlineExceeded,
+			wantReason: ReasonDeadlineExceeded,
+		},
+		{
+			name:        "status errors are kept",
+			err:         New(codes.Aborted, ReasonRequestInProgress, "in progress"),
+			wantCode:    codes.Aborted,
+			wantReason:  ReasonRequestInProgress,
+			wantMessage: "in progress",
+		},
+		{
+			name:        "unknown errors are internal",
+			err:         errors.New("connection refused"),
+			wantCode:    codes.Internal,
+			wantReason:  ReasonInternal,
+			wantMessage: "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := FromError(tt.err)
+
+			st := status.Convert(err)
+			require.Equal(t, tt.wantCode, st.Code())
+			require.Contains(t, st.Message(), tt.wantMessage)
+			require.Equal(t, tt.wantReason, Reason(err))
+		})
+	}
+
+	require.NoError(t, FromError(nil))
+}
+
+func Test_catalog(t *testing.T) {
+	seen := make(map[error]bool, len(catalog))
+	for _, e := range catalog {
+		require.False(t, seen[e.err], "%v is in the catalog more than once", e.err)
+		seen[e.err] = true
+	}
+}
+
+func TestInvalidArgument(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantReason string
+	}{
+		{
+			name:       "catalog error",
+			err:        fmt.Errorf("%w: bad", types.ErrInvalidEmail),
+			wantReason: ReasonInvalidEmail,
+		},
+		{
+			name:       "catalog error with another code",
+			err:        types.ErrNotFound,
+			wantReason: ReasonInvalidArgument,
+		},
+		{
+			name:       "other error",
+			err:        errors.New("must be positive"),
+			wantReason: ReasonInvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := InvalidArgument("user.email", tt.err)
+
+			st := status.Convert(err)
+			require.Equal(t, codes.InvalidArgument, st.Code())
+			require.Equal(t, "invalid user.email: "+tt.err.Error(), st.Message())
+			require.Equal(t, tt.wantReason, Reason(err))
+
+			var violations []*errdetails.BadRequest_FieldViolation
+			for _, d := range st.Details() {
+				if b, ok := d.(*errdetails.BadRequest); ok {
+					violations = b.GetFieldViolations()
+				}
+			}
+			require.Len(t, violations, 1)
+			require.Equal(t, "user.email", violations[0].GetField())
+			require.Equal(t, tt.err.Error(), violations[0].GetDescription())
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		requestId     string
+		wantCode      codes.Code
+		wantReason    string
+		wantMessage   string
+		wantRequestId string
+	}{
+		{
+			name:          "internal error",
+			err:           FromError(errors.New("mongo: connection refused")),
+			requestId:     "abc",
+			wantCode:      codes.Internal,
+			wantReason:    ReasonInternal,
+			wantMessage:   "internal error, request id abc",
+			wantRequestId: "abc",
+		},
+		{
+			name:        "internal error without request id",
+			err:         FromError(errors.New("mongo: connection refused")),
+			wantCode:    codes.Internal,
+			wantReason:  ReasonInternal,
+			wantMessage: "internal error",
+		},
+		{
+			name:          "unknown error without reason",
+			err:           status.Error(codes.Unknown, "panic: nil map"),
+			requestId:     "abc",
+			wantCode:      codes.Unknown,
+			wantReason:    ReasonInternal,
+			wantMessage:   "internal error, request id abc",
+			wantRequestId: "abc",
+		},
+		{
+			name:        "other errors are kept",
+			err:         FromError(types.ErrNotFound),
+			requestId:   "abc",
+			wantCode:    codes.NotFound,
+			wantReason:  ReasonNotFound,
+			wantMessage: types.ErrNotFound.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Sanitize(tt.err, tt.requestId)
+
+			st := status.Convert(err)
+			require.Equal(t, tt.wantCode, st.Code())
+			require.Equal(t, tt.wantMessage, st.Message())
+			require.Equal(t, tt.wantReason, Reason(err))
+
+			var requestId string
+			for _, d := range st.Details() {
+				if i, ok := d.(*errdetails.RequestInfo); ok {
+					requestId = i.GetRequestId()
+				}
+			}
+			require.Equal(t, tt.wantRequestId, requestId)
+		})
+	}
+
+	require.NoError(t, Sanitize(nil, "abc"))
+}
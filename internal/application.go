@@ -2,9 +2,13 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/auth"
 	"github.com/captainlettuce/users-microservice/internal/types"
 	"github.com/google/uuid"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/keepalive"
 	"log/slog"
 	"time"
 )
@@ -16,8 +20,30 @@ type Application struct {
 	Repository     UserRepository
 	UserGrpcServer generated.UsersServiceServer
 	PubSub         PubSubService
+	Idempotency    IdempotencyStore
+	Webhooks       WebhookService
+
+	// Authenticator authenticates and authorizes callers of the grpc and http apis, nil disables authentication
+	Authenticator *auth.Authenticator
+
+	// Health reports the serving status of the grpc services, e.g. NOT_SERVING while nats is unreachable
+	Health *health.Server
 
 	GRPCPort string
+	HTTPPort string
+
+	// GrpcKeepalive and GrpcKeepalivePolicy make the grpc server close half-open connections
+	GrpcKeepalive       keepalive.ServerParameters
+	GrpcKeepalivePolicy keepalive.EnforcementPolicy
+
+	// GrpcTLS serves the grpc api with tls, nil serves plaintext
+	GrpcTLS *tls.Config
+
+	// SanitizeErrors replaces the message of internal errors returned to callers with a generic text and the request id
+	SanitizeErrors bool
+
+	// GrpcReflection registers the server reflection service
+	GrpcReflection bool
 
 	// ShutdownTimeout represents how long to wait for o
 	ShutdownTimout    time.Duration
@@ -29,17 +55,31 @@ type UserRepository interface {
 	// Shutdown is run before app close and can be used to release resources
 	Shutdown(ctx context.Context) error
 
+	// Ping returns an error if the database is not reachable
+	Ping(ctx context.Context) error
+
 	// Add adds a new user to the database
 	Add(ctx context.Context, user *types.User) error
 
 	// UpdatePartial updates only the fields set to a non-nil pointer
 	// If a field is set to a pointer to the corresponding types zero-value; the field will be unset
-	UpdatePartial(ctx context.Context, filter types.UserFilter, fields types.UpdateUserFields) (types.User, error)
+	// updated_at is set and the revision incremented, returns the user before and after the update
+	UpdatePartial(ctx context.Context, filter types.UserFilter, fields types.UpdateUserFields) (before types.User, after types.User, err error)
+
+	// Upsert atomically inserts the user, or updates the existing user matching the key field
+	// fields set to their zero-value are left untouched on update
+	// CreatedAt is only written when inserting and UpdatedAt only when updating
+	// returns the user before (nil if it was created) and after the upsert
+	Upsert(ctx context.Context, user types.User, key types.UpsertKey) (before *types.User, after types.User, err error)
 
 	// Delete permanently removes a user
 	// returns nil if the userId is not found
 	Delete(ctx context.Context, userId uuid.UUID) error
 
+	// DeleteMany permanently removes all users with the given ids
+	// returns the number of users actually removed
+	DeleteMany(ctx context.Context, userIds []uuid.UUID) (uint64, error)
+
 	// List filtered users
 	// takes a set of filters and an offset/limit-based paging entity
 	// returns a slice of users along with a total count for the executed filter
@@ -55,9 +95,18 @@ type UserService interface {
 	// Update an existing user, returns an error if no user found using the filter provided
 	UpdatePartial(ctx context.Context, filter types.UserFilter, fields types.UpdateUserFields) error
 
+	// Upsert adds a new user or updates the existing user matching the key field of the user
+	// the user is updated to the stored state, returns true if the user was created
+	Upsert(ctx context.Context, user *types.User, key types.UpsertKey) (bool, error)
+
 	// Delete an existing user, returns nil if the user does not exist
 	Delete(ctx context.Context, userId uuid.UUID) error
 
+	// DeleteMany removes all users matching the filter
+	// empty filters are refused, as are filters matching more users than allowed in a single call
+	// if dryRun is set nothing is removed, the matched count and a sample of ids are returned instead
+	DeleteMany(ctx context.Context, filter types.UserFilter, dryRun bool) (types.DeleteManyResult, error)
+
 	// List filtered users
 	// takes a set of filters and an offset/limit-based paging entity
 	// returns a slice of users along with a total count for the executed filter
@@ -65,8 +114,65 @@ type UserService interface {
 	// the results are sorted by when they were inserted to DB in FIFO ordering
 	List(ctx context.Context, filter types.UserFilter, paging types.Paging) (users []types.User, totalCount uint64, err error)
 
+	// Get a single user, returns types.ErrNotFound if the user does not exist
+	Get(ctx context.Context, userId uuid.UUID) (types.User, error)
+
 	// SubscribeToUserChanges returns a channel that receives a message each time a user is updated
-	SubscribeToUserChanges(ctx context.Context, req types.SubscriptionRequest) (<-chan types.SubscriptionPayload, error)
+	// lag reports how many changes are buffered for the subscriber
+	SubscribeToUserChanges(ctx context.Context, req types.SubscriptionRequest) (changes <-chan types.SubscriptionPayload, lag func() int, err error)
+}
+
+type IdempotencyStore interface {
+	// Reserve atomically claims the key for a request with the given hash
+	// if the key is already claimed the existing record is returned and reserved is false
+	Reserve(ctx context.Context, key string, requestHash []byte) (record types.IdempotencyRecord, reserved bool, err error)
+
+	// Complete stores the response of a reserved request so that retries can replay it
+	Complete(ctx context.Context, key string, response []byte) error
+
+	// Release removes an uncompleted reservation, allowing the request to be executed again
+	Release(ctx context.Context, key string) error
+}
+
+type WebhookRepository interface {
+	// AddWebhook stores a new webhook
+	AddWebhook(ctx context.Context, webhook types.Webhook) error
+
+	// DeleteWebhook removes a webhook along with its delivery log and dead letters
+	// returns nil if the webhook is not found
+	DeleteWebhook(ctx context.Context, id uuid.UUID) error
+
+	// ListWebhooks lists webhooks in the order they were registered, a limit of 0 lists all webhooks
+	ListWebhooks(ctx context.Context, paging types.Paging) (webhooks []types.Webhook, totalCount uint64, err error)
+
+	// AddDelivery logs an attempt to deliver a change to a webhook
+	AddDelivery(ctx context.Context, delivery types.WebhookDelivery) error
+
+	// ListDeliveries lists the logged delivery attempts of a webhook, latest first
+	ListDeliveries(ctx context.Context, webhookId uuid.UUID, paging types.Paging) (deliveries []types.WebhookDelivery, totalCount uint64, err error)
+
+	// AddDeadLetter stores a change that could not be delivered to a webhook, replacing a dead letter with the same id
+	AddDeadLetter(ctx context.Context, deadLetter types.WebhookDeadLetter) error
+
+	// ListDeadLetters lists the changes that could not be delivered to a webhook, latest first
+	ListDeadLetters(ctx context.Context, webhookId uuid.UUID, paging types.Paging) (deadLetters []types.WebhookDeadLetter, totalCount uint64, err error)
+}
+
+type WebhookService interface {
+	// Register validates and stores a new webhook, the id, secret (if empty) and created at are set on webhook
+	Register(ctx context.Context, webhook *types.Webhook) error
+
+	// Delete stops deliveries to a webhook, returns nil if the webhook does not exist
+	Delete(ctx context.Context, id uuid.UUID) error
+
+	// List registered webhooks, their secrets are never returned
+	List(ctx context.Context, paging types.Paging) (webhooks []types.Webhook, totalCount uint64, err error)
+
+	// ListDeliveries lists the delivery attempts of a webhook, latest first
+	ListDeliveries(ctx context.Context, webhookId uuid.UUID, paging types.Paging) (deliveries []types.WebhookDelivery, totalCount uint64, err error)
+
+	// ListDeadLetters lists the changes that could not be delivered to a webhook, latest first
+	ListDeadLetters(ctx context.Context, webhookId uuid.UUID, paging types.Paging) (deadLetters []types.WebhookDeadLetter, totalCount uint64, err error)
 }
 
 type PubSubService interface {
@@ -74,11 +180,29 @@ type PubSubService interface {
 	SubscribeToUserChanges(ctx context.Context, req types.SubscriptionRequest) (<-chan types.SubscriptionPayload, error)
 
 	// PublishUserChange publishes a user change to subscribers
+	// it may return before the change is published, GracefulShutdown waits for queued changes
 	PublishUserChange(result types.SubscriptionPayload) error
 
 	GracefulShutdown(ctx context.Context) error
 }
 
+// ChangeQueues are durable queues of user changes shared by all replicas
+// each change is handled by one replica at a time and redelivered until it is acknowledged,
+// so changes are neither lost while no replica consumes the queue nor handled by every replica
+type ChangeQueues interface {
+	// ConsumeQueue passes the changes of the named queue to handle in order, one at a time, until ctx is cancelled
+	// the queue is created with the changes matching req published since start if it does not exist yet
+	// handle gets the delivery attempt of the change starting at 1, and returns 0 to acknowledge it or how long to wait
+	// before it is redelivered
+	ConsumeQueue(ctx context.Context, name string, req types.SubscriptionRequest, start time.Time, handle func(p types.SubscriptionPayload, attempt int) (retryAfter time.Duration)) error
+
+	// DeleteQueue removes a queue along with its position, returns nil if the queue does not exist
+	DeleteQueue(ctx context.Context, name string) error
+
+	// ListQueues returns the names of all queues starting with prefix
+	ListQueues(ctx context.Context, prefix string) ([]string, error)
+}
+
 // AddShutdownFunction adds a hook to be run before application exit
 // it can be used to release resources and gracefully terminate connections for example
 func (app *Application) AddShutdownFunction(function func(context.Context) error) {
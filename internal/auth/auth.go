@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"github.com/captainlettuce/users-microservice/internal/logging"
+	"google.golang.org/grpc/codes"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeUsersRead     = "users:read"
+	ScopeUsersWrite    = "users:write"
+	ScopeUsersAdmin    = "users:admin"
+	ScopeWebhooksRead  = "webhooks:read"
+	ScopeWebhooksWrite = "webhooks:write"
+)
+
+// defaultMethodScopes is the scope needed to call each users service method
+var defaultMethodScopes = map[string]string{
+	"add":                    ScopeUsersWrite,
+	"update":                 ScopeUsersWrite,
+	"upsert":                 ScopeUsersWrite,
+	"delete":                 ScopeUsersWrite,
+	"deleteMany":             ScopeUsersWrite,
+	"list":                   ScopeUsersRead,
+	"get":                    ScopeUsersRead,
+	"subscribe":              ScopeUsersRead,
+	"listSubscriptions":      ScopeUsersAdmin,
+	"terminateSubscription":  ScopeUsersAdmin,
+	"registerWebhook":        ScopeWebhooksWrite,
+	"deleteWebhook":          ScopeWebhooksWrite,
+	"listWebhooks":           ScopeWebhooksRead,
+	"listWebhookDeliveries":  ScopeWebhooksRead,
+	"listWebhookDeadLetters": ScopeWebhooksRead,
+}
+
+// Claims are the verified claims of the caller
+type Claims struct {
+	Subject string
+	Scopes  []string
+}
+
+type claimsKey struct{}
+
+// ContextWithClaims returns a copy of ctx holding the claims of an authenticated caller
+func ContextWithClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of an authenticated caller
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(Claims)
+	return claims, ok
+}
+
+type Settings struct {
+	issuer          string
+	audience        string
+	leeway          time.Duration
+	refreshInterval time.Duration
+	methodScopes    map[string]string
+	client          *http.Client
+}
+
+type Option func(*Settings)
+
+// WithIssuer only accepts tokens issued by issuer, it is required
+func WithIssuer(issuer string) Option {
+	return func(settings *Settings) {
+		settings.issuer = issuer
+	}
+}
+
+// WithAudience only accepts tokens meant for audience, it is required
+func WithAudience(audience string) Option {
+	return func(settings *Settings) {
+		settings.audience = audience
+	}
+}
+
+// WithLeeway sets how much clock skew is tolerated when checking the expiry and not-before of tokens
+func WithLeeway(leeway time.Duration) Option {
+	return func(settings *Settings) {
+		settings.leeway = leeway
+	}
+}
+
+// WithRefreshInterval sets how often the keys are reloaded, reloading happens in the background
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(settings *Settings) {
+		settings.refreshInterval = interval
+	}
+}
+
+// WithMethodScopes overrides the scope needed to call users service methods, keyed by method name e.g. "list"
+func WithMethodScopes(scopes map[string]string) Option {
+	return func(settings *Settings) {
+		for method, scope := range scopes {
+			settings.methodScopes[method] = scope
+		}
+	}
+}
+
+// WithHttpClient sets the client used to fetch the keys from a url
+func WithHttpClient(client *http.Client) Option {
+	return func(settings *Settings) {
+		settings.client = client
+	}
+}
+
+// Authenticator verifies the bearer jwt of callers and that it has the scope needed for the called method
+type Authenticator struct {
+	keys         *jwksSource
+	issuer       string
+	audience     string
+	leeway       time.Duration
+	methodScopes map[string]string
+	now          func() time.Time
+}
+
+// NewAuthenticator verifies tokens with the json web key set in the file or at the http(s) url jwksLocation
+// the keys are loaded before returning, an error is returned if that fails or the issuer or audience is not set,
+// since tokens of any issuer for any service would be accepted otherwise
+func NewAuthenticator(jwksLocation string, logger *slog.Logger, options ...Option) (*Authenticator, error) {
+	settings := &Settings{
+		leeway:          time.Minute,
+		refreshInterval: 10 * time.Minute,
+		methodScopes:    make(map[string]string, len(defaultMethodScopes)),
+		client:          &http.Client{Timeout: jwksTimeout},
+	}
+	for method, scope := range defaultMethodScopes {
+		settings.methodScopes[method] = scope
+	}
+
+	for _, option := range options {
+		option(settings)
+	}
+
+	if settings.issuer == "" || settings.audience == "" {
+		return nil, errors.New("an issuer and an audience are required")
+	}
+
+	a := &Authenticator{
+		keys: &jwksSource{
+			location:        jwksLocation,
+			client:          settings.client,
+			refreshInterval: settings.refreshInterval,
+			logger:          logger.With(slog.String("component", "auth")),
+		},
+		issuer:       settings.issuer,
+		audience:     settings.audience,
+		leeway:       settings.leeway,
+		methodScopes: make(map[string]string, len(settings.methodScopes)),
+		now:          time.Now,
+	}
+	for method, scope := range settings.methodScopes {
+		a.methodScopes[fullMethodName(method)] = scope
+	}
+
+	keys, err := a.keys.load(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not load jwks: %w", err)
+	}
+	a.keys.keys = keys
+	a.keys.loadedAt = time.Now()
+	a.keys.attemptAt = a.keys.loadedAt
+
+	return a, nil
+}
+
+// Authorize checks that the caller of the grpc method fullMethod is allowed to call it, authorization is the value of
+// the authorization header. Methods of other services than the users service, e.g. health checks, are public
+// and users service methods without a scope are never allowed
+// the returned context holds the claims of the caller
+func (a *Authenticator) Authorize(ctx context.Context, fullMethod, authorization string) (context.Context, error) {
+	if !strings.HasPrefix(fullMethod, fullMethodName("")) {
+		return ctx, nil
+	}
+
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return ctx, apierror.New(codes.Unauthenticated, apierror.ReasonUnauthenticated, "a bearer token is required")
+	}
+
+	claims, err := a.verify(ctx, strings.TrimSpace(token))
+	if err != nil {
+		return ctx, apierror.New(codes.Unauthenticated, apierror.ReasonUnauthenticated, "invalid token: "+err.Error())
+	}
+
+	ctx = logging.LogToContext(ContextWithClaims(ctx, claims), slog.String("subject", claims.Subject))
+
+	scope, ok := a.methodScopes[fullMethod]
+	if !ok {
+		return ctx, apierror.New(codes.PermissionDenied, apierror.ReasonMethodNotAllowed, "method is not allowed")
+	}
+	if !slices.Contains(claims.Scopes, scope) {
+		return ctx, apierror.New(codes.PermissionDenied, apierror.ReasonScopeRequired, "scope "+scope+" is required")
+	}
+
+	return ctx, nil
+}
+
+func fullMethodName(method string) string {
+	return "/" + generated.UsersService_ServiceDesc.ServiceName + "/" + method
+}
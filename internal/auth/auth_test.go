@@ -0,0 +1,507 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testKey struct {
+	kid  string
+	alg  string
+	sign func(signed []byte) []byte
+	jwk  map[string]string
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newRSAKey(t *testing.T, kid string) testKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	return testKey{
+		kid: kid,
+		alg: "RS256",
+		sign: func(signed []byte) []byte {
+			digest := sha256.Sum256(signed)
+			sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+			require.NoError(t, err)
+			return sig
+		},
+		jwk: map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"n":   b64(key.N.Bytes()),
+			"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+		},
+	}
+}
+
+func newECKey(t *testing.T, kid string) testKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return testKey{
+		kid: kid,
+		alg: "ES256",
+		sign: func(signed []byte) []byte {
+			digest := sha256.Sum256(signed)
+			r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+			require.NoError(t, err)
+			return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		},
+		jwk: map[string]string{
+			"kty": "EC",
+			"kid": kid,
+			"crv": "P-256",
+			"x":   b64(key.X.FillBytes(make([]byte, 32))),
+			"y":   b64(key.Y.FillBytes(make([]byte, 32))),
+		},
+	}
+}
+
+func newEd25519Key(t *testing.T, kid string) testKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	return testKey{
+		kid: kid,
+		alg: "EdDSA",
+		sign: func(signed []byte) []byte {
+			return ed25519.Sign(private, signed)
+		},
+		jwk: map[string]string{
+			"kty": "OKP",
+			"kid": kid,
+			"crv": "Ed25519",
+			"x":   b64(public),
+		},
+	}
+}
+
+func jwks(t *testing.T, keys ...testKey) []byte {
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.jwk)
+	}
+
+	b, err := json.Marshal(set)
+	require.NoError(t, err)
+	return b
+}
+
+func writeJWKS(t *testing.T, keys ...testKey) string {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, jwks(t, keys...), 0o600))
+	return path
+}
+
+func (k testKey) token(t *testing.T, header map[string]any, claims map[string]any) string {
+	h := map[string]any{"alg": k.alg, "kid": k.kid, "typ": "JWT"}
+	for name, value := range header {
+		h[name] = value
+	}
+
+	hb, err := json.Marshal(h)
+	require.NoError(t, err)
+	cb, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := b64(hb) + "." + b64(cb)
+	return signed + "." + b64(k.sign([]byte(signed)))
+}
+
+func validClaims(scope string) map[string]any {
+	return map[string]any{
+		"iss":   "https://issuer.example",
+		"sub":   "client-1",
+		"aud":   []string{"users", "other"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": scope,
+	}
+}
+
+func withClaims(claims map[string]any, name string, value any) map[string]any {
+	c := make(map[string]any, len(claims))
+	for k, v := range claims {
+		c[k] = v
+	}
+	if value == nil {
+		delete(c, name)
+	} else {
+		c[name] = value
+	}
+	return c
+}
+
+func TestAuthenticator_Authorize(t *testing.T) {
+	var (
+		logger  = slog.New(slog.NewTextHandler(io.Discard, nil))
+		rsaKey  = newRSAKey(t, "rsa")
+		ecKey   = newECKey(t, "ec")
+		edKey   = newEd25519Key(t, "ed")
+		unknown = newRSAKey(t, "unknown")
+	)
+
+	a, err := NewAuthenticator(writeJWKS(t, rsaKey, ecKey, edKey), logger,
+		WithIssuer("https://issuer.example"),
+		WithAudience("users"),
+		WithMethodScopes(map[string]string{"get": ScopeUsersAdmin}),
+	)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		wantCode      codes.Code
+		wantSubject   string
+	}{
+		{
+			name:          "rsa",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, nil, validClaims("users:read users:write")),
+			wantSubject:   "client-1",
+		},
+		{
+			name:          "ecdsa",
+			method:        fullMethodName("add"),
+			authorization: "Bearer " + ecKey.token(t, nil, validClaims("users:write")),
+			wantSubject:   "client-1",
+		},
+		{
+			name:          "ed25519 with scp claim",
+			method:        fullMethodName("listWebhooks"),
+			authorization: "bearer " + edKey.token(t, nil, withClaims(validClaims(""), "scp", []string{"webhooks:read"})),
+			wantSubject:   "client-1",
+		},
+		{
+			name:          "key without kid",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, map[string]any{"kid": ""}, validClaims("users:read")),
+			wantSubject:   "client-1",
+		},
+		{
+			name:          "expired within leeway",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, nil, withClaims(validClaims("users:read"), "exp", time.Now().Add(-30*time.Second).Unix())),
+			wantSubject:   "client-1",
+		},
+		{
+			name:   "other services are public",
+			method: "/grpc.health.v1.Health/Check",
+		},
+		{
+			name:     "missing token",
+			method:   fullMethodName("list"),
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:          "not a bearer token",
+			method:        fullMethodName("list"),
+			authorization: "Basic dXNlcjpwYXNz",
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "malformed token",
+			method:        fullMethodName("list"),
+			authorization: "Bearer abc.def",
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "expired",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, nil, withClaims(validClaims("users:read"), "exp", time.Now().Add(-time.Hour).Unix())),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "no expiry",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, nil, withClaims(validClaims("users:read"), "exp", nil)),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "not valid yet",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, nil, withClaims(validClaims("users:read"), "nbf", time.Now().Add(time.Hour).Unix())),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "wrong issuer",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, nil, withClaims(validClaims("users:read"), "iss", "https://other.example")),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "missing issuer",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, nil, withClaims(validClaims("users:read"), "iss", nil)),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "missing audience",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, nil, withClaims(validClaims("users:read"), "aud", nil)),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "wrong audience",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, nil, withClaims(validClaims("users:read"), "aud", "other")),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "unknown key",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + unknown.token(t, nil, validClaims("users:read")),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "signed with another key than its kid",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + unknown.token(t, map[string]any{"kid": "rsa"}, validClaims("users:read")),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "alg does not match the key",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, map[string]any{"kid": "ec"}, validClaims("users:read")),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "alg none",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + testKey{kid: "rsa", alg: "none", sign: func([]byte) []byte { return nil }}.token(t, nil, validClaims("users:read")),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "symmetric alg",
+			method:        fullMethodName("list"),
+			authorization: "Bearer " + rsaKey.token(t, map[string]any{"alg": "HS256"}, validClaims("users:read")),
+			wantCode:      codes.Unauthenticated,
+		},
+		{
+			name:          "missing scope",
+			method:        fullMethodName("add"),
+			authorization: "Bearer " + rsaKey.token(t, nil, validClaims("users:read")),
+			wantCode:      codes.PermissionDenied,
+		},
+		{
+			name:          "overridden scope",
+			method:        fullMethodName("get"),
+			authorization: "Bearer " + rsaKey.token(t, nil, validClaims("users:read")),
+			wantCode:      codes.PermissionDenied,
+		},
+		{
+			name:          "method without scope",
+			method:        fullMethodName("unknown"),
+			authorization: "Bearer " + rsaKey.token(t, nil, validClaims("users:read users:write users:admin")),
+			wantCode:      codes.PermissionDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := a.Authorize(context.Background(), tt.method, tt.authorization)
+			require.Equal(t, tt.wantCode, status.Code(err), "error: %v", err)
+
+			if tt.wantSubject == "" {
+				return
+			}
+			claims, ok := ClaimsFromContext(ctx)
+			require.True(t, ok)
+			require.Equal(t, tt.wantSubject, claims.Subject)
+		})
+	}
+}
+
+func TestNewAuthenticator_issuerAndAudienceRequired(t *testing.T) {
+	var (
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		path   = writeJWKS(t, newEd25519Key(t, "ed"))
+	)
+
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{name: "neither", options: nil},
+		{name: "issuer only", options: []Option{WithIssuer("https://issuer.example")}},
+		{name: "audience only", options: []Option{WithAudience("users")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAuthenticator(path, logger, tt.options...)
+			require.ErrorContains(t, err, "issuer and an audience are required")
+		})
+	}
+}
+
+func TestAuthenticator_keyRotation(t *testing.T) {
+	var (
+		logger   = slog.New(slog.NewTextHandler(io.Discard, nil))
+		oldKey   = newRSAKey(t, "old")
+		newKey   = newEd25519Key(t, "new")
+		rotated  atomic.Bool
+		failing  atomic.Bool
+		slow     atomic.Bool
+		unblock  = make(chan struct{})
+		requests atomic.Int64
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if slow.Load() {
+			<-unblock
+		}
+		switch {
+		case failing.Load():
+			w.WriteHeader(http.StatusInternalServerError)
+		case rotated.Load():
+			_, _ = w.Write(jwks(t, newKey))
+		default:
+			_, _ = w.Write(jwks(t, oldKey))
+		}
+	}))
+	defer srv.Close()
+
+	a, err := NewAuthenticator(srv.URL, logger, WithIssuer("https://issuer.example"), WithAudience("users"))
+	require.NoError(t, err)
+
+	authorize := func(key testKey) error {
+		_, err := a.Authorize(context.Background(), fullMethodName("list"), "Bearer "+key.token(t, nil, validClaims("users:read")))
+		return err
+	}
+
+	// expire waits for a running reload and makes the keys due for reloading
+	expire := func() {
+		a.keys.mu.Lock()
+		reloading := a.keys.reloading
+		a.keys.mu.Unlock()
+		if reloading != nil {
+			<-reloading
+		}
+
+		a.keys.mu.Lock()
+		defer a.keys.mu.Unlock()
+		a.keys.loadedAt = time.Now().Add(-time.Hour)
+		a.keys.attemptAt = a.keys.loadedAt
+	}
+
+	require.NoError(t, authorize(oldKey))
+
+	t.Run("unknown kid reloads the keys", func(t *testing.T) {
+		rotated.Store(true)
+		expire()
+
+		require.NoError(t, authorize(newKey))
+		require.Equal(t, codes.Unauthenticated, status.Code(authorize(oldKey)))
+	})
+
+	t.Run("reloads are throttled", func(t *testing.T) {
+		before := requests.Load()
+		for range 5 {
+			require.Equal(t, codes.Unauthenticated, status.Code(authorize(oldKey)))
+		}
+		require.Equal(t, before, requests.Load())
+	})
+
+	t.Run("keys are kept when reloading fails", func(t *testing.T) {
+		failing.Store(true)
+		expire()
+
+		require.NoError(t, authorize(newKey))
+		expire()
+		require.NoError(t, authorize(newKey))
+	})
+
+	t.Run("reloading does not block requests with known keys", func(t *testing.T) {
+		slow.Store(true)
+		expire()
+
+		start := time.Now()
+		require.NoError(t, authorize(newKey))
+		require.Less(t, time.Since(start), time.Second)
+
+		slow.Store(false)
+		close(unblock)
+	})
+
+	t.Run("unreachable jwks fails creation", func(t *testing.T) {
+		_, err := NewAuthenticator(srv.URL, logger, WithIssuer("https://issuer.example"), WithAudience("users"))
+		require.Error(t, err)
+	})
+}
+
+func Test_parseJWKS(t *testing.T) {
+	tests := []struct {
+		name    string
+		jwks    string
+		wantErr bool
+		want    int
+	}{
+		{
+			name: "encryption and symmetric keys are ignored",
+			jwks: `{"keys":[{"kty":"oct","k":"c2VjcmV0"},{"kty":"RSA","use":"enc","n":"AQAB","e":"AQAB"},` + string(jwks(t, newEd25519Key(t, "ed")))[9:],
+			want: 1,
+		},
+		{
+			name:    "no usable keys",
+			jwks:    `{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "small rsa key",
+			jwks:    `{"keys":[{"kty":"RSA","n":"` + b64(big.NewInt(1<<62-57).Bytes()) + `","e":"AQAB"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "ec point not on the curve",
+			jwks:    `{"keys":[{"kty":"EC","crv":"P-256","x":"` + b64(make([]byte, 32)) + `","y":"` + b64(make([]byte, 32)) + `"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			jwks:    `{"keys":`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseJWKS([]byte(tt.jwks))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, keys, tt.want)
+		})
+	}
+}
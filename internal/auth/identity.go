@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+)
+
+// ClientIdentity is the identity of a client verified with its tls certificate
+type ClientIdentity struct {
+	// Name is the first uri SAN (e.g. a spiffe id), otherwise the first dns SAN, otherwise the common name
+	Name       string
+	CommonName string
+	DNSNames   []string
+	URIs       []string
+}
+
+// ClientIdentityFromCertificate returns the identity in a verified client certificate
+func ClientIdentityFromCertificate(cert *x509.Certificate) ClientIdentity {
+	identity := ClientIdentity{
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+
+	switch {
+	case len(identity.URIs) > 0:
+		identity.Name = identity.URIs[0]
+	case len(identity.DNSNames) > 0:
+		identity.Name = identity.DNSNames[0]
+	default:
+		identity.Name = identity.CommonName
+	}
+
+	return identity
+}
+
+type clientIdentityKey struct{}
+
+// ContextWithClientIdentity returns a copy of ctx holding identity
+func ContextWithClientIdentity(ctx context.Context, identity ClientIdentity) context.Context {
+	return context.WithValue(ctx, clientIdentityKey{}, identity)
+}
+
+// ClientIdentityFromContext returns the identity of a client that connected with a verified certificate
+func ClientIdentityFromContext(ctx context.Context) (ClientIdentity, bool) {
+	identity, ok := ctx.Value(clientIdentityKey{}).(ClientIdentity)
+	return identity, ok
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minJWKSReload limits how often unknown key ids make the keys reload, so bogus tokens can't hammer the jwks endpoint
+	minJWKSReload = 30 * time.Second
+
+	// jwksTimeout limits fetching the keys from a url
+	jwksTimeout = 5 * time.Second
+)
+
+// jwksSource loads the keys tokens are verified with from a file or url
+// keys are reloaded in the background after refreshInterval, or when a token is signed with an unknown key
+// if reloading fails the previously loaded keys are kept
+type jwksSource struct {
+	location        string
+	client          *http.Client
+	refreshInterval time.Duration
+	logger          *slog.Logger
+
+	mu         sync.Mutex
+	keys       []jose.JSONWebKey
+	loadedAt   time.Time
+	attemptAt  time.Time
+	loadFailed bool
+	// reloading is closed when the running reload finishes, nil while no reload runs
+	reloading chan struct{}
+}
+
+// verificationKeys returns the keys with kid usable for alg, all keys usable for alg if kid is empty
+// if there are none the keys are reloaded, since the issuer may have rotated its keys
+func (s *jwksSource) verificationKeys(ctx context.Context, kid, alg string) ([]jose.JSONWebKey, error) {
+	s.mu.Lock()
+	if time.Since(s.loadedAt) > s.refreshInterval {
+		s.reload()
+	}
+	keys := s.find(kid, alg)
+	var reloaded chan struct{}
+	if len(keys) == 0 {
+		reloaded = s.reload()
+	}
+	s.mu.Unlock()
+
+	if len(keys) > 0 {
+		return keys, nil
+	}
+
+	if reloaded != nil {
+		select {
+		case <-reloaded:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		s.mu.Lock()
+		keys = s.find(kid, alg)
+		s.mu.Unlock()
+		if len(keys) > 0 {
+			return keys, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no key %q for %s", kid, alg)
+}
+
+func (s *jwksSource) find(kid, alg string) []jose.JSONWebKey {
+	var keys []jose.JSONWebKey
+	for _, k := range s.keys {
+		if (kid == "" || k.KeyID == kid) && (k.Algorithm == "" || k.Algorithm == alg) && keyMatchesAlg(k.Key, alg) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// reload starts reloading the keys in the background unless a reload is running or one was attempted recently
+// it returns a channel closed when the reload finishes, or nil if none runs
+// s.mu has to be held
+func (s *jwksSource) reload() chan struct{} {
+	if s.reloading != nil {
+		return s.reloading
+	}
+	if time.Since(s.attemptAt) < minJWKSReload {
+		return nil
+	}
+
+	s.attemptAt = time.Now()
+	reloading := make(chan struct{})
+	s.reloading = reloading
+
+	go func() {
+		keys, err := s.load(context.Background())
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		defer close(reloading)
+		s.reloading = nil
+
+		if err != nil {
+			if !s.loadFailed {
+				s.logger.With(slog.Any("error", err), slog.String("location", s.location)).Warn("Could not reload jwks, keeping the previous keys")
+			}
+			s.loadFailed = true
+			return
+		}
+
+		s.keys = keys
+		s.loadedAt = time.Now()
+		s.loadFailed = false
+	}()
+
+	return reloading
+}
+
+func (s *jwksSource) load(ctx context.Context) ([]jose.JSONWebKey, error) {
+	var (
+		b   []byte
+		err error
+	)
+
+	if strings.HasPrefix(s.location, "https://") || strings.HasPrefix(s.location, "http://") {
+		b, err = s.fetch(ctx)
+	} else {
+		b, err = os.ReadFile(s.location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJWKS(b)
+}
+
+func (s *jwksSource) fetch(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.location, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s fetching jwks", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// parseJWKS parses the RSA, EC and Ed25519 signing keys of a json web key set, other keys are ignored
+func parseJWKS(b []byte) ([]jose.JSONWebKey, error) {
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %w", err)
+	}
+
+	var keys []jose.JSONWebKey
+	for _, raw := range set.Keys {
+		var header struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+		}
+		if err := json.Unmarshal(raw, &header); err != nil {
+			return nil, fmt.Errorf("invalid jwk: %w", err)
+		}
+		if (header.Use != "" && header.Use != "sig") || (header.Kty != "RSA" && header.Kty != "EC" && header.Kty != "OKP") {
+			continue
+		}
+
+		var key jose.JSONWebKey
+		if err := key.UnmarshalJSON(raw); err != nil {
+			return nil, fmt.Errorf("invalid jwk %q: %w", header.Kid, err)
+		}
+		if !key.IsPublic() || !key.Valid() {
+			return nil, fmt.Errorf("invalid jwk %q: not a public signing key", header.Kid)
+		}
+		if k, ok := key.Key.(*rsa.PublicKey); ok && k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("invalid jwk %q: rsa keys must have at least 2048 bits", header.Kid)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("jwks contains no usable signing keys")
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"strings"
+)
+
+// signatureAlgorithms are the accepted signing algorithms, symmetric algorithms and none are never accepted
+var signatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// ecAlgCurves is the curve each ecdsa algorithm has to be used with
+var ecAlgCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// stringList is a json string or array of strings
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = strings.Fields(s)
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// scopeClaims are a space separated scope claim, or the scp claim some issuers use instead
+type scopeClaims struct {
+	Scope stringList `json:"scope"`
+	Scp   stringList `json:"scp"`
+}
+
+// verify checks the signature and the registered claims of a compact serialized jwt
+func (a *Authenticator) verify(ctx context.Context, token string) (Claims, error) {
+	tok, err := jwt.ParseSigned(token, signatureAlgorithms)
+	if err != nil {
+		return Claims{}, fmt.Errorf("malformed token: %w", err)
+	}
+	header := tok.Headers[0]
+
+	keys, err := a.keys.verificationKeys(ctx, header.KeyID, header.Algorithm)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	var (
+		claims jwt.Claims
+		scopes scopeClaims
+	)
+	err = errors.New("invalid token signature")
+	for _, key := range keys {
+		if tok.Claims(key.Key, &claims, &scopes) == nil {
+			err = nil
+			break
+		}
+	}
+	if err != nil {
+		return Claims{}, err
+	}
+
+	if claims.Expiry == nil {
+		return Claims{}, errors.New("token has no expiry")
+	}
+	expected := jwt.Expected{Issuer: a.issuer, AnyAudience: jwt.Audience{a.audience}, Time: a.now()}
+	if err := claims.ValidateWithLeeway(expected, a.leeway); err != nil {
+		return Claims{}, err
+	}
+
+	return Claims{
+		Subject: claims.Subject,
+		Scopes:  append(scopes.Scope, scopes.Scp...),
+	}, nil
+}
+
+// keyMatchesAlg reports whether key can verify signatures of alg
+func keyMatchesAlg(key crypto.PublicKey, alg string) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return ecAlgCurves[alg] == k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
@@ -10,6 +10,14 @@ import (
 	"time"
 )
 
+const (
+	// maxDeleteMany is the hard cap on how many users a single DeleteMany call may remove
+	maxDeleteMany = 1000
+
+	// deleteManySampleSize is how many ids DeleteMany returns as a sample of matched users
+	deleteManySampleSize = 10
+)
+
 type userService struct {
 	repo   internal.UserRepository
 	pubsub internal.PubSubService
@@ -28,6 +36,7 @@ func (us *userService) Add(ctx context.Context, user *types.User) error {
 
 	user.CreatedAt = time.Now()
 	user.UpdatedAt = nil
+	user.Revision = 1
 
 	if user.Id == uuid.Nil {
 		user.Id = uuid.New()
@@ -37,7 +46,7 @@ func (us *userService) Add(ctx context.Context, user *types.User) error {
 		return fmt.Errorf("failed to add user: %w", err)
 	}
 
-	if err := us.pubsub.PublishUserChange(types.SubscriptionPayload{UserId: user.Id, Change: types.UserChangeTypeCreated}); err != nil {
+	if err := us.pubsub.PublishUserChange(types.NewUserChangePayload(types.UserChangeTypeCreated, nil, *user)); err != nil {
 		slog.With(slog.Any("error", err)).WarnContext(ctx, "Failed to publish user change")
 		// not error-ing out here since the user actually was created
 	}
@@ -46,12 +55,12 @@ func (us *userService) Add(ctx context.Context, user *types.User) error {
 }
 
 func (us *userService) UpdatePartial(ctx context.Context, filter types.UserFilter, fields types.UpdateUserFields) error {
-	user, err := us.repo.UpdatePartial(ctx, filter, fields)
+	before, after, err := us.repo.UpdatePartial(ctx, filter, fields)
 	if err != nil {
 		return err
 	}
 
-	if err := us.pubsub.PublishUserChange(types.SubscriptionPayload{UserId: user.Id, Change: types.UserChangeTypeUpdated}); err != nil {
+	if err := us.pubsub.PublishUserChange(types.NewUserChangePayload(types.UserChangeTypeUpdated, &before, after)); err != nil {
 		slog.With(slog.Any("error", err)).WarnContext(ctx, "Failed to publish user change")
 		// not error-ing out here since the update actually was done
 	}
@@ -59,6 +68,45 @@ func (us *userService) UpdatePartial(ctx context.Context, filter types.UserFilte
 	return nil
 }
 
+func (us *userService) Upsert(ctx context.Context, user *types.User, key types.UpsertKey) (bool, error) {
+	switch key {
+	case types.UpsertKeyEmail:
+		if user.Email == "" {
+			return false, fmt.Errorf("failed to upsert user: %w", types.ErrInvalidEmail)
+		}
+		if user.Id == uuid.Nil {
+			user.Id = uuid.New()
+		}
+	default:
+		if user.Id == uuid.Nil {
+			return false, fmt.Errorf("failed to upsert user: %w", types.ErrInvalidUserId)
+		}
+	}
+
+	now := time.Now()
+	user.CreatedAt = now
+	user.UpdatedAt = &now
+
+	before, after, err := us.repo.Upsert(ctx, *user, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to upsert user: %w", err)
+	}
+	*user = after
+
+	created := before == nil
+	change := types.UserChangeTypeUpdated
+	if created {
+		change = types.UserChangeTypeCreated
+	}
+
+	if err := us.pubsub.PublishUserChange(types.NewUserChangePayload(change, before, after)); err != nil {
+		slog.With(slog.Any("error", err)).WarnContext(ctx, "Failed to publish user change")
+		// not error-ing out here since the upsert actually was done
+	}
+
+	return created, nil
+}
+
 func (us *userService) Delete(ctx context.Context, userId uuid.UUID) error {
 	if userId == uuid.Nil {
 		return fmt.Errorf("failed to delete user: %w", types.ErrInvalidUserId)
@@ -67,7 +115,7 @@ func (us *userService) Delete(ctx context.Context, userId uuid.UUID) error {
 		return fmt.Errorf("failed to delete user: %w", err)
 	}
 
-	if err := us.pubsub.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeDeleted}); err != nil {
+	if err := us.pubsub.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeDeleted, Timestamp: time.Now()}); err != nil {
 		slog.With(slog.Any("error", err)).WarnContext(ctx, "Failed to publish user change")
 		// not error-ing out here since the user actually was created
 	}
@@ -75,6 +123,49 @@ func (us *userService) Delete(ctx context.Context, userId uuid.UUID) error {
 	return nil
 }
 
+func (us *userService) DeleteMany(ctx context.Context, filter types.UserFilter, dryRun bool) (types.DeleteManyResult, error) {
+	if filter.IsEmpty() {
+		return types.DeleteManyResult{}, fmt.Errorf("failed to delete users: %w", types.ErrEmptyFilter)
+	}
+
+	var limit int64 = maxDeleteMany
+	if dryRun {
+		limit = deleteManySampleSize
+	}
+
+	users, total, err := us.repo.List(ctx, filter, types.Paging{Limit: limit})
+	if err != nil {
+		return types.DeleteManyResult{}, fmt.Errorf("failed to delete users: %w", err)
+	}
+
+	userIds := make([]uuid.UUID, 0, len(users))
+	for _, u := range users {
+		userIds = append(userIds, u.Id)
+	}
+
+	if dryRun {
+		return types.DeleteManyResult{Count: total, SampleIds: userIds}, nil
+	}
+
+	if total > maxDeleteMany {
+		return types.DeleteManyResult{}, fmt.Errorf("failed to delete users, filter matched %d users (max %d): %w", total, maxDeleteMany, types.ErrLimitExceeded)
+	}
+
+	deleted, err := us.repo.DeleteMany(ctx, userIds)
+	if err != nil {
+		return types.DeleteManyResult{}, fmt.Errorf("failed to delete users: %w", err)
+	}
+
+	for _, userId := range userIds {
+		if err := us.pubsub.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeDeleted, Timestamp: time.Now()}); err != nil {
+			slog.With(slog.Any("error", err), slog.Any("userId", userId)).WarnContext(ctx, "Failed to publish user change")
+			// not error-ing out here since the users actually were deleted
+		}
+	}
+
+	return types.DeleteManyResult{Count: deleted, SampleIds: userIds[:min(len(userIds), deleteManySampleSize)]}, nil
+}
+
 func (us *userService) List(ctx context.Context, filter types.UserFilter, paging types.Paging) ([]types.User, uint64, error) {
 	if paging.Limit == 0 {
 		return []types.User{}, 0, nil
@@ -88,6 +179,51 @@ func (us *userService) List(ctx context.Context, filter types.UserFilter, paging
 	return users, total, nil
 }
 
-func (us *userService) SubscribeToUserChanges(ctx context.Context, req types.SubscriptionRequest) (<-chan types.SubscriptionPayload, error) {
-	return us.pubsub.SubscribeToUserChanges(ctx, req)
+func (us *userService) Get(ctx context.Context, userId uuid.UUID) (types.User, error) {
+	if userId == uuid.Nil {
+		return types.User{}, fmt.Errorf("failed to get user: %w", types.ErrInvalidUserId)
+	}
+
+	users, _, err := us.repo.List(ctx, types.UserFilter{Ids: []uuid.UUID{userId}}, types.Paging{Limit: 1})
+	if err != nil {
+		return types.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	if len(users) == 0 {
+		return types.User{}, fmt.Errorf("failed to get user: %w", types.ErrNotFound)
+	}
+
+	return users[0], nil
+}
+
+func (us *userService) SubscribeToUserChanges(ctx context.Context, req types.SubscriptionRequest) (<-chan types.SubscriptionPayload, func() int, error) {
+	ch, err := us.pubsub.SubscribeToUserChanges(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// ch is the buffer of the subscriber, filtered only hands over one change at a time
+	lag := func() int { return len(ch) }
+	if req.Filter.IsEmpty() {
+		return ch, lag, nil
+	}
+
+	// the filter is evaluated in-process since change subjects only contain the change type and user id
+	filtered := make(chan types.SubscriptionPayload)
+	go func() {
+		defer close(filtered)
+
+		for payload := range ch {
+			if !payload.MatchesFilter(req.Filter) {
+				continue
+			}
+
+			select {
+			case filtered <- payload:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return filtered, lag, nil
 }
@@ -8,7 +8,9 @@ import (
 	"github.com/captainlettuce/users-microservice/internal/mocks"
 	"github.com/captainlettuce/users-microservice/internal/types"
 	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"slices"
 	"testing"
 	"time"
 )
@@ -17,6 +19,13 @@ func newTestService(mockRepo internal.UserRepository, mockPubSub internal.PubSub
 	return NewUserService(mockRepo, mockPubSub)
 }
 
+// payloadFor matches a published payload on user id and change type, ignoring the change details
+func payloadFor(userId uuid.UUID, change types.UserChangeType) any {
+	return mock.MatchedBy(func(p types.SubscriptionPayload) bool {
+		return p.UserId == userId && p.Change == change && !p.Timestamp.IsZero()
+	})
+}
+
 func Test_userService_Add(t *testing.T) {
 
 	// CreatedAt & UpdatedAt fields of user creates problems when using cmp so init them to a static time
@@ -67,7 +76,7 @@ func Test_userService_Add(t *testing.T) {
 			if !tt.discardMockExpectation {
 				mr.EXPECT().Add(ctx, &userCopy).Return(tt.repoError)
 				if !tt.discardPubSubMockExpectation {
-					mps.EXPECT().PublishUserChange(types.SubscriptionPayload{UserId: userCopy.Id, Change: types.UserChangeTypeCreated}).Return(tt.pubsubErr)
+					mps.EXPECT().PublishUserChange(payloadFor(userCopy.Id, types.UserChangeTypeCreated)).Return(tt.pubsubErr)
 				}
 			}
 
@@ -132,7 +141,7 @@ func Test_userService_Delete(t *testing.T) {
 			}
 
 			if !tt.discardPubSubMockExpectation {
-				mps.EXPECT().PublishUserChange(types.SubscriptionPayload{UserId: tt.userId, Change: types.UserChangeTypeDeleted}).Return(tt.pubsubErr)
+				mps.EXPECT().PublishUserChange(payloadFor(tt.userId, types.UserChangeTypeDeleted)).Return(tt.pubsubErr)
 			}
 
 			s := newTestService(mr, mps)
@@ -193,10 +202,74 @@ func Test_userService_List(t *testing.T) {
 	}
 }
 
+func Test_userService_Get(t *testing.T) {
+	userId := uuid.New()
+
+	tests := []struct {
+		name                   string
+		userId                 uuid.UUID
+		usersFromMock          []types.User
+		errFromMock            error
+		discardMockExpectation bool
+		wantErr                error
+	}{
+		{
+			name:          "happy case",
+			userId:        userId,
+			usersFromMock: []types.User{{Id: userId}},
+		},
+		{
+			name:          "sad case user not found",
+			userId:        userId,
+			usersFromMock: []types.User{},
+			wantErr:       types.ErrNotFound,
+		},
+		{
+			name:                   "sad case nil uuid",
+			discardMockExpectation: true,
+			wantErr:                types.ErrInvalidUserId,
+		},
+		{
+			name:        "sad case error from repository",
+			userId:      userId,
+			errFromMock: types.ErrUnknownError,
+			wantErr:     types.ErrUnknownError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ctx := context.Background()
+			m := mocks.NewMockUserRepository(t)
+
+			if !tt.discardMockExpectation {
+				m.EXPECT().List(ctx, types.UserFilter{Ids: []uuid.UUID{tt.userId}}, types.Paging{Limit: 1}).
+					Return(tt.usersFromMock, uint64(len(tt.usersFromMock)), tt.errFromMock)
+			}
+
+			s := newTestService(m, nil)
+
+			user, err := s.Get(ctx, tt.userId)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.userId, user.Id)
+		})
+	}
+}
+
 func Test_userService_UpdatePartial(t *testing.T) {
 	var (
-		ctx  = context.Background()
-		user = fixtures_test.NewUser()
+		ctx     = context.Background()
+		user    = fixtures_test.NewUser()
+		updated = fixtures_test.NewUserWith(func(u *types.User) {
+			u.FirstName = "updated"
+			u.Revision++
+		})
 	)
 
 	tests := []struct {
@@ -228,10 +301,17 @@ func Test_userService_UpdatePartial(t *testing.T) {
 			pubsub := mocks.NewMockPubSubService(t)
 
 			if !tt.discardRepoMockExpectation {
-				repo.EXPECT().UpdatePartial(ctx, types.UserFilter{}, types.UpdateUserFields{}).Return(user, tt.repoError)
+				repo.EXPECT().UpdatePartial(ctx, types.UserFilter{}, types.UpdateUserFields{}).Return(user, updated, tt.repoError)
 			}
 			if !tt.discardPubSubMockExpectation {
-				pubsub.EXPECT().PublishUserChange(types.SubscriptionPayload{UserId: user.Id, Change: types.UserChangeTypeUpdated}).Return(tt.pubsubError)
+				pubsub.EXPECT().PublishUserChange(mock.MatchedBy(func(p types.SubscriptionPayload) bool {
+					return p.UserId == user.Id &&
+						p.Change == types.UserChangeTypeUpdated &&
+						p.Revision == updated.Revision &&
+						slices.Equal(p.ChangedFields, []string{"first_name"}) &&
+						p.Before != nil && p.Before.Password == "" &&
+						p.After != nil && p.After.Password == "" && p.After.FirstName == updated.FirstName
+				})).Return(tt.pubsubError)
 			}
 			us := &userService{
 				repo:   repo,
@@ -244,3 +324,310 @@ func Test_userService_UpdatePartial(t *testing.T) {
 		})
 	}
 }
+
+func Test_userService_DeleteMany(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		user   = fixtures_test.NewUser()
+		filter = types.UserFilter{Countries: []string{user.Country}}
+	)
+
+	tests := []struct {
+		name          string
+		filter        types.UserFilter
+		dryRun        bool
+		listLimit     int64
+		listTotal     uint64
+		listErr       error
+		discardList   bool
+		expectDelete  bool
+		deleteErr     error
+		expectPublish bool
+		pubsubErr     error
+		want          types.DeleteManyResult
+		wantErr       error
+	}{
+		{
+			name:          "happy case",
+			filter:        filter,
+			listLimit:     maxDeleteMany,
+			listTotal:     1,
+			expectDelete:  true,
+			expectPublish: true,
+			want:          types.DeleteManyResult{Count: 1, SampleIds: []uuid.UUID{user.Id}},
+		},
+		{
+			name:      "happy case dry-run",
+			filter:    filter,
+			dryRun:    true,
+			listLimit: deleteManySampleSize,
+			listTotal: 50,
+			want:      types.DeleteManyResult{Count: 50, SampleIds: []uuid.UUID{user.Id}},
+		},
+		{
+			name:          "sad case (soft-)failed pubsub-publish",
+			filter:        filter,
+			listLimit:     maxDeleteMany,
+			listTotal:     1,
+			expectDelete:  true,
+			expectPublish: true,
+			pubsubErr:     errors.New("error"),
+			want:          types.DeleteManyResult{Count: 1, SampleIds: []uuid.UUID{user.Id}},
+		},
+		{
+			name:        "sad case empty filter",
+			filter:      types.UserFilter{Created: &types.TimeFilter{}},
+			discardList: true,
+			wantErr:     types.ErrEmptyFilter,
+		},
+		{
+			name:      "sad case too many matches",
+			filter:    filter,
+			listLimit: maxDeleteMany,
+			listTotal: maxDeleteMany + 1,
+			wantErr:   types.ErrLimitExceeded,
+		},
+		{
+			name:      "sad case error from list",
+			filter:    filter,
+			listLimit: maxDeleteMany,
+			listErr:   types.ErrUnknownError,
+			wantErr:   types.ErrUnknownError,
+		},
+		{
+			name:         "sad case error from delete",
+			filter:       filter,
+			listLimit:    maxDeleteMany,
+			listTotal:    1,
+			expectDelete: true,
+			deleteErr:    types.ErrUnknownError,
+			wantErr:      types.ErrUnknownError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := mocks.NewMockUserRepository(t)
+			pubsub := mocks.NewMockPubSubService(t)
+
+			if !tt.discardList {
+				repo.EXPECT().List(ctx, tt.filter, types.Paging{Limit: tt.listLimit}).Return([]types.User{user}, tt.listTotal, tt.listErr)
+			}
+			if tt.expectDelete {
+				repo.EXPECT().DeleteMany(ctx, []uuid.UUID{user.Id}).Return(1, tt.deleteErr)
+			}
+			if tt.expectPublish {
+				pubsub.EXPECT().PublishUserChange(payloadFor(user.Id, types.UserChangeTypeDeleted)).Return(tt.pubsubErr)
+			}
+
+			s := newTestService(repo, pubsub)
+
+			got, err := s.DeleteMany(ctx, tt.filter, tt.dryRun)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_userService_Upsert(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		user = fixtures_test.NewUser()
+	)
+
+	tests := []struct {
+		name                       string
+		user                       types.User
+		key                        types.UpsertKey
+		created                    bool
+		repoError                  error
+		discardRepoMockExpectation bool
+		expectPublish              bool
+		wantChange                 types.UserChangeType
+		pubsubError                error
+		wantErr                    error
+	}{
+		{
+			name:          "happy case created",
+			user:          user,
+			key:           types.UpsertKeyId,
+			created:       true,
+			expectPublish: true,
+			wantChange:    types.UserChangeTypeCreated,
+		},
+		{
+			name:          "happy case updated",
+			user:          user,
+			key:           types.UpsertKeyId,
+			expectPublish: true,
+			wantChange:    types.UserChangeTypeUpdated,
+		},
+		{
+			name:          "happy case by email without id",
+			user:          types.User{Email: user.Email},
+			key:           types.UpsertKeyEmail,
+			expectPublish: true,
+			wantChange:    types.UserChangeTypeUpdated,
+		},
+		{
+			name:          "sad case (soft-)failed pubsub-publish",
+			user:          user,
+			key:           types.UpsertKeyId,
+			expectPublish: true,
+			wantChange:    types.UserChangeTypeUpdated,
+			pubsubError:   errors.New("error"),
+		},
+		{
+			name:                       "sad case missing id",
+			user:                       types.User{Email: user.Email},
+			key:                        types.UpsertKeyId,
+			discardRepoMockExpectation: true,
+			wantErr:                    types.ErrInvalidUserId,
+		},
+		{
+			name:                       "sad case missing email",
+			user:                       types.User{Id: user.Id},
+			key:                        types.UpsertKeyEmail,
+			discardRepoMockExpectation: true,
+			wantErr:                    types.ErrInvalidEmail,
+		},
+		{
+			name:      "sad case error from repository",
+			user:      user,
+			key:       types.UpsertKeyId,
+			repoError: types.ErrUnknownError,
+			wantErr:   types.ErrUnknownError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := mocks.NewMockUserRepository(t)
+			pubsub := mocks.NewMockPubSubService(t)
+
+			stored := fixtures_test.NewUser()
+
+			var before *types.User
+			if !tt.created {
+				before = &stored
+			}
+
+			if !tt.discardRepoMockExpectation {
+				repo.EXPECT().Upsert(ctx, mock.MatchedBy(func(u types.User) bool {
+					return u.Id != uuid.Nil && !u.CreatedAt.IsZero() && u.UpdatedAt != nil
+				}), tt.key).Return(before, stored, tt.repoError)
+			}
+			if tt.expectPublish {
+				pubsub.EXPECT().PublishUserChange(payloadFor(stored.Id, tt.wantChange)).Return(tt.pubsubError)
+			}
+
+			s := newTestService(repo, pubsub)
+
+			userCopy := tt.user
+			created, err := s.Upsert(ctx, &userCopy, tt.key)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.created, created)
+			require.Equal(t, stored, userCopy, "user should be set to the stored state")
+		})
+	}
+}
+
+func Test_userService_SubscribeToUserChanges(t *testing.T) {
+	german := types.User{Id: uuid.New(), Country: "DE"}
+	swedish := types.User{Id: uuid.New(), Country: "SE"}
+
+	published := []types.SubscriptionPayload{
+		types.NewUserChangePayload(types.UserChangeTypeCreated, nil, german),
+		types.NewUserChangePayload(types.UserChangeTypeCreated, nil, swedish),
+		{UserId: german.Id, Change: types.UserChangeTypeDeleted, Timestamp: time.Now()},
+	}
+
+	tests := []struct {
+		name    string
+		req     types.SubscriptionRequest
+		want    []uuid.UUID
+		wantErr bool
+		subErr  error
+	}{
+		{
+			name: "happy case no filter",
+			req:  types.SubscriptionRequest{},
+			want: []uuid.UUID{german.Id, swedish.Id, german.Id},
+		},
+		{
+			name: "happy case filter on country",
+			req:  types.SubscriptionRequest{Filter: types.UserFilter{Countries: []string{"DE"}}},
+			want: []uuid.UUID{german.Id},
+		},
+		{
+			name:    "sad case error from pubsub",
+			req:     types.SubscriptionRequest{Filter: types.UserFilter{Countries: []string{"DE"}}},
+			wantErr: true,
+			subErr:  errors.New("error"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			mps := mocks.NewMockPubSubService(t)
+
+			var ch chan types.SubscriptionPayload
+			if tt.subErr == nil {
+				ch = make(chan types.SubscriptionPayload, len(published))
+				for _, p := range published {
+					ch <- p
+				}
+				close(ch)
+			}
+			mps.EXPECT().SubscribeToUserChanges(ctx, tt.req).Return(ch, tt.subErr)
+
+			s := newTestService(mocks.NewMockUserRepository(t), mps)
+
+			got, lag, err := s.SubscribeToUserChanges(ctx, tt.req)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var ids []uuid.UUID
+			for p := range got {
+				ids = append(ids, p.UserId)
+			}
+			require.Equal(t, tt.want, ids)
+			require.Zero(t, lag())
+		})
+	}
+
+	t.Run("filtered changes wait in the subscriber buffer", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ch := make(chan types.SubscriptionPayload, len(published))
+		for _, p := range published {
+			ch <- p
+		}
+
+		req := types.SubscriptionRequest{Filter: types.UserFilter{Countries: []string{"DE"}}}
+		mps := mocks.NewMockPubSubService(t)
+		mps.EXPECT().SubscribeToUserChanges(ctx, req).Return(ch, nil)
+
+		_, lag, err := newTestService(mocks.NewMockUserRepository(t), mps).SubscribeToUserChanges(ctx, req)
+		require.NoError(t, err)
+
+		// the first change is held until the subscriber reads it, the others stay buffered
+		require.Eventually(t, func() bool { return lag() == len(published)-1 }, time.Second, time.Millisecond)
+		require.Never(t, func() bool { return lag() < len(published)-1 }, 50*time.Millisecond, time.Millisecond)
+	})
+}
@@ -0,0 +1,103 @@
+package domain
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/captainlettuce/users-microservice/internal/webhook"
+	"github.com/google/uuid"
+	"net/url"
+	"time"
+)
+
+const (
+	// webhookSecretBytes is the length of generated webhook secrets before hex encoding
+	webhookSecretBytes = 32
+
+	// defaultWebhookPageSize is used when listing webhooks, deliveries or dead letters without a limit
+	defaultWebhookPageSize = 100
+)
+
+type webhookService struct {
+	repo    internal.WebhookRepository
+	targets *webhook.TargetPolicy
+}
+
+// NewWebhookService registers webhooks for the urls allowed by targets
+func NewWebhookService(repo internal.WebhookRepository, targets *webhook.TargetPolicy) internal.WebhookService {
+	return &webhookService{
+		repo:    repo,
+		targets: targets,
+	}
+}
+
+func (ws *webhookService) Register(ctx context.Context, hook *types.Webhook) error {
+	u, err := url.Parse(hook.Url)
+	if err != nil {
+		return errors.Join(types.ErrInvalidWebhookUrl, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Join(types.ErrInvalidWebhookUrl, errors.New("url has to be an absolute http(s) url"))
+	}
+	if err := ws.targets.Check(ctx, u); err != nil {
+		return errors.Join(types.ErrInvalidWebhookUrl, err)
+	}
+
+	if hook.Secret == "" {
+		b := make([]byte, webhookSecretBytes)
+		if _, err := rand.Read(b); err != nil {
+			return errors.Join(types.ErrUnknownError, err)
+		}
+		hook.Secret = hex.EncodeToString(b)
+	}
+
+	hook.Id = uuid.New()
+	hook.CreatedAt = time.Now()
+
+	// webhooks only ever receive new changes
+	hook.Subscription.StartSequence = 0
+	hook.Subscription.StartTime = nil
+
+	if err := ws.repo.AddWebhook(ctx, *hook); err != nil {
+		return fmt.Errorf("failed to add webhook: %w", err)
+	}
+
+	return nil
+}
+
+func (ws *webhookService) Delete(ctx context.Context, id uuid.UUID) error {
+	return ws.repo.DeleteWebhook(ctx, id)
+}
+
+func (ws *webhookService) List(ctx context.Context, paging types.Paging) ([]types.Webhook, uint64, error) {
+	webhooks, total, err := ws.repo.ListWebhooks(ctx, withDefaultLimit(paging))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, total, nil
+}
+
+func (ws *webhookService) ListDeliveries(ctx context.Context, webhookId uuid.UUID, paging types.Paging) ([]types.WebhookDelivery, uint64, error) {
+	return ws.repo.ListDeliveries(ctx, webhookId, withDefaultLimit(paging))
+}
+
+func (ws *webhookService) ListDeadLetters(ctx context.Context, webhookId uuid.UUID, paging types.Paging) ([]types.WebhookDeadLetter, uint64, error) {
+	return ws.repo.ListDeadLetters(ctx, webhookId, withDefaultLimit(paging))
+}
+
+// withDefaultLimit limits pages without a limit, as the repository would otherwise return everything
+func withDefaultLimit(paging types.Paging) types.Paging {
+	if paging.Limit <= 0 {
+		paging.Limit = defaultWebhookPageSize
+	}
+	return paging
+}
@@ -0,0 +1,170 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/internal/mocks"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/captainlettuce/users-microservice/internal/webhook"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// staticResolver resolves hosts to fixed addresses, unknown hosts don't resolve
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func Test_webhookService_Register(t *testing.T) {
+	startTime := time.Now()
+	resolver := staticResolver{
+		"example.com":  {netip.MustParseAddr("93.184.215.14")},
+		"internal.com": {netip.MustParseAddr("93.184.215.14"), netip.MustParseAddr("10.0.0.1")},
+	}
+
+	tests := []struct {
+		name       string
+		webhook    types.Webhook
+		repoErr    error
+		skipRepo   bool
+		wantErr    error
+		wantSecret string
+		targets    []webhook.TargetOption
+	}{
+		{
+			name:    "happy case generates secret",
+			webhook: types.Webhook{Url: "https://example.com/hook"},
+		},
+		{
+			name:       "happy case keeps given secret",
+			webhook:    types.Webhook{Url: "http://example.com/hook", Secret: "secret"},
+			wantSecret: "secret",
+		},
+		{
+			name: "start point is ignored",
+			webhook: types.Webhook{
+				Url:          "https://example.com/hook",
+				Subscription: types.SubscriptionRequest{StartSequence: 42, StartTime: &startTime},
+			},
+		},
+		{
+			name:     "sad case relative url",
+			webhook:  types.Webhook{Url: "/hook"},
+			skipRepo: true,
+			wantErr:  types.ErrInvalidWebhookUrl,
+		},
+		{
+			name:     "sad case unsupported scheme",
+			webhook:  types.Webhook{Url: "ftp://example.com/hook"},
+			skipRepo: true,
+			wantErr:  types.ErrInvalidWebhookUrl,
+		},
+		{
+			name:     "sad case loopback address",
+			webhook:  types.Webhook{Url: "http://127.0.0.1:8080/hook"},
+			skipRepo: true,
+			wantErr:  types.ErrInvalidWebhookUrl,
+		},
+		{
+			name:     "sad case link-local address",
+			webhook:  types.Webhook{Url: "http://169.254.169.254/latest/meta-data"},
+			skipRepo: true,
+			wantErr:  types.ErrInvalidWebhookUrl,
+		},
+		{
+			name:     "sad case host resolving to a private address",
+			webhook:  types.Webhook{Url: "https://internal.com/hook"},
+			skipRepo: true,
+			wantErr:  types.ErrInvalidWebhookUrl,
+		},
+		{
+			name:     "sad case unresolvable host",
+			webhook:  types.Webhook{Url: "https://unknown.example.com/hook"},
+			skipRepo: true,
+			wantErr:  types.ErrInvalidWebhookUrl,
+		},
+		{
+			name:    "happy case private address when allowed",
+			webhook: types.Webhook{Url: "http://[fd00::1]/hook"},
+			targets: []webhook.TargetOption{webhook.WithPrivateTargets()},
+		},
+		{
+			name:    "happy case allowed host",
+			webhook: types.Webhook{Url: "https://example.com/hook"},
+			targets: []webhook.TargetOption{webhook.WithAllowedHosts("*.other.com", "example.com")},
+		},
+		{
+			name:     "sad case host not allowed",
+			webhook:  types.Webhook{Url: "https://example.com/hook"},
+			targets:  []webhook.TargetOption{webhook.WithAllowedHosts("*.example.com")},
+			skipRepo: true,
+			wantErr:  types.ErrInvalidWebhookUrl,
+		},
+		{
+			name:    "sad case repository error",
+			webhook: types.Webhook{Url: "https://example.com/hook"},
+			repoErr: types.ErrUnknownError,
+			wantErr: types.ErrUnknownError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := mocks.NewMockWebhookRepository(t)
+			if !tt.skipRepo {
+				repo.EXPECT().AddWebhook(mock.Anything, mock.MatchedBy(func(w types.Webhook) bool {
+					return w.Id != uuid.Nil && w.Secret != "" && !w.CreatedAt.IsZero() &&
+						w.Subscription.StartSequence == 0 && w.Subscription.StartTime == nil
+				})).Return(tt.repoErr)
+			}
+
+			targets := webhook.NewTargetPolicy(append(tt.targets, webhook.WithResolver(resolver))...)
+
+			hook := tt.webhook
+			err := NewWebhookService(repo, targets).Register(context.Background(), &hook)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotEqual(t, uuid.Nil, hook.Id)
+			if tt.wantSecret != "" {
+				require.Equal(t, tt.wantSecret, hook.Secret)
+			} else {
+				require.Len(t, hook.Secret, 2*webhookSecretBytes)
+			}
+		})
+	}
+}
+
+func Test_webhookService_List(t *testing.T) {
+	t.Run("secrets are removed and the page is limited", func(t *testing.T) {
+		repo := mocks.NewMockWebhookRepository(t)
+		repo.EXPECT().ListWebhooks(mock.Anything, types.Paging{Limit: defaultWebhookPageSize}).
+			Return([]types.Webhook{{Id: uuid.New(), Secret: "secret"}}, 1, nil)
+
+		webhooks, total, err := NewWebhookService(repo, webhook.NewTargetPolicy()).List(context.Background(), types.Paging{})
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), total)
+		require.Empty(t, webhooks[0].Secret)
+	})
+
+	t.Run("sad case repository error", func(t *testing.T) {
+		repo := mocks.NewMockWebhookRepository(t)
+		repo.EXPECT().ListWebhooks(mock.Anything, types.Paging{Limit: 10}).Return(nil, 0, errors.New("error"))
+
+		_, _, err := NewWebhookService(repo, webhook.NewTargetPolicy()).List(context.Background(), types.Paging{Limit: 10})
+		require.Error(t, err)
+	})
+}
@@ -18,6 +18,7 @@ func NewUser() types.User {
 		Country:   "UK",
 		CreatedAt: t,
 		UpdatedAt: ref(t.Add(time.Hour)),
+		Revision:  1,
 	}
 }
 
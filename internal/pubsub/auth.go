@@ -0,0 +1,127 @@
+package pubsub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"os"
+)
+
+// natsAuth holds the supported ways to authenticate with nats, at most one of them may be set
+type natsAuth struct {
+	credentialsFile string
+	nkeySeedFile    string
+	user            string
+	password        string
+	token           string
+}
+
+type natsTLS struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+}
+
+// WithCredentialsFile authenticates using a decentralized jwt and nkey seed stored in a .creds file
+func WithCredentialsFile(path string) Option {
+	return func(settings *NatsSettings) {
+		settings.auth.credentialsFile = path
+	}
+}
+
+// WithNkeySeedFile authenticates by signing the server nonce with the nkey seed stored in path
+func WithNkeySeedFile(path string) Option {
+	return func(settings *NatsSettings) {
+		settings.auth.nkeySeedFile = path
+	}
+}
+
+// WithUserPassword authenticates using a username and password
+func WithUserPassword(user, password string) Option {
+	return func(settings *NatsSettings) {
+		settings.auth.user = user
+		settings.auth.password = password
+	}
+}
+
+// WithToken authenticates using a token
+func WithToken(token string) Option {
+	return func(settings *NatsSettings) {
+		settings.auth.token = token
+	}
+}
+
+// WithTLS connects to nats over tls, all arguments are optional
+// caFile replaces the system roots for verifying the server, certFile and keyFile are a client certificate to present
+// and serverName overrides the host name the server certificate is verified against
+func WithTLS(caFile, certFile, keyFile, serverName string) Option {
+	return func(settings *NatsSettings) {
+		settings.tls = &natsTLS{
+			caFile:     caFile,
+			certFile:   certFile,
+			keyFile:    keyFile,
+			serverName: serverName,
+		}
+	}
+}
+
+// options converts the configured authentication to nats connect options
+func (a natsAuth) options() ([]nats.Option, error) {
+	var methods []nats.Option
+
+	if a.credentialsFile != "" {
+		methods = append(methods, nats.UserCredentials(a.credentialsFile))
+	}
+	if a.nkeySeedFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(a.nkeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read nkey seed: %w", err)
+		}
+		methods = append(methods, opt)
+	}
+	if a.user != "" || a.password != "" {
+		methods = append(methods, nats.UserInfo(a.user, a.password))
+	}
+	if a.token != "" {
+		methods = append(methods, nats.Token(a.token))
+	}
+
+	if len(methods) > 1 {
+		return nil, errors.New("only one nats authentication method can be used")
+	}
+
+	return methods, nil
+}
+
+// config loads the configured certificates into a tls config
+func (t natsTLS) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: t.serverName,
+	}
+
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read nats ca: %w", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in nats ca %s", t.caFile)
+		}
+	}
+
+	if t.certFile != "" || t.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load nats client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,229 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewNatsClient_auth(t *testing.T) {
+	nkey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	nkeyPublic, err := nkey.PublicKey()
+	require.NoError(t, err)
+	nkeySeed, err := nkey.Seed()
+	require.NoError(t, err)
+
+	nkeySeedFile := filepath.Join(t.TempDir(), "user.nk")
+	require.NoError(t, os.WriteFile(nkeySeedFile, nkeySeed, 0600))
+
+	otherKey, err := nkeys.CreateUser()
+	require.NoError(t, err)
+	otherSeed, err := otherKey.Seed()
+	require.NoError(t, err)
+
+	otherSeedFile := filepath.Join(t.TempDir(), "other.nk")
+	require.NoError(t, os.WriteFile(otherSeedFile, otherSeed, 0600))
+
+	tests := []struct {
+		name      string
+		configure func(*server.Options)
+		options   []Option
+		wantErr   bool
+	}{
+		{
+			name:      "token",
+			configure: func(o *server.Options) { o.Authorization = "secret" },
+			options:   []Option{WithToken("secret")},
+		},
+		{
+			name:      "sad case wrong token",
+			configure: func(o *server.Options) { o.Authorization = "secret" },
+			options:   []Option{WithToken("wrong")},
+			wantErr:   true,
+		},
+		{
+			name:      "user and password",
+			configure: func(o *server.Options) { o.Username, o.Password = "user", "secret" },
+			options:   []Option{WithUserPassword("user", "secret")},
+		},
+		{
+			name:      "sad case wrong password",
+			configure: func(o *server.Options) { o.Username, o.Password = "user", "secret" },
+			options:   []Option{WithUserPassword("user", "wrong")},
+			wantErr:   true,
+		},
+		{
+			name:      "nkey",
+			configure: func(o *server.Options) { o.Nkeys = []*server.NkeyUser{{Nkey: nkeyPublic}} },
+			options:   []Option{WithNkeySeedFile(nkeySeedFile)},
+		},
+		{
+			name:      "sad case unknown nkey",
+			configure: func(o *server.Options) { o.Nkeys = []*server.NkeyUser{{Nkey: nkeyPublic}} },
+			options:   []Option{WithNkeySeedFile(otherSeedFile)},
+			wantErr:   true,
+		},
+		{
+			name:      "sad case missing credentials",
+			configure: func(o *server.Options) { o.Authorization = "secret" },
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewNatsClient(discardLogger, runTestNatsServer(t, tt.configure), append(tt.options, WithConnectTimeout(time.Second))...)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, client.GracefulShutdown(context.Background()))
+		})
+	}
+}
+
+func TestNewNatsClient_tls(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "server", ca, caKey)
+	writeTestCert(t, dir, "client", ca, caKey)
+
+	var (
+		caFile     = filepath.Join(dir, "ca.pem")
+		clientCert = filepath.Join(dir, "client.pem")
+		clientKey  = filepath.Join(dir, "client-key.pem")
+	)
+
+	serverPair, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	uri := runTestNatsServer(t, func(o *server.Options) {
+		o.TLS = true
+		o.TLSVerify = true
+		o.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{serverPair},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		}
+	})
+
+	tests := []struct {
+		name    string
+		options []Option
+		wantErr bool
+	}{
+		{
+			name:    "ca, client certificate and server name",
+			options: []Option{WithTLS(caFile, clientCert, clientKey, "server")},
+		},
+		{
+			name:    "sad case wrong server name",
+			options: []Option{WithTLS(caFile, clientCert, clientKey, "other")},
+			wantErr: true,
+		},
+		{
+			name:    "sad case missing client certificate",
+			options: []Option{WithTLS(caFile, "", "", "server")},
+			wantErr: true,
+		},
+		{
+			name:    "sad case unreadable ca",
+			options: []Option{WithTLS(filepath.Join(dir, "missing.pem"), clientCert, clientKey, "server")},
+			wantErr: true,
+		},
+		{
+			name:    "sad case no certificates in ca",
+			options: []Option{WithTLS(clientKey, clientCert, clientKey, "server")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewNatsClient(discardLogger, uri, append(tt.options, WithConnectTimeout(time.Second))...)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, client.GracefulShutdown(context.Background()))
+		})
+	}
+}
+
+func Test_natsAuth_options(t *testing.T) {
+	t.Run("no authentication", func(t *testing.T) {
+		opts, err := natsAuth{}.options()
+		require.NoError(t, err)
+		require.Empty(t, opts)
+	})
+
+	t.Run("sad case multiple methods", func(t *testing.T) {
+		_, err := natsAuth{token: "secret", user: "user", password: "secret"}.options()
+		require.Error(t, err)
+	})
+
+	t.Run("sad case missing nkey seed", func(t *testing.T) {
+		_, err := natsAuth{nkeySeedFile: filepath.Join(t.TempDir(), "missing.nk")}.options()
+		require.Error(t, err)
+	})
+}
+
+// writeTestCert writes a certificate for name and its key as pem files to dir, named after name
+// the certificate is a self-signed ca if parent is nil
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return cert, key
+}
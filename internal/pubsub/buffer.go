@@ -0,0 +1,67 @@
+package pubsub
+
+import (
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"sync/atomic"
+)
+
+type OverflowPolicy string
+
+const (
+	// OverflowPolicyDropOldest discards the oldest buffered payload to make room when a subscriber lags
+	OverflowPolicyDropOldest OverflowPolicy = "drop-oldest"
+
+	// OverflowPolicyDisconnect cuts off a lagging subscriber with types.ErrSubscriberLagging
+	OverflowPolicyDisconnect OverflowPolicy = "disconnect"
+)
+
+// subscriptionBuffer delivers payloads to a single subscriber through a bounded channel
+// the producer never blocks on the subscriber, the overflow policy is applied instead when the buffer is full
+// push and close must only be called from the producing goroutine
+type subscriptionBuffer struct {
+	ch      chan types.SubscriptionPayload
+	policy  OverflowPolicy
+	dropped atomic.Uint64
+}
+
+func newSubscriptionBuffer(size int, policy OverflowPolicy) *subscriptionBuffer {
+	return &subscriptionBuffer{
+		ch:     make(chan types.SubscriptionPayload, max(size, 1)),
+		policy: policy,
+	}
+}
+
+// push buffers p for the subscriber, returns false if the subscriber was cut off and the subscription should stop
+func (b *subscriptionBuffer) push(p types.SubscriptionPayload) bool {
+	p.Dropped = b.dropped.Load()
+
+	select {
+	case b.ch <- p:
+		return true
+	default:
+	}
+
+	if b.policy == OverflowPolicyDropOldest {
+		select {
+		case <-b.ch:
+			p.Dropped = b.dropped.Add(1)
+		default:
+		}
+		// being the only sender there is always room after removing an entry
+		b.ch <- p
+		return true
+	}
+
+	// the subscriber will not read what is buffered in time anyway, make room for the error and let it resume by sequence
+	for len(b.ch) > 0 {
+		<-b.ch
+	}
+	b.ch <- types.SubscriptionPayload{Err: types.ErrSubscriberLagging}
+
+	return false
+}
+
+// close ends the subscription, buffered payloads are still delivered to the subscriber
+func (b *subscriptionBuffer) close() {
+	close(b.ch)
+}
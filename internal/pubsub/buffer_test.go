@@ -0,0 +1,52 @@
+package pubsub
+
+import (
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_subscriptionBuffer_push(t *testing.T) {
+	payloads := []types.SubscriptionPayload{{Sequence: 1}, {Sequence: 2}, {Sequence: 3}}
+
+	tests := []struct {
+		name        string
+		policy      OverflowPolicy
+		wantOk      []bool
+		want        []types.SubscriptionPayload
+		wantDropped uint64
+	}{
+		{
+			name:        "drop oldest keeps the newest payloads",
+			policy:      OverflowPolicyDropOldest,
+			wantOk:      []bool{true, true, true},
+			want:        []types.SubscriptionPayload{{Sequence: 2}, {Sequence: 3, Dropped: 1}},
+			wantDropped: 1,
+		},
+		{
+			name:   "disconnect cuts off the subscriber",
+			policy: OverflowPolicyDisconnect,
+			wantOk: []bool{true, true, false},
+			want:   []types.SubscriptionPayload{{Err: types.ErrSubscriberLagging}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newSubscriptionBuffer(2, tt.policy)
+
+			for i, p := range payloads {
+				require.Equal(t, tt.wantOk[i], b.push(p), "unexpected push result for payload %d", i)
+			}
+			b.close()
+
+			var got []types.SubscriptionPayload
+			for p := range b.ch {
+				got = append(got, p)
+			}
+
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.wantDropped, b.dropped.Load())
+		})
+	}
+}
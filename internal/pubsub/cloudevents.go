@@ -0,0 +1,195 @@
+package pubsub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"mime"
+	"strings"
+	"time"
+)
+
+// EventFormat is how changes are encoded when they are published
+type EventFormat string
+
+const (
+	// EventFormatProtobuf publishes the bare SubscriptionResponse protobuf without CloudEvents metadata
+	EventFormatProtobuf EventFormat = "protobuf"
+
+	// EventFormatCloudEventsBinary publishes a CloudEvent with its attributes in ce- headers and the protobuf as data
+	EventFormatCloudEventsBinary EventFormat = "binary"
+
+	// EventFormatCloudEventsStructured publishes a CloudEvent json envelope with the SubscriptionResponse json as data
+	EventFormatCloudEventsStructured EventFormat = "structured"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsTypePrefix  = "users.v1."
+
+	contentTypeHeader          = "content-type"
+	contentTypeProtobuf        = "application/protobuf"
+	contentTypeJson            = "application/json"
+	contentTypeCloudEventsJson = "application/cloudevents+json"
+
+	// binary mode headers as defined by the CloudEvents nats protocol binding
+	ceSpecVersionHeader = "ce-specversion"
+	ceIdHeader          = "ce-id"
+	ceSourceHeader      = "ce-source"
+	ceTypeHeader        = "ce-type"
+	ceTimeHeader        = "ce-time"
+	ceSubjectHeader     = "ce-subject"
+)
+
+// cloudEvent is the json envelope of a structured mode CloudEvent
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Id              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time,omitempty"`
+	Subject         string          `json:"subject,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// WithEventFormat sets how changes are published, source is the CloudEvents source attribute identifying this service
+// subscribers understand all formats regardless of this setting
+func WithEventFormat(format EventFormat, source string) Option {
+	return func(settings *NatsSettings) {
+		settings.eventFormat = format
+		settings.eventSource = source
+	}
+}
+
+// CloudEventType is the CloudEvents type attribute of a change, e.g. users.v1.updated
+func CloudEventType(change types.UserChangeType) string {
+	return cloudEventsTypePrefix + strings.ToLower(string(change))
+}
+
+// encodeEvent creates the message publishing resp in the given format
+func encodeEvent(format EventFormat, source string, p types.SubscriptionPayload, resp *generated.SubscriptionResponse) (*nats.Msg, error) {
+	// the event id doubles as the jetstream message id, so retried publishes are not stored twice
+	eventId := uuid.NewString()
+	msg := &nats.Msg{Header: nats.Header{jetstream.MsgIDHeader: {eventId}}}
+
+	eventTime := p.Timestamp
+	if eventTime.IsZero() {
+		eventTime = time.Now()
+	}
+
+	switch format {
+	case EventFormatCloudEventsBinary:
+		b, err := proto.Marshal(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Header.Set(ceSpecVersionHeader, cloudEventsSpecVersion)
+		msg.Header.Set(ceIdHeader, eventId)
+		msg.Header.Set(ceSourceHeader, source)
+		msg.Header.Set(ceTypeHeader, CloudEventType(p.Change))
+		msg.Header.Set(ceTimeHeader, eventTime.UTC().Format(time.RFC3339Nano))
+		msg.Header.Set(ceSubjectHeader, p.UserId.String())
+		msg.Header.Set(contentTypeHeader, contentTypeProtobuf)
+		msg.Data = b
+	case EventFormatCloudEventsStructured:
+		data, err := protojson.Marshal(resp)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := json.Marshal(cloudEvent{
+			SpecVersion:     cloudEventsSpecVersion,
+			Id:              eventId,
+			Source:          source,
+			Type:            CloudEventType(p.Change),
+			Time:            eventTime.UTC().Format(time.RFC3339Nano),
+			Subject:         p.UserId.String(),
+			DataContentType: contentTypeJson,
+			Data:            data,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Header.Set(contentTypeHeader, contentTypeCloudEventsJson)
+		msg.Data = b
+	default:
+		b, err := proto.Marshal(resp)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = b
+	}
+
+	return msg, nil
+}
+
+// decodeEvent reads the SubscriptionResponse from a message in any of the event formats
+func decodeEvent(header nats.Header, data []byte) (*generated.SubscriptionResponse, error) {
+	if header.Get(ceSpecVersionHeader) != "" {
+		return unmarshalEventData(header.Get(contentTypeHeader), data)
+	}
+
+	if mediaType(header.Get(contentTypeHeader)) != contentTypeCloudEventsJson {
+		return unmarshalEventData(contentTypeProtobuf, data)
+	}
+
+	var event cloudEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("invalid structured cloud event: %w", err)
+	}
+
+	if event.DataBase64 != "" {
+		b, err := base64.StdEncoding.DecodeString(event.DataBase64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cloud event data_base64: %w", err)
+		}
+		return unmarshalEventData(event.DataContentType, b)
+	}
+
+	contentType := event.DataContentType
+	if contentType == "" {
+		contentType = contentTypeJson
+	}
+	return unmarshalEventData(contentType, event.Data)
+}
+
+// unmarshalEventData decodes data as protobuf or json depending on contentType, protobuf if it is not set
+func unmarshalEventData(contentType string, data []byte) (*generated.SubscriptionResponse, error) {
+	resp := &generated.SubscriptionResponse{}
+
+	switch mediaType(contentType) {
+	case "", contentTypeProtobuf:
+		if err := proto.Unmarshal(data, resp); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message to protobuf: %w", err)
+		}
+	case contentTypeJson:
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, resp); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message from json: %w", err)
+		}
+	default:
+		return nil, errors.New("unsupported event data content type " + contentType)
+	}
+
+	return resp, nil
+}
+
+// mediaType strips parameters such as charset from a content type
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return t
+}
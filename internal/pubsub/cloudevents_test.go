@@ -0,0 +1,154 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"testing"
+	"time"
+)
+
+func Test_encodeEvent(t *testing.T) {
+	var (
+		userId    = uuid.New()
+		timestamp = time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+		payload   = types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeUpdated, Revision: 3, Timestamp: timestamp}
+	)
+	resp, ok := payload.Proto()
+	require.True(t, ok)
+
+	t.Run("protobuf only has a message id", func(t *testing.T) {
+		msg, err := encodeEvent(EventFormatProtobuf, "test", payload, resp)
+		require.NoError(t, err)
+		require.Len(t, msg.Header, 1)
+		require.NoError(t, uuid.Validate(msg.Header.Get(jetstream.MsgIDHeader)))
+	})
+
+	t.Run("binary mode carries attributes in headers", func(t *testing.T) {
+		msg, err := encodeEvent(EventFormatCloudEventsBinary, "test", payload, resp)
+		require.NoError(t, err)
+
+		require.Equal(t, "1.0", msg.Header.Get(ceSpecVersionHeader))
+		require.NoError(t, uuid.Validate(msg.Header.Get(ceIdHeader)))
+		require.Equal(t, msg.Header.Get(ceIdHeader), msg.Header.Get(jetstream.MsgIDHeader))
+		require.Equal(t, "test", msg.Header.Get(ceSourceHeader))
+		require.Equal(t, "users.v1.updated", msg.Header.Get(ceTypeHeader))
+		require.Equal(t, "2024-08-01T12:00:00Z", msg.Header.Get(ceTimeHeader))
+		require.Equal(t, userId.String(), msg.Header.Get(ceSubjectHeader))
+		require.Equal(t, contentTypeProtobuf, msg.Header.Get(contentTypeHeader))
+	})
+
+	t.Run("structured mode is a json envelope", func(t *testing.T) {
+		msg, err := encodeEvent(EventFormatCloudEventsStructured, "test", payload, resp)
+		require.NoError(t, err)
+		require.Equal(t, contentTypeCloudEventsJson, msg.Header.Get(contentTypeHeader))
+
+		var event cloudEvent
+		require.NoError(t, json.Unmarshal(msg.Data, &event))
+		require.Equal(t, "1.0", event.SpecVersion)
+		require.NoError(t, uuid.Validate(event.Id))
+		require.Equal(t, "test", event.Source)
+		require.Equal(t, "users.v1.updated", event.Type)
+		require.Equal(t, "2024-08-01T12:00:00Z", event.Time)
+		require.Equal(t, userId.String(), event.Subject)
+		require.Equal(t, contentTypeJson, event.DataContentType)
+		require.Contains(t, string(event.Data), userId.String())
+	})
+
+	t.Run("event ids are unique", func(t *testing.T) {
+		first, err := encodeEvent(EventFormatCloudEventsBinary, "test", payload, resp)
+		require.NoError(t, err)
+		second, err := encodeEvent(EventFormatCloudEventsBinary, "test", payload, resp)
+		require.NoError(t, err)
+		require.NotEqual(t, first.Header.Get(ceIdHeader), second.Header.Get(ceIdHeader))
+	})
+
+	for _, format := range []EventFormat{EventFormatProtobuf, EventFormatCloudEventsBinary, EventFormatCloudEventsStructured} {
+		t.Run("round trip "+string(format), func(t *testing.T) {
+			msg, err := encodeEvent(format, "test", payload, resp)
+			require.NoError(t, err)
+
+			got, err := decodeEvent(msg.Header, msg.Data)
+			require.NoError(t, err)
+			require.True(t, proto.Equal(resp, got), "decoded event differs")
+		})
+	}
+}
+
+func Test_decodeEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  nats.Header
+		data    string
+		wantErr bool
+	}{
+		{
+			name:   "happy case structured with base64 protobuf data",
+			header: nats.Header{contentTypeHeader: {"application/cloudevents+json; charset=utf-8"}},
+			data:   `{"specversion":"1.0","id":"1","source":"test","type":"users.v1.created","datacontenttype":"application/protobuf","data_base64":"GAE="}`,
+		},
+		{
+			name:   "happy case binary with json data",
+			header: nats.Header{ceSpecVersionHeader: {"1.0"}, contentTypeHeader: {contentTypeJson}},
+			data:   `{"sequence":"1","unknownField":true}`,
+		},
+		{
+			name:    "sad case invalid envelope",
+			header:  nats.Header{contentTypeHeader: {contentTypeCloudEventsJson}},
+			data:    `{`,
+			wantErr: true,
+		},
+		{
+			name:    "sad case unsupported data content type",
+			header:  nats.Header{ceSpecVersionHeader: {"1.0"}, contentTypeHeader: {"text/plain"}},
+			data:    `sequence 1`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeEvent(tt.header, []byte(tt.data))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.True(t, proto.Equal(&generated.SubscriptionResponse{Sequence: 1}, got))
+		})
+	}
+}
+
+func TestNatsClient_mixedEventFormats(t *testing.T) {
+	uri := runTestNatsServer(t)
+
+	subscriber, err := NewNatsClient(discardLogger, uri)
+	require.NoError(t, err)
+	defer func() { _ = subscriber.GracefulShutdown(context.Background()) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	userId := uuid.New()
+	ch, err := subscriber.SubscribeToUserChanges(ctx, types.SubscriptionRequest{UserIds: []uuid.UUID{userId}})
+	require.NoError(t, err)
+
+	for i, format := range []EventFormat{EventFormatCloudEventsBinary, EventFormatCloudEventsStructured, EventFormatProtobuf} {
+		publisher, err := NewNatsClient(discardLogger, uri, WithEventFormat(format, "test"), WithSharedSubscription(false))
+		require.NoError(t, err)
+
+		require.NoError(t, publisher.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeUpdated, Revision: uint64(i + 1)}))
+		require.NoError(t, publisher.GracefulShutdown(context.Background()))
+
+		got := receive(t, ch)
+		require.Equal(t, uint64(i+1), got.Revision, "change published as %s not received", format)
+		require.Equal(t, userId, got.UserId)
+	}
+}
@@ -0,0 +1,62 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/nats-io/nats-server/v2/server"
+	"time"
+)
+
+// EmbeddedNats is a nats server running inside the service process, so the service can run without any external nats
+type EmbeddedNats struct {
+	server *server.Server
+}
+
+// StartEmbeddedNats starts a jetstream enabled nats server storing changes in storeDir
+// port 0 only accepts in-process connections, otherwise other processes can connect to the port as well
+func StartEmbeddedNats(storeDir string, port int) (*EmbeddedNats, error) {
+	opts := &server.Options{
+		ServerName: "users-embedded",
+		JetStream:  true,
+		StoreDir:   storeDir,
+		Port:       port,
+		DontListen: port == 0,
+		NoSigs:     true,
+	}
+
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not create embedded nats server: %w", err)
+	}
+
+	go ns.Start()
+
+	if !ns.ReadyForConnections(10 * time.Second) {
+		ns.Shutdown()
+		return nil, fmt.Errorf("embedded nats server not ready for connections")
+	}
+
+	return &EmbeddedNats{server: ns}, nil
+}
+
+// ClientURL is the uri to connect to the embedded server with, connecting needs the WithInProcessServer option if it does not listen on a port
+func (en *EmbeddedNats) ClientURL() string {
+	return en.server.ClientURL()
+}
+
+func (en *EmbeddedNats) Shutdown(ctx context.Context) error {
+	en.server.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		en.server.WaitForShutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
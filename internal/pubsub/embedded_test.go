@@ -0,0 +1,30 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestStartEmbeddedNats(t *testing.T) {
+	embedded, err := StartEmbeddedNats(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, embedded.Shutdown(context.Background())) }()
+
+	client, err := NewNatsClient(discardLogger, embedded.ClientURL(), WithInProcessServer(embedded))
+	require.NoError(t, err)
+	defer func() { _ = client.GracefulShutdown(context.Background()) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := client.SubscribeToUserChanges(ctx, types.SubscriptionRequest{})
+	require.NoError(t, err)
+
+	userId := uuid.New()
+	require.NoError(t, client.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeCreated}))
+
+	require.Equal(t, userId, receive(t, ch).UserId)
+}
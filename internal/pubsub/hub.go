@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// hubKey indexes subscribers the same way change subjects are built, an empty change or nil user id is a wildcard
+type hubKey struct {
+	change types.UserChangeType
+	userId uuid.UUID
+}
+
+type hubSubscriber struct {
+	buf  *subscriptionBuffer
+	keys []hubKey
+}
+
+// hub fans out changes from a single shared subscription to all local subscribers they match
+// so that the number of nats subscriptions does not grow with the number of streaming clients
+type hub struct {
+	logger     *slog.Logger
+	bufferSize int
+	policy     OverflowPolicy
+
+	mu          sync.RWMutex
+	subscribers map[hubKey]map[*hubSubscriber]struct{}
+	closed      bool
+}
+
+func newHub(logger *slog.Logger, bufferSize int, policy OverflowPolicy) *hub {
+	return &hub{
+		logger:      logger,
+		bufferSize:  bufferSize,
+		policy:      policy,
+		subscribers: make(map[hubKey]map[*hubSubscriber]struct{}),
+	}
+}
+
+// subscribe registers a subscriber for the changes matching req until ctx is cancelled
+func (h *hub) subscribe(ctx context.Context, req types.SubscriptionRequest) (<-chan types.SubscriptionPayload, error) {
+	keys, err := hubKeysFromSubRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &hubSubscriber{
+		buf:  newSubscriptionBuffer(h.bufferSize, h.policy),
+		keys: keys,
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil, errors.Join(types.ErrUnknownError, errors.New("subscription hub is closed"))
+	}
+	for _, key := range keys {
+		if h.subscribers[key] == nil {
+			h.subscribers[key] = make(map[*hubSubscriber]struct{})
+		}
+		h.subscribers[key][sub] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		h.unsubscribe(sub)
+	})
+
+	return sub.buf.ch, nil
+}
+
+// dispatch delivers p to all matching subscribers, lagging subscribers are cut off according to the overflow policy
+// dispatch must only be called from the goroutine consuming the shared subscription
+func (h *hub) dispatch(p types.SubscriptionPayload) {
+	var lagging []*hubSubscriber
+
+	h.mu.RLock()
+	if h.closed {
+		h.mu.RUnlock()
+		return
+	}
+
+	for _, key := range [...]hubKey{
+		{change: p.Change, userId: p.UserId},
+		{change: p.Change},
+		{userId: p.UserId},
+		{},
+	} {
+		// a subscriber matches at most one key per change since its keys never overlap
+		for sub := range h.subscribers[key] {
+			if !deliver(context.Background(), h.logger, sub.buf, p) {
+				lagging = append(lagging, sub)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, sub := range lagging {
+		h.unsubscribe(sub)
+	}
+}
+
+// unsubscribe removes sub from the hub and closes its channel, it is safe to call more than once
+func (h *hub) unsubscribe(sub *hubSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub.keys[0]][sub]; !ok {
+		return
+	}
+
+	for _, key := range sub.keys {
+		delete(h.subscribers[key], sub)
+		if len(h.subscribers[key]) == 0 {
+			delete(h.subscribers, key)
+		}
+	}
+
+	sub.buf.close()
+}
+
+// close ends all subscriptions, subscribing to a closed hub fails and dispatching to it does nothing
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+
+	closed := make(map[*hubSubscriber]struct{})
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			if _, ok := closed[sub]; !ok {
+				closed[sub] = struct{}{}
+				sub.buf.close()
+			}
+		}
+	}
+
+	clear(h.subscribers)
+}
+
+// hubKeysFromSubRequest creates one key per combination of requested change type and user id
+func hubKeysFromSubRequest(req types.SubscriptionRequest) ([]hubKey, error) {
+	if len(req.UserIds) > types.MaxSubscriptionUserIds {
+		return nil, types.ErrLimitExceeded
+	}
+
+	changes := req.Changes
+	if len(changes) == 0 {
+		changes = []types.UserChangeType{""}
+	}
+
+	userIds := req.UserIds
+	if len(userIds) == 0 {
+		userIds = []uuid.UUID{uuid.Nil}
+	} else if slices.Contains(userIds, uuid.Nil) {
+		return nil, types.ErrInvalidUserId
+	}
+
+	seen := make(map[hubKey]struct{}, len(changes)*len(userIds))
+	keys := make([]hubKey, 0, len(changes)*len(userIds))
+	for _, change := range changes {
+		for _, userId := range userIds {
+			key := hubKey{change: change, userId: userId}
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys, nil
+}
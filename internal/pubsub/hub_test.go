@@ -0,0 +1,210 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// drain reads everything currently buffered on ch without waiting for more
+func drain(ch <-chan types.SubscriptionPayload) []types.SubscriptionPayload {
+	var got []types.SubscriptionPayload
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				return got
+			}
+			got = append(got, p)
+		default:
+			return got
+		}
+	}
+}
+
+func Test_hub_dispatch(t *testing.T) {
+	userA, userB := uuid.New(), uuid.New()
+
+	changes := []types.SubscriptionPayload{
+		{UserId: userA, Change: types.UserChangeTypeCreated, Sequence: 1},
+		{UserId: userB, Change: types.UserChangeTypeCreated, Sequence: 2},
+		{UserId: userA, Change: types.UserChangeTypeUpdated, Sequence: 3},
+		{UserId: userB, Change: types.UserChangeTypeDeleted, Sequence: 4},
+	}
+
+	tests := []struct {
+		name string
+		req  types.SubscriptionRequest
+		want []uint64
+	}{
+		{
+			name: "all changes",
+			req:  types.SubscriptionRequest{},
+			want: []uint64{1, 2, 3, 4},
+		},
+		{
+			name: "single user",
+			req:  types.SubscriptionRequest{UserIds: []uuid.UUID{userA}},
+			want: []uint64{1, 3},
+		},
+		{
+			name: "single change type",
+			req:  types.SubscriptionRequest{Changes: []types.UserChangeType{types.UserChangeTypeCreated}},
+			want: []uint64{1, 2},
+		},
+		{
+			name: "users and change types",
+			req: types.SubscriptionRequest{
+				UserIds: []uuid.UUID{userA, userB},
+				Changes: []types.UserChangeType{types.UserChangeTypeUpdated, types.UserChangeTypeDeleted},
+			},
+			want: []uint64{3, 4},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newHub(discardLogger, 10, OverflowPolicyDisconnect)
+
+	subs := make([]<-chan types.SubscriptionPayload, len(tests))
+	for i, tt := range tests {
+		ch, err := h.subscribe(ctx, tt.req)
+		require.NoError(t, err)
+		subs[i] = ch
+	}
+
+	for _, p := range changes {
+		h.dispatch(p)
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []uint64
+			for _, p := range drain(subs[i]) {
+				got = append(got, p.Sequence)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_hub_unsubscribe(t *testing.T) {
+	h := newHub(discardLogger, 10, OverflowPolicyDisconnect)
+
+	t.Run("cancelled subscriber is removed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch, err := h.subscribe(ctx, types.SubscriptionRequest{UserIds: []uuid.UUID{uuid.New(), uuid.New()}})
+		require.NoError(t, err)
+
+		cancel()
+
+		require.Eventually(t, func() bool {
+			_, ok := <-ch
+			return !ok
+		}, time.Second, 10*time.Millisecond, "channel not closed")
+		require.Empty(t, h.subscribers)
+	})
+
+	t.Run("lagging subscriber is cut off", func(t *testing.T) {
+		lagging := newHub(discardLogger, 1, OverflowPolicyDisconnect)
+
+		ch, err := lagging.subscribe(context.Background(), types.SubscriptionRequest{})
+		require.NoError(t, err)
+
+		lagging.dispatch(types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeCreated})
+		lagging.dispatch(types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeCreated})
+
+		require.Equal(t, []types.SubscriptionPayload{{Err: types.ErrSubscriberLagging}}, drain(ch))
+		require.Empty(t, lagging.subscribers)
+	})
+
+	t.Run("closed hub closes subscribers and rejects new ones", func(t *testing.T) {
+		ch, err := h.subscribe(context.Background(), types.SubscriptionRequest{})
+		require.NoError(t, err)
+
+		h.close()
+
+		_, ok := <-ch
+		require.False(t, ok, "channel not closed")
+
+		_, err = h.subscribe(context.Background(), types.SubscriptionRequest{})
+		require.ErrorIs(t, err, types.ErrUnknownError)
+	})
+}
+
+func Test_hubKeysFromSubRequest(t *testing.T) {
+	userId := uuid.New()
+
+	t.Run("duplicates are removed", func(t *testing.T) {
+		keys, err := hubKeysFromSubRequest(types.SubscriptionRequest{
+			UserIds: []uuid.UUID{userId, userId},
+			Changes: []types.UserChangeType{types.UserChangeTypeCreated},
+		})
+		require.NoError(t, err)
+		require.Equal(t, []hubKey{{change: types.UserChangeTypeCreated, userId: userId}}, keys)
+	})
+
+	t.Run("sad case nil userId", func(t *testing.T) {
+		_, err := hubKeysFromSubRequest(types.SubscriptionRequest{UserIds: []uuid.UUID{uuid.Nil}})
+		require.ErrorIs(t, err, types.ErrInvalidUserId)
+	})
+}
+
+// BenchmarkSubscriptions compares fanning out changes from one shared subscription with a jetstream consumer per subscriber
+// each subscriber watches a single user, every change is published for one of them
+// every run uses its own in-process nats server, so latencies are lower than over a real network
+func BenchmarkSubscriptions(b *testing.B) {
+	for _, shared := range []bool{true, false} {
+		for _, subscribers := range []int{10, 100, 1000} {
+			name := fmt.Sprintf("shared=%t/subscribers=%d", shared, subscribers)
+			b.Run(name, func(b *testing.B) {
+				client, err := NewNatsClient(
+					discardLogger,
+					runTestNatsServer(b),
+					WithSharedSubscription(shared),
+					WithSubscriptionBuffer(b.N, OverflowPolicyDisconnect),
+				)
+				require.NoError(b, err)
+				defer func() { _ = client.GracefulShutdown(context.Background()) }()
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				var (
+					users    = make([]uuid.UUID, subscribers)
+					received sync.WaitGroup
+				)
+				received.Add(b.N)
+
+				for i := range users {
+					users[i] = uuid.New()
+					ch, err := client.SubscribeToUserChanges(ctx, types.SubscriptionRequest{UserIds: []uuid.UUID{users[i]}})
+					require.NoError(b, err)
+
+					go func() {
+						for range ch {
+							received.Done()
+						}
+					}()
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err := client.PublishUserChange(types.SubscriptionPayload{UserId: users[i%subscribers], Change: types.UserChangeTypeUpdated})
+					require.NoError(b, err)
+				}
+				received.Wait()
+			})
+		}
+	}
+}
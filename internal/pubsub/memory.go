@@ -0,0 +1,64 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"log/slog"
+	"sync"
+)
+
+// memoryPubSub delivers changes to subscribers within the same process, with the same matching as nats subjects
+// changes are not stored, so replaying subscriptions are not supported
+type memoryPubSub struct {
+	// mu serializes publishing, which assigns sequences and dispatches to the hub
+	mu       sync.Mutex
+	sequence uint64
+	hub      *hub
+}
+
+// NewMemoryPubSub creates a pubsub service that does not need a nats server, e.g. for tests and local development
+// only WithSubscriptionBuffer applies, the other options are ignored
+func NewMemoryPubSub(logger *slog.Logger, options ...Option) internal.PubSubService {
+	settings := &NatsSettings{
+		subscriptionBuffer: 256,
+		overflowPolicy:     OverflowPolicyDisconnect,
+	}
+
+	for _, option := range options {
+		option(settings)
+	}
+
+	return &memoryPubSub{
+		hub: newHub(logger.With(slog.String("component", "memory-pubsub")), settings.subscriptionBuffer, settings.overflowPolicy),
+	}
+}
+
+func (mp *memoryPubSub) SubscribeToUserChanges(ctx context.Context, req types.SubscriptionRequest) (<-chan types.SubscriptionPayload, error) {
+	if req.StartSequence != 0 || req.StartTime != nil {
+		return nil, errors.Join(types.ErrInvalidSubscriptionStart, errors.New("changes are not stored in memory and can not be replayed"))
+	}
+
+	return mp.hub.subscribe(ctx, req)
+}
+
+func (mp *memoryPubSub) PublishUserChange(result types.SubscriptionPayload) error {
+	if _, ok := result.Proto(); !ok {
+		return errors.Join(types.ErrUnknownError, errors.New("could not convert result to protobuf"))
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.sequence++
+	result.Sequence = mp.sequence
+	mp.hub.dispatch(result)
+
+	return nil
+}
+
+func (mp *memoryPubSub) GracefulShutdown(_ context.Context) error {
+	mp.hub.close()
+	return nil
+}
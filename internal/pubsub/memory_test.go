@@ -0,0 +1,44 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMemoryPubSub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ps := NewMemoryPubSub(discardLogger)
+	defer func() { _ = ps.GracefulShutdown(context.Background()) }()
+
+	userId := uuid.New()
+	ch, err := ps.SubscribeToUserChanges(ctx, types.SubscriptionRequest{UserIds: []uuid.UUID{userId}, Changes: []types.UserChangeType{types.UserChangeTypeUpdated}})
+	require.NoError(t, err)
+
+	require.NoError(t, ps.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeCreated}))
+	require.NoError(t, ps.PublishUserChange(types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeUpdated}))
+	require.NoError(t, ps.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeUpdated}))
+
+	got := drain(ch)
+	require.Len(t, got, 1)
+	require.Equal(t, userId, got[0].UserId)
+	require.Equal(t, uint64(3), got[0].Sequence, "sequence should count all published changes")
+
+	t.Run("sad case invalid payload", func(t *testing.T) {
+		require.ErrorIs(t, ps.PublishUserChange(types.SubscriptionPayload{Change: types.UserChangeTypeCreated}), types.ErrUnknownError)
+	})
+
+	t.Run("sad case nil userId", func(t *testing.T) {
+		_, err := ps.SubscribeToUserChanges(ctx, types.SubscriptionRequest{UserIds: []uuid.UUID{uuid.Nil}})
+		require.ErrorIs(t, err, types.ErrInvalidUserId)
+	})
+
+	t.Run("sad case replay", func(t *testing.T) {
+		_, err := ps.SubscribeToUserChanges(ctx, types.SubscriptionRequest{StartSequence: 1})
+		require.ErrorIs(t, err, types.ErrInvalidSubscriptionStart)
+	})
+}
@@ -4,81 +4,367 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/captainlettuce/users-microservice/generated"
 	"github.com/captainlettuce/users-microservice/internal"
 	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/captainlettuce/users-microservice/internal/wait"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
-	"google.golang.org/protobuf/proto"
+	"github.com/nats-io/nats.go/jetstream"
 	"log/slog"
+	"slices"
+	"time"
 )
 
 var usersTopic = "users"
 
+const publishTimeout = 5 * time.Second
+
+type NatsSettings struct {
+	stream       string
+	streamMaxAge time.Duration
+
+	subscriptionBuffer int
+	overflowPolicy     OverflowPolicy
+	sharedSubscription bool
+
+	eventFormat EventFormat
+	eventSource string
+
+	publishQueueSize   int
+	publishBatchSize   int
+	publishMaxAttempts int
+
+	connectTimeout   time.Duration
+	maxReconnects    int
+	reconnectWait    time.Duration
+	reconnectBufSize int
+	statusHandler    func(connected bool)
+
+	auth natsAuth
+	// tls is nil unless the connection has to use tls
+	tls *natsTLS
+
+	connectOptions []nats.Option
+}
+
+type Option func(*NatsSettings)
+
+// WithStream sets the name of the jetstream stream user changes are stored in, and how long changes are kept for replay
+func WithStream(name string, maxAge time.Duration) Option {
+	return func(settings *NatsSettings) {
+		settings.stream = name
+		settings.streamMaxAge = maxAge
+	}
+}
+
+// WithSubscriptionBuffer sets how many changes are buffered per subscriber, and what to do when a lagging subscriber fills it
+func WithSubscriptionBuffer(size int, policy OverflowPolicy) Option {
+	return func(settings *NatsSettings) {
+		settings.subscriptionBuffer = size
+		settings.overflowPolicy = policy
+	}
+}
+
+// WithSharedSubscription toggles fanning out new changes to all subscribers from one shared nats subscription (the default),
+// when disabled each subscriber gets its own jetstream consumer. Replaying subscribers always get their own consumer
+func WithSharedSubscription(enabled bool) Option {
+	return func(settings *NatsSettings) {
+		settings.sharedSubscription = enabled
+	}
+}
+
+// WithConnectTimeout sets how long to wait for the initial connection before failing
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(settings *NatsSettings) {
+		settings.connectTimeout = timeout
+	}
+}
+
+// WithReconnect sets how many times, and how often, to try reconnecting after losing the connection, -1 retries forever
+// bufferSize is how many bytes of publishes are buffered while reconnecting before publishing fails
+func WithReconnect(maxReconnects int, wait time.Duration, bufferSize int) Option {
+	return func(settings *NatsSettings) {
+		settings.maxReconnects = maxReconnects
+		settings.reconnectWait = wait
+		settings.reconnectBufSize = bufferSize
+	}
+}
+
+// WithStatusHandler is called with false when the connection is lost or closed and with true when it is re-established
+func WithStatusHandler(handler func(connected bool)) Option {
+	return func(settings *NatsSettings) {
+		settings.statusHandler = handler
+	}
+}
+
+// WithInProcessServer connects to an embedded nats server directly instead of over the network
+func WithInProcessServer(en *EmbeddedNats) Option {
+	return func(settings *NatsSettings) {
+		settings.connectOptions = append(settings.connectOptions, nats.InProcessServer(en.server))
+	}
+}
+
 type natsClient struct {
 	logger *slog.Logger
 	client *nats.Conn
+	js     jetstream.JetStream
+	stream string
+
+	eventFormat EventFormat
+	eventSource string
+
+	// publisher is nil if changes are published synchronously
+	publisher *asyncPublisher
+
+	subscriptionBuffer int
+	overflowPolicy     OverflowPolicy
+
+	// hub is nil if subscriptions are not shared
+	hub       *hub
+	hubCancel context.CancelFunc
+	hubDone   chan struct{}
 }
 
-func NewNatsClient(logger *slog.Logger, uri string) (internal.PubSubService, error) {
-	nc, err := nats.Connect(uri)
+func NewNatsClient(logger *slog.Logger, uri string, options ...Option) (internal.PubSubService, error) {
+	settings := &NatsSettings{
+		stream:       "USERS",
+		streamMaxAge: 7 * 24 * time.Hour,
+
+		subscriptionBuffer: 256,
+		overflowPolicy:     OverflowPolicyDisconnect,
+		sharedSubscription: true,
+
+		eventFormat: EventFormatProtobuf,
+		eventSource: "users-microservice",
+
+		publishQueueSize:   1024,
+		publishBatchSize:   64,
+		publishMaxAttempts: 5,
+
+		connectTimeout:   nats.DefaultTimeout,
+		maxReconnects:    nats.DefaultMaxReconnect,
+		reconnectWait:    nats.DefaultReconnectWait,
+		reconnectBufSize: nats.DefaultReconnectBufSize,
+		statusHandler:    func(bool) {},
+	}
+
+	for _, option := range options {
+		option(settings)
+	}
+
+	logger = logger.With(slog.String("component", "nats"))
+
+	connectOptions := append(
+		settings.connectOptions,
+		nats.ErrorHandler(asyncErrorHandler(logger)),
+		nats.Timeout(settings.connectTimeout),
+		nats.MaxReconnects(settings.maxReconnects),
+		nats.ReconnectWait(settings.reconnectWait),
+		nats.ReconnectBufSize(settings.reconnectBufSize),
+	)
+	connectOptions = append(connectOptions, connectionHandlers(logger, settings.statusHandler)...)
+
+	authOptions, err := settings.auth.options()
+	if err != nil {
+		return nil, err
+	}
+	connectOptions = append(connectOptions, authOptions...)
+
+	if settings.tls != nil {
+		tlsConfig, err := settings.tls.config()
+		if err != nil {
+			return nil, err
+		}
+		connectOptions = append(connectOptions, nats.Secure(tlsConfig))
+	}
+
+	nc, err := nats.Connect(uri, connectOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to nats within %s: %w", settings.connectTimeout, err)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("could not create jetstream context: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     settings.stream,
+		Subjects: []string{usersTopic + ".>"},
+		MaxAge:   settings.streamMaxAge,
+		Storage:  jetstream.FileStorage,
+	})
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("could not create jetstream stream: %w", err)
+	}
+
+	client := &natsClient{
+		logger: logger,
+		client: nc,
+		js:     js,
+		stream: settings.stream,
+
+		eventFormat: settings.eventFormat,
+		eventSource: settings.eventSource,
+
+		subscriptionBuffer: settings.subscriptionBuffer,
+		overflowPolicy:     settings.overflowPolicy,
+	}
+
+	if settings.sharedSubscription {
+		if err := client.startHub(); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("could not start shared subscription: %w", err)
+		}
+	}
+
+	if settings.publishQueueSize > 0 {
+		client.publisher = newAsyncPublisher(logger, js, settings.publishQueueSize, settings.publishBatchSize, settings.publishMaxAttempts)
+	}
+
+	return client, nil
+}
+
+// NatsConn returns the nats connection of ps, false if ps does not use nats
+func NatsConn(ps internal.PubSubService) (*nats.Conn, bool) {
+	nc, ok := ps.(*natsClient)
+	if !ok {
+		return nil, false
+	}
+	return nc.client, true
+}
+
+// startHub creates the shared subscription for new changes and dispatches them to the hub until GracefulShutdown
+func (nc *natsClient) startHub() error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	msgs, err := nc.messages(ctx, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{usersTopic + ".>"},
+		DeliverPolicy:  jetstream.DeliverNewPolicy,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to nats: %w", err)
+		cancel()
+		return err
 	}
 
-	return &natsClient{
-			logger: logger.With(slog.String("component", "nats")),
-			client: nc,
-		},
-		nil
+	nc.hub = newHub(nc.logger, nc.subscriptionBuffer, nc.overflowPolicy)
+	nc.hubCancel = cancel
+	nc.hubDone = make(chan struct{})
+
+	go func() {
+		defer close(nc.hubDone)
+		defer nc.hub.close()
+
+		nc.consume(ctx, msgs, func(p types.SubscriptionPayload) bool {
+			nc.hub.dispatch(p)
+			return true
+		})
+
+		if ctx.Err() == nil {
+			nc.logger.Error("Shared subscription ended unexpectedly, closing all subscribers")
+		}
+	}()
+
+	return nil
 }
 
 func (nc *natsClient) SubscribeToUserChanges(ctx context.Context, req types.SubscriptionRequest) (<-chan types.SubscriptionPayload, error) {
 
-	var ch = make(chan types.SubscriptionPayload)
+	cfg, err := consumerConfigFromSubRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if nc.hub != nil && cfg.DeliverPolicy == jetstream.DeliverNewPolicy {
+		return nc.hub.subscribe(ctx, req)
+	}
 
-	topic, err := natsTopicFromSubRequest(req)
+	msgs, err := nc.messages(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	sub, err := nc.client.SubscribeSync(topic)
+	buf := newSubscriptionBuffer(nc.subscriptionBuffer, nc.overflowPolicy)
+
+	go func() {
+		defer buf.close()
+
+		nc.consume(ctx, msgs, func(p types.SubscriptionPayload) bool {
+			return deliver(ctx, nc.logger, buf, p)
+		})
+	}()
+
+	return buf.ch, nil
+}
+
+// messages creates an ordered consumer and starts iterating its messages until ctx is cancelled
+func (nc *natsClient) messages(ctx context.Context, cfg jetstream.OrderedConsumerConfig) (jetstream.MessagesContext, error) {
+	consumer, err := nc.js.OrderedConsumer(ctx, nc.stream, cfg)
 	if err != nil {
 		return nil, errors.Join(types.ErrUnknownError, err)
 	}
 
-	go func() {
-		defer close(ch)
+	msgs, err := consumer.Messages()
+	if err != nil {
+		return nil, errors.Join(types.ErrUnknownError, err)
+	}
 
-		for {
-			msg, err := sub.NextMsgWithContext(ctx)
-			if err != nil {
-				slog.With(slog.Any("error", err)).WarnContext(ctx, "Got unexpected error fetching message")
-			}
-			if ctx.Err() != nil {
-				return
-			}
-			if msg == nil {
-				continue
-			}
+	// Next does not take a context, stopping the iterator unblocks it
+	context.AfterFunc(ctx, msgs.Stop)
 
-			resp := &generated.SubscriptionResponse{}
-			if err := proto.Unmarshal(msg.Data, resp); err != nil {
-				slog.With(slog.Any("error", err)).WarnContext(ctx, "Got unexpected error unmarshalling message to protobuf")
-				continue
-			}
+	return msgs, nil
+}
 
-			res, err := types.SubscriptionPayloadFromProto(resp)
-			if err != nil {
-				slog.With(slog.Any("error", err)).WarnContext(ctx, "Got unexpected error converting from protobuf")
-				continue
+// consume passes changes from msgs to handle until ctx is cancelled, msgs is stopped or handle returns false
+func (nc *natsClient) consume(ctx context.Context, msgs jetstream.MessagesContext, handle func(types.SubscriptionPayload) bool) {
+	defer msgs.Stop()
+
+	for attempt := 0; ; {
+		msg, err := msgs.Next()
+		if ctx.Err() != nil || errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+			return
+		}
+		if err != nil {
+			attempt++
+			nc.logger.With(slog.Any("error", err), slog.Int("attempt", attempt)).WarnContext(ctx, "Got unexpected error fetching message")
+			if !wait.Sleep(ctx, retryBackoff(attempt)) {
+				return
 			}
+			continue
+		}
+		attempt = 0
 
-			ch <- res
+		res, err := payloadFromMsg(msg)
+		if err != nil {
+			nc.logger.With(slog.Any("error", err)).WarnContext(ctx, "Got unexpected error converting message")
+			continue
 		}
-	}()
 
-	return ch, nil
+		if !handle(res) {
+			return
+		}
+	}
+}
+
+// deliver pushes p to a subscriber buffer, returns false if the subscriber was cut off for lagging
+func deliver(ctx context.Context, logger *slog.Logger, buf *subscriptionBuffer, p types.SubscriptionPayload) bool {
+	droppedBefore := buf.dropped.Load()
+	if !buf.push(p) {
+		logger.With(slog.Uint64("sequence", p.Sequence)).WarnContext(ctx, "Disconnecting lagging subscriber")
+		return false
+	}
+
+	// log the first drop and then once per buffer-length of drops to not flood the logs
+	if dropped := buf.dropped.Load(); dropped != droppedBefore && (dropped-1)%uint64(cap(buf.ch)) == 0 {
+		logger.With(slog.Uint64("dropped", dropped)).WarnContext(ctx, "Dropping changes for lagging subscriber")
+	}
+
+	return true
 }
 
 func (nc *natsClient) PublishUserChange(result types.SubscriptionPayload) error {
@@ -87,40 +373,187 @@ func (nc *natsClient) PublishUserChange(result types.SubscriptionPayload) error
 		return errors.Join(types.ErrUnknownError, errors.New("could not convert result to protobuf"))
 	}
 
-	b, err := proto.Marshal(pb)
+	msg, err := encodeEvent(nc.eventFormat, nc.eventSource, result, pb)
 	if err != nil {
 		return errors.Join(types.ErrUnknownError, err)
 	}
+	msg.Subject = natsTopicFromSubResult(result)
 
-	err = nc.client.Publish(natsTopicFromSubResult(result), b)
+	if nc.publisher != nil {
+		return nc.publisher.publish(msg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	_, err = nc.js.PublishMsg(ctx, msg)
 	if err != nil {
 		return errors.Join(types.ErrUnknownError, err)
 	}
 	return nil
 }
 
-func (nc *natsClient) GracefulShutdown(_ context.Context) error {
+func (nc *natsClient) GracefulShutdown(ctx context.Context) error {
+	var errs []error
+
+	if nc.publisher != nil {
+		errs = append(errs, nc.publisher.shutdown(ctx))
+	}
+
+	if nc.hub != nil {
+		nc.hubCancel()
+		nc.hub.close()
+
+		// give the shared subscription a moment to stop, it may be stuck recreating its consumer if nats is unreachable
+		select {
+		case <-nc.hubDone:
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	// send anything still buffered in the connection before closing it, while reconnecting there is nothing to flush to
+	if nc.client.IsConnected() {
+		flushCtx, cancel := ctx, context.CancelFunc(func() {})
+		if _, ok := ctx.Deadline(); !ok {
+			flushCtx, cancel = context.WithTimeout(ctx, publishTimeout)
+		}
+		defer cancel()
+
+		if err := nc.client.FlushWithContext(flushCtx); err != nil {
+			errs = append(errs, fmt.Errorf("could not flush nats connection: %w", err))
+		}
+	}
+
 	nc.client.Close()
-	return nil
+	return errors.Join(errs...)
+}
+
+// payloadFromMsg converts a stored change in any event format to a payload carrying its stream sequence
+func payloadFromMsg(msg jetstream.Msg) (types.SubscriptionPayload, error) {
+	resp, err := decodeEvent(msg.Headers(), msg.Data())
+	if err != nil {
+		return types.SubscriptionPayload{}, err
+	}
+
+	res, err := types.SubscriptionPayloadFromProto(resp)
+	if err != nil {
+		return types.SubscriptionPayload{}, fmt.Errorf("failed to convert from protobuf: %w", err)
+	}
+
+	meta, err := msg.Metadata()
+	if err != nil {
+		return types.SubscriptionPayload{}, fmt.Errorf("failed to read message metadata: %w", err)
+	}
+	res.Sequence = meta.Sequence.Stream
+
+	return res, nil
+}
+
+// asyncErrorHandler logs errors nats can not return to a caller, most notably slow consumers
+// where messages are dropped because the subscription could not keep up
+func asyncErrorHandler(logger *slog.Logger) nats.ErrHandler {
+	return func(_ *nats.Conn, sub *nats.Subscription, err error) {
+		l := logger.With(slog.Any("error", err))
+		if sub != nil {
+			l = l.With(slog.String("subject", sub.Subject))
+		}
+
+		if errors.Is(err, nats.ErrSlowConsumer) {
+			l.Warn("Slow nats consumer detected, messages dropped")
+			return
+		}
+
+		l.Warn("Got asynchronous nats error")
+	}
+}
+
+// connectionHandlers logs changes to the connection state and reports them to statusHandler
+func connectionHandlers(logger *slog.Logger, statusHandler func(connected bool)) []nats.Option {
+	return []nats.Option{
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.With(slog.Any("error", err)).Warn("Disconnected from nats, reconnecting")
+			statusHandler(false)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			logger.With(slog.String("url", conn.ConnectedUrlRedacted())).Info("Reconnected to nats")
+			statusHandler(true)
+		}),
+		nats.ClosedHandler(func(conn *nats.Conn) {
+			logger.With(slog.Any("error", conn.LastError())).Warn("Nats connection closed")
+			statusHandler(false)
+		}),
+	}
+}
+
+// retryBackoff is the time to wait before the nth consecutive retry, capped at 5 seconds
+func retryBackoff(attempt int) time.Duration {
+	return min(time.Duration(attempt)*100*time.Millisecond, 5*time.Second)
+}
+
+// consumerConfigFromSubRequest creates the config for an ordered consumer delivering the changes matching req
+// from the requested start point, or only new changes if no start point is given
+func consumerConfigFromSubRequest(req types.SubscriptionRequest) (jetstream.OrderedConsumerConfig, error) {
+	topics, err := natsTopicsFromSubRequest(req)
+	if err != nil {
+		return jetstream.OrderedConsumerConfig{}, err
+	}
+
+	cfg := jetstream.OrderedConsumerConfig{
+		FilterSubjects: topics,
+		DeliverPolicy:  jetstream.DeliverNewPolicy,
+	}
+
+	switch {
+	case req.StartSequence != 0 && req.StartTime != nil:
+		return jetstream.OrderedConsumerConfig{}, errors.Join(types.ErrInvalidSubscriptionStart, errors.New("only one of start sequence and start time can be set"))
+	case req.StartSequence != 0:
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = req.StartSequence
+	case req.StartTime != nil:
+		cfg.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+		cfg.OptStartTime = req.StartTime
+	}
+
+	return cfg, nil
 }
 
-func natsTopicFromSubRequest(req types.SubscriptionRequest) (string, error) {
+// natsTopicsFromSubRequest creates one subject per combination of requested change type and user id
+// the subjects never overlap, which jetstream requires for consumer filter subjects
+func natsTopicsFromSubRequest(req types.SubscriptionRequest) ([]string, error) {
 	var (
-		err         error
-		changeField = "*"
-		userIdField = "*"
+		changeFields = []string{"*"}
+		userIdFields = []string{"*"}
 	)
-	if req.Change != nil {
-		changeField = string(*req.Change)
+	if len(req.UserIds) > types.MaxSubscriptionUserIds {
+		return nil, types.ErrLimitExceeded
 	}
-	if req.UserId != nil {
-		if *req.UserId == uuid.Nil {
-			return "", types.ErrInvalidUserId
+	if len(req.Changes) > 0 {
+		changeFields = changeFields[:0]
+		for _, change := range req.Changes {
+			changeFields = append(changeFields, string(change))
 		}
-		userIdField = req.UserId.String()
 	}
+	if len(req.UserIds) > 0 {
+		userIdFields = userIdFields[:0]
+		for _, userId := range req.UserIds {
+			if userId == uuid.Nil {
+				return nil, types.ErrInvalidUserId
+			}
+			userIdFields = append(userIdFields, userId.String())
+		}
+	}
+
+	topics := make([]string, 0, len(changeFields)*len(userIdFields))
+	for _, changeField := range changeFields {
+		for _, userIdField := range userIdFields {
+			topics = append(topics, fmt.Sprintf("%s.%s.%s", usersTopic, changeField, userIdField))
+		}
+	}
+
+	slices.Sort(topics)
 
-	return fmt.Sprintf("%s.%s.%s", usersTopic, changeField, userIdField), err
+	return slices.Compact(topics), nil
 }
 
 func natsTopicFromSubResult(resp types.SubscriptionPayload) string {
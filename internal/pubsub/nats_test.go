@@ -1,54 +1,293 @@
 package pubsub
 
 import (
+	"context"
 	"fmt"
 	"github.com/captainlettuce/users-microservice/internal/types"
 	"github.com/google/uuid"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+	"net"
 	"testing"
+	"time"
 )
 
-func Test_natsTopicFromSubRequest(t *testing.T) {
-	staticId := uuid.New()
-	nilUuid := uuid.Nil
-	changeType := types.UserChangeTypeCreated
+func Test_natsTopicsFromSubRequest(t *testing.T) {
+	staticId := uuid.MustParse("2b3f3c4e-2d2a-4b8e-9a59-0d1f0a2f0c01")
+	otherId := uuid.MustParse("7c1d5f6a-8e9b-4c3d-a2e1-f0b9c8d7e6a5")
+	tooManyIds := make([]uuid.UUID, types.MaxSubscriptionUserIds+1)
+	for i := range tooManyIds {
+		tooManyIds[i] = uuid.New()
+	}
 	tests := []struct {
 		name    string
 		req     types.SubscriptionRequest
-		want    string
-		wantErr bool
+		want    []string
+		wantErr error
 	}{
 		{
 			name: "happy case all wildcard",
 			req:  types.SubscriptionRequest{},
-			want: usersTopic + ".*.*",
+			want: []string{usersTopic + ".*.*"},
 		},
 		{
 			name: "happy case userId specced",
-			req:  types.SubscriptionRequest{UserId: &staticId},
-			want: fmt.Sprintf("%s.*.%s", usersTopic, staticId.String()),
+			req:  types.SubscriptionRequest{UserIds: []uuid.UUID{staticId}},
+			want: []string{fmt.Sprintf("%s.*.%s", usersTopic, staticId.String())},
 		},
 		{
 			name: "happy case changeType specced",
-			req:  types.SubscriptionRequest{Change: &changeType},
-			want: fmt.Sprintf("%s.%s.*", usersTopic, types.UserChangeTypeCreated),
+			req:  types.SubscriptionRequest{Changes: []types.UserChangeType{types.UserChangeTypeCreated}},
+			want: []string{fmt.Sprintf("%s.%s.*", usersTopic, types.UserChangeTypeCreated)},
+		},
+		{
+			name: "happy case multiple userIds and changeTypes",
+			req: types.SubscriptionRequest{
+				UserIds: []uuid.UUID{staticId, otherId},
+				Changes: []types.UserChangeType{types.UserChangeTypeUpdated, types.UserChangeTypeCreated},
+			},
+			want: []string{
+				fmt.Sprintf("%s.%s.%s", usersTopic, types.UserChangeTypeCreated, staticId.String()),
+				fmt.Sprintf("%s.%s.%s", usersTopic, types.UserChangeTypeCreated, otherId.String()),
+				fmt.Sprintf("%s.%s.%s", usersTopic, types.UserChangeTypeUpdated, staticId.String()),
+				fmt.Sprintf("%s.%s.%s", usersTopic, types.UserChangeTypeUpdated, otherId.String()),
+			},
+		},
+		{
+			name: "happy case duplicates are removed",
+			req:  types.SubscriptionRequest{UserIds: []uuid.UUID{staticId, staticId}},
+			want: []string{fmt.Sprintf("%s.*.%s", usersTopic, staticId.String())},
 		},
 		{
 			name:    "sad case nil userId",
-			req:     types.SubscriptionRequest{UserId: &nilUuid},
-			wantErr: true,
+			req:     types.SubscriptionRequest{UserIds: []uuid.UUID{staticId, uuid.Nil}},
+			wantErr: types.ErrInvalidUserId,
+		},
+		{
+			name:    "sad case too many userIds",
+			req:     types.SubscriptionRequest{UserIds: tooManyIds},
+			wantErr: types.ErrLimitExceeded,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := natsTopicFromSubRequest(tt.req)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("natsTopicFromSubRequest() error = %v, wantErr %v", err, tt.wantErr)
+			got, err := natsTopicsFromSubRequest(tt.req)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
 				return
 			}
-			if got != tt.want {
-				t.Errorf("natsTopicFromSubRequest() got = %v, want %v", got, tt.want)
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_consumerConfigFromSubRequest(t *testing.T) {
+	startTime := time.Now()
+	tests := []struct {
+		name    string
+		req     types.SubscriptionRequest
+		want    jetstream.OrderedConsumerConfig
+		wantErr error
+	}{
+		{
+			name: "happy case only new changes by default",
+			req:  types.SubscriptionRequest{},
+			want: jetstream.OrderedConsumerConfig{
+				FilterSubjects: []string{usersTopic + ".*.*"},
+				DeliverPolicy:  jetstream.DeliverNewPolicy,
+			},
+		},
+		{
+			name: "happy case start at sequence",
+			req:  types.SubscriptionRequest{StartSequence: 42},
+			want: jetstream.OrderedConsumerConfig{
+				FilterSubjects: []string{usersTopic + ".*.*"},
+				DeliverPolicy:  jetstream.DeliverByStartSequencePolicy,
+				OptStartSeq:    42,
+			},
+		},
+		{
+			name: "happy case start at time",
+			req:  types.SubscriptionRequest{StartTime: &startTime},
+			want: jetstream.OrderedConsumerConfig{
+				FilterSubjects: []string{usersTopic + ".*.*"},
+				DeliverPolicy:  jetstream.DeliverByStartTimePolicy,
+				OptStartTime:   &startTime,
+			},
+		},
+		{
+			name:    "sad case both sequence and time",
+			req:     types.SubscriptionRequest{StartSequence: 42, StartTime: &startTime},
+			wantErr: types.ErrInvalidSubscriptionStart,
+		},
+		{
+			name:    "sad case nil userId",
+			req:     types.SubscriptionRequest{UserIds: []uuid.UUID{uuid.Nil}},
+			wantErr: types.ErrInvalidUserId,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := consumerConfigFromSubRequest(tt.req)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
 			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
 		})
 	}
 }
+
+// runTestNatsServer starts an in-process nats server with jetstream enabled for the duration of the test
+// configure can change its options before it starts
+func runTestNatsServer(tb testing.TB, configure ...func(*server.Options)) string {
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  tb.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	}
+	for _, c := range configure {
+		c(opts)
+	}
+
+	ns, err := server.NewServer(opts)
+	require.NoError(tb, err)
+
+	go ns.Start()
+	require.True(tb, ns.ReadyForConnections(5*time.Second), "nats server not ready")
+	tb.Cleanup(ns.Shutdown)
+
+	return ns.ClientURL()
+}
+
+func TestNatsClient_SubscribeToUserChanges(t *testing.T) {
+	for _, shared := range []bool{true, false} {
+		t.Run(fmt.Sprintf("shared=%t", shared), func(t *testing.T) {
+			client, err := NewNatsClient(discardLogger, runTestNatsServer(t), WithSharedSubscription(shared))
+			require.NoError(t, err)
+			defer func() { _ = client.GracefulShutdown(context.Background()) }()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			userId := uuid.New()
+			ch, err := client.SubscribeToUserChanges(ctx, types.SubscriptionRequest{UserIds: []uuid.UUID{userId}})
+			require.NoError(t, err)
+
+			require.NoError(t, client.PublishUserChange(types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeCreated}))
+			require.NoError(t, client.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeCreated}))
+			require.NoError(t, client.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeUpdated}))
+
+			first, second := receive(t, ch), receive(t, ch)
+			require.Equal(t, types.UserChangeTypeCreated, first.Change)
+			require.Equal(t, types.UserChangeTypeUpdated, second.Change)
+			require.Equal(t, first.Sequence+1, second.Sequence, "sequence not set on payload")
+
+			t.Run("replay from sequence", func(t *testing.T) {
+				replay, err := client.SubscribeToUserChanges(ctx, types.SubscriptionRequest{UserIds: []uuid.UUID{userId}, StartSequence: second.Sequence})
+				require.NoError(t, err)
+
+				require.Equal(t, second.Sequence, receive(t, replay).Sequence)
+			})
+
+			cancel()
+			require.Eventually(t, func() bool {
+				_, ok := <-ch
+				return !ok
+			}, time.Second, 10*time.Millisecond, "channel not closed after cancel")
+		})
+	}
+}
+
+func receive(t *testing.T, ch <-chan types.SubscriptionPayload) types.SubscriptionPayload {
+	t.Helper()
+
+	select {
+	case p, ok := <-ch:
+		require.True(t, ok, "channel closed")
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for change")
+		return types.SubscriptionPayload{}
+	}
+}
+
+func TestNewNatsClient_connectTimeout(t *testing.T) {
+	// a server that accepts connections but never speaks nats
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	start := time.Now()
+	_, err = NewNatsClient(discardLogger, "nats://"+listener.Addr().String(), WithConnectTimeout(200*time.Millisecond), WithReconnect(0, time.Millisecond, 0))
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 2*time.Second, "connecting should fail fast")
+}
+
+func TestNewNatsClient_statusHandler(t *testing.T) {
+	var (
+		storeDir = t.TempDir()
+		opts     = &server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, JetStream: true, StoreDir: storeDir, NoLog: true, NoSigs: true}
+		statuses = make(chan bool, 10)
+	)
+
+	ns, err := server.NewServer(opts)
+	require.NoError(t, err)
+	go ns.Start()
+	require.True(t, ns.ReadyForConnections(5*time.Second))
+
+	client, err := NewNatsClient(
+		discardLogger,
+		ns.ClientURL(),
+		WithReconnect(-1, 50*time.Millisecond, nats.DefaultReconnectBufSize),
+		WithStatusHandler(func(connected bool) { statuses <- connected }),
+	)
+	require.NoError(t, err)
+	defer func() { _ = client.GracefulShutdown(context.Background()) }()
+
+	// restart the server on the same port
+	opts.Port = ns.Addr().(*net.TCPAddr).Port
+	ns.Shutdown()
+	ns.WaitForShutdown()
+	require.False(t, receiveStatus(t, statuses), "expected disconnect")
+
+	ns, err = server.NewServer(opts)
+	require.NoError(t, err)
+	go ns.Start()
+	defer ns.Shutdown()
+
+	require.True(t, receiveStatus(t, statuses), "expected reconnect")
+}
+
+func receiveStatus(t *testing.T, statuses <-chan bool) bool {
+	t.Helper()
+
+	select {
+	case s := <-statuses:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection status")
+		return false
+	}
+}
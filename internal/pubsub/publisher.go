@@ -0,0 +1,217 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/captainlettuce/users-microservice/internal/wait"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// WithAsyncPublish queues published changes and publishes them in the background in batches of up to batchSize,
+// retrying each change up to maxAttempts times. Publishing fails right away when queueSize changes are queued
+// a queueSize of 0 publishes synchronously instead
+func WithAsyncPublish(queueSize, batchSize, maxAttempts int) Option {
+	return func(settings *NatsSettings) {
+		settings.publishQueueSize = queueSize
+		settings.publishBatchSize = batchSize
+		settings.publishMaxAttempts = maxAttempts
+	}
+}
+
+// asyncPublisher publishes changes to jetstream in the background so callers don't wait for acknowledgements
+// retries are deduplicated by jetstream through the message id, but may reorder changes that failed transiently
+type asyncPublisher struct {
+	logger      *slog.Logger
+	js          jetstream.JetStream
+	batchSize   int
+	maxAttempts int
+
+	// mu guards closing queue against concurrent publishes
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *nats.Msg
+
+	// abort is cancelled when shutdown runs out of time, remaining changes are then failed without further attempts
+	abort     context.Context
+	abortFunc context.CancelFunc
+	done      chan struct{}
+
+	failed atomic.Uint64
+}
+
+func newAsyncPublisher(logger *slog.Logger, js jetstream.JetStream, queueSize, batchSize, maxAttempts int) *asyncPublisher {
+	abort, abortFunc := context.WithCancel(context.Background())
+
+	ap := &asyncPublisher{
+		logger:      logger,
+		js:          js,
+		batchSize:   max(batchSize, 1),
+		maxAttempts: max(maxAttempts, 1),
+		queue:       make(chan *nats.Msg, queueSize),
+		abort:       abort,
+		abortFunc:   abortFunc,
+		done:        make(chan struct{}),
+	}
+
+	go ap.run()
+
+	return ap
+}
+
+// publish queues msg without waiting for it to be published
+func (ap *asyncPublisher) publish(msg *nats.Msg) error {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+
+	if ap.closed {
+		return errors.Join(types.ErrUnknownError, errors.New("publisher is shut down"))
+	}
+
+	select {
+	case ap.queue <- msg:
+		return nil
+	default:
+		return errors.Join(types.ErrUnknownError, errors.New("publish queue is full"))
+	}
+}
+
+// shutdown stops accepting changes and waits until the queued ones are published or ctx is done
+func (ap *asyncPublisher) shutdown(ctx context.Context) error {
+	ap.mu.Lock()
+	if !ap.closed {
+		ap.closed = true
+		close(ap.queue)
+	}
+	ap.mu.Unlock()
+
+	select {
+	case <-ap.done:
+	case <-ctx.Done():
+		ap.abortFunc()
+		<-ap.done
+	}
+
+	if failed := ap.failed.Load(); failed > 0 {
+		return fmt.Errorf("%d changes could not be published: %w", failed, types.ErrUnknownError)
+	}
+	return nil
+}
+
+func (ap *asyncPublisher) run() {
+	defer close(ap.done)
+	defer ap.abortFunc()
+
+	batch := make([]*nats.Msg, 0, ap.batchSize)
+	for msg := range ap.queue {
+		batch = append(batch[:0], msg)
+
+		// publish everything that is already queued together, up to the batch size
+	fill:
+		for len(batch) < ap.batchSize {
+			select {
+			case msg, ok := <-ap.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, msg)
+			default:
+				break fill
+			}
+		}
+
+		ap.publishBatch(batch)
+	}
+}
+
+// publishBatch publishes all messages without waiting for each acknowledgement and retries the ones that failed
+func (ap *asyncPublisher) publishBatch(batch []*nats.Msg) {
+	pending := batch
+	errs := make([]error, len(batch))
+
+	for attempt := 1; ; attempt++ {
+		if ap.abort.Err() != nil {
+			ap.fail(pending, errs, ap.abort.Err())
+			return
+		}
+
+		futures := make([]jetstream.PubAckFuture, len(pending))
+		for i, msg := range pending {
+			futures[i], errs[i] = ap.js.PublishMsgAsync(msg)
+		}
+
+		// futures are not resolved if the connection is lost, so acknowledgements are only awaited up to a deadline
+		ackCtx, cancel := context.WithTimeout(ap.abort, publishTimeout)
+
+		var (
+			failed     []*nats.Msg
+			failedErrs []error
+		)
+		for i, future := range futures {
+			err := errs[i]
+			if err == nil {
+				err = awaitAck(ackCtx, future)
+			}
+
+			if err != nil {
+				failed = append(failed, pending[i])
+				failedErrs = append(failedErrs, err)
+			}
+		}
+		cancel()
+
+		if len(failed) == 0 {
+			return
+		}
+
+		if attempt >= ap.maxAttempts || !wait.Sleep(ap.abort, retryBackoff(attempt)) {
+			ap.fail(failed, failedErrs, nil)
+			return
+		}
+
+		ap.logger.With(slog.Int("failed", len(failed)), slog.Int("attempt", attempt), slog.Any("error", failedErrs[0])).Warn("Retrying failed publishes")
+		pending, errs = failed, failedErrs
+	}
+}
+
+// awaitAck waits for jetstream to acknowledge a publish, an acknowledgement that already arrived wins over ctx
+func awaitAck(ctx context.Context, future jetstream.PubAckFuture) error {
+	select {
+	case <-future.Ok():
+		return nil
+	case err := <-future.Err():
+		return err
+	case <-ctx.Done():
+		select {
+		case <-future.Ok():
+			return nil
+		case err := <-future.Err():
+			return err
+		default:
+			return fmt.Errorf("no publish acknowledgement: %w", ctx.Err())
+		}
+	}
+}
+
+// fail records changes that could not be published, err overrides the individual errors if set
+func (ap *asyncPublisher) fail(msgs []*nats.Msg, errs []error, err error) {
+	ap.failed.Add(uint64(len(msgs)))
+
+	for i, msg := range msgs {
+		msgErr := err
+		if msgErr == nil {
+			msgErr = errs[i]
+		}
+
+		ap.logger.With(
+			slog.Any("error", msgErr),
+			slog.String("subject", msg.Subject),
+			slog.String("eventId", msg.Header.Get(jetstream.MsgIDHeader)),
+		).Error("Failed to publish user change")
+	}
+}
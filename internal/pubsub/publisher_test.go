@@ -0,0 +1,76 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestNatsClient_asyncPublish(t *testing.T) {
+	uri := runTestNatsServer(t)
+
+	client, err := NewNatsClient(discardLogger, uri, WithAsyncPublish(100, 10, 3), WithSharedSubscription(false))
+	require.NoError(t, err)
+
+	for range 50 {
+		require.NoError(t, client.PublishUserChange(types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeCreated}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, client.GracefulShutdown(ctx), "queued changes not published on shutdown")
+
+	t.Run("all queued changes are stored", func(t *testing.T) {
+		js := testJetStream(t, uri)
+
+		stream, err := js.Stream(ctx, "USERS")
+		require.NoError(t, err)
+		info, err := stream.Info(ctx)
+		require.NoError(t, err)
+		require.Equal(t, uint64(50), info.State.Msgs)
+	})
+
+	t.Run("publishing after shutdown fails", func(t *testing.T) {
+		require.Error(t, client.PublishUserChange(types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeCreated}))
+	})
+}
+
+func Test_asyncPublisher_queueFull(t *testing.T) {
+	// not started, so nothing is taken off the queue
+	ap := &asyncPublisher{queue: make(chan *nats.Msg, 1)}
+
+	require.NoError(t, ap.publish(&nats.Msg{Subject: "users.CREATED.1"}))
+	require.ErrorIs(t, ap.publish(&nats.Msg{Subject: "users.CREATED.2"}), types.ErrUnknownError)
+}
+
+func Test_asyncPublisher_failures(t *testing.T) {
+	// no stream is bound to the subject, so every publish is rejected
+	ap := newAsyncPublisher(discardLogger, testJetStream(t, runTestNatsServer(t)), 10, 10, 2)
+
+	require.NoError(t, ap.publish(&nats.Msg{Subject: "users.CREATED.1", Header: nats.Header{}}))
+	require.NoError(t, ap.publish(&nats.Msg{Subject: "users.CREATED.2", Header: nats.Header{}}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.ErrorIs(t, ap.shutdown(ctx), types.ErrUnknownError)
+	require.Equal(t, uint64(2), ap.failed.Load())
+}
+
+func testJetStream(t *testing.T, uri string) jetstream.JetStream {
+	t.Helper()
+
+	nc, err := nats.Connect(uri)
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+
+	return js
+}
@@ -0,0 +1,143 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/captainlettuce/users-microservice/internal/wait"
+	"github.com/nats-io/nats.go/jetstream"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// queueAckWait is how long a replica has to acknowledge a queued change before it is redelivered to another one
+// handlers taking longer keep extending it while they run
+const queueAckWait = 30 * time.Second
+
+// ConsumeQueue consumes a durable jetstream consumer, replicas consuming the same queue share its changes
+func (nc *natsClient) ConsumeQueue(ctx context.Context, name string, req types.SubscriptionRequest, start time.Time, handle func(p types.SubscriptionPayload, attempt int) time.Duration) error {
+	topics, err := natsTopicsFromSubRequest(req)
+	if err != nil {
+		return err
+	}
+
+	consumer, err := nc.js.CreateOrUpdateConsumer(ctx, nc.stream, jetstream.ConsumerConfig{
+		Durable:        name,
+		FilterSubjects: topics,
+		DeliverPolicy:  jetstream.DeliverByStartTimePolicy,
+		OptStartTime:   &start,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		AckWait:        queueAckWait,
+		// a single unacknowledged change at a time keeps the changes in order across replicas
+		MaxAckPending: 1,
+		MaxDeliver:    -1,
+	})
+	if err != nil {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+
+	msgs, err := consumer.Messages(jetstream.PullMaxMessages(1))
+	if err != nil {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+	context.AfterFunc(ctx, msgs.Stop)
+	defer msgs.Stop()
+
+	logger := nc.logger.With(slog.String("queue", name))
+	for attempt := 0; ; {
+		msg, err := msgs.Next()
+		if ctx.Err() != nil {
+			if msg != nil {
+				// let another replica have it right away
+				_ = msg.Nak()
+			}
+			return nil
+		}
+		switch {
+		case errors.Is(err, jetstream.ErrMsgIteratorClosed):
+			return errors.Join(types.ErrUnknownError, errors.New("queue consumer stopped"))
+		case errors.Is(err, jetstream.ErrConsumerDeleted), errors.Is(err, jetstream.ErrBadRequest):
+			return errors.Join(types.ErrUnknownError, err)
+		case err != nil:
+			attempt++
+			logger.With(slog.Any("error", err), slog.Int("attempt", attempt)).WarnContext(ctx, "Got unexpected error fetching queued message")
+			if !wait.Sleep(ctx, retryBackoff(attempt)) {
+				return nil
+			}
+			continue
+		}
+		attempt = 0
+
+		handleQueued(ctx, logger, msg, handle)
+	}
+}
+
+// handleQueued passes msg to handle and acknowledges it, or schedules its redelivery
+func handleQueued(ctx context.Context, logger *slog.Logger, msg jetstream.Msg, handle func(p types.SubscriptionPayload, attempt int) time.Duration) {
+	p, err := payloadFromMsg(msg)
+	if err != nil {
+		logger.With(slog.Any("error", err)).WarnContext(ctx, "Got unexpected error converting queued message, dropping it")
+		_ = msg.Term()
+		return
+	}
+	meta, _ := msg.Metadata()
+
+	// keep the change from being redelivered to another replica while it is handled
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(queueAckWait / 3)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				_ = msg.InProgress()
+			case <-done:
+				return
+			}
+		}
+	}()
+	retryAfter := handle(p, int(meta.NumDelivered))
+	close(done)
+
+	if retryAfter > 0 {
+		err = msg.NakWithDelay(retryAfter)
+	} else {
+		// wait for the ack to be confirmed, a lost ack would deliver the change again
+		ackCtx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		err = msg.DoubleAck(ackCtx)
+		cancel()
+	}
+	if err != nil {
+		logger.With(slog.Any("error", err), slog.Uint64("sequence", p.Sequence)).WarnContext(ctx, "Could not acknowledge queued message, it will be redelivered")
+	}
+}
+
+func (nc *natsClient) DeleteQueue(ctx context.Context, name string) error {
+	if err := nc.js.DeleteConsumer(ctx, nc.stream, name); err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+
+	return nil
+}
+
+func (nc *natsClient) ListQueues(ctx context.Context, prefix string) ([]string, error) {
+	stream, err := nc.js.Stream(ctx, nc.stream)
+	if err != nil {
+		return nil, errors.Join(types.ErrUnknownError, err)
+	}
+
+	var names []string
+	lister := stream.ConsumerNames(ctx)
+	for name := range lister.Name() {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	if err := lister.Err(); err != nil {
+		return nil, errors.Join(types.ErrUnknownError, err)
+	}
+
+	return names, nil
+}
@@ -0,0 +1,124 @@
+package pubsub
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNatsClient_ConsumeQueue(t *testing.T) {
+	url := runTestNatsServer(t)
+
+	newClient := func() *natsClient {
+		client, err := NewNatsClient(discardLogger, url)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = client.GracefulShutdown(context.Background()) })
+		return client.(*natsClient)
+	}
+	publisher, first, second := newClient(), newClient(), newClient()
+
+	type handled struct {
+		sequence uint64
+		attempt  int
+	}
+	var (
+		mu   sync.Mutex
+		got  []handled
+		fail = true
+	)
+	handle := func(p types.SubscriptionPayload, attempt int) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, handled{sequence: p.Sequence, attempt: attempt})
+
+		// fail the first change once, the changes after it have to wait for it
+		if fail {
+			fail = false
+			return 50 * time.Millisecond
+		}
+		return 0
+	}
+	handledSequences := func() []uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		var sequences []uint64
+		for _, h := range got {
+			sequences = append(sequences, h.sequence)
+		}
+		return sequences
+	}
+
+	start := time.Now()
+	userId := uuid.New()
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			require.NoError(t, publisher.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeUpdated}))
+		}
+		// not matching the queue
+		require.NoError(t, publisher.PublishUserChange(types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeUpdated}))
+	}
+	req := types.SubscriptionRequest{UserIds: []uuid.UUID{userId}}
+
+	// published before anyone consumes the queue
+	publish(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	for _, queues := range []internal.ChangeQueues{first, second} {
+		go func() { errs <- queues.ConsumeQueue(ctx, "test-queue", req, start, handle) }()
+	}
+
+	publish(2)
+
+	require.Eventually(t, func() bool { return len(handledSequences()) == 6 }, 5*time.Second, 10*time.Millisecond)
+
+	t.Run("changes are handled once and in order by all consumers", func(t *testing.T) {
+		sequences := handledSequences()
+		require.Equal(t, sequences[0], sequences[1], "failed change not retried first")
+		for i := 2; i < len(sequences); i++ {
+			require.Greater(t, sequences[i], sequences[i-1])
+		}
+	})
+
+	t.Run("retries are counted", func(t *testing.T) {
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, 1, got[0].attempt)
+		require.Equal(t, 2, got[1].attempt)
+		require.Equal(t, 1, got[2].attempt)
+	})
+
+	cancel()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	t.Run("consuming resumes after the last acknowledged change", func(t *testing.T) {
+		publish(1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() { _ = first.ConsumeQueue(ctx, "test-queue", req, start, handle) }()
+
+		require.Eventually(t, func() bool { return len(handledSequences()) == 7 }, 5*time.Second, 10*time.Millisecond)
+		sequences := handledSequences()
+		require.Greater(t, sequences[6], sequences[5])
+	})
+
+	t.Run("queues are listed and deleted", func(t *testing.T) {
+		names, err := first.ListQueues(context.Background(), "test-")
+		require.NoError(t, err)
+		require.Equal(t, []string{"test-queue"}, names)
+
+		require.NoError(t, first.DeleteQueue(context.Background(), "test-queue"))
+		require.NoError(t, first.DeleteQueue(context.Background(), "test-queue"), "deleting a missing queue")
+
+		names, err = first.ListQueues(context.Background(), "test-")
+		require.NoError(t, err)
+		require.Empty(t, names)
+	})
+}
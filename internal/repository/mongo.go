@@ -9,6 +9,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"log/slog"
 	"time"
 )
@@ -17,8 +18,20 @@ type mongoRepository struct {
 	collection *mongo.Collection
 }
 
-func NewMongoRepository(ctx context.Context, uri string, db string, collection string) (internal.UserRepository, error) {
+// NewMongoRepository stores users in collection, the client of the collection is disconnected on Shutdown
+func NewMongoRepository(ctx context.Context, collection *mongo.Collection) (internal.UserRepository, error) {
+	mr := &mongoRepository{collection: collection}
+	indexCtx, indexCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer indexCancel()
+
+	err := mr.setupIndices(indexCtx)
+
+	return mr, err
+}
 
+// ConnectMongo connects to the mongodb server and makes sure it is reachable
+// the client is shared by all stores so they use the same connection pool
+func ConnectMongo(ctx context.Context, uri string) (*mongo.Client, error) {
 	opts := []*options.ClientOptions{
 		options.Client().ApplyURI(uri),
 		options.Client().SetTimeout(5 * time.Second),
@@ -43,48 +56,135 @@ func NewMongoRepository(ctx context.Context, uri string, db string, collection s
 		return nil, err
 	}
 
-	c := client.Database(db).Collection(collection)
-
-	mr := &mongoRepository{collection: c}
-	indexCtx, indexCancel := context.WithTimeout(ctx, 5*time.Second)
-	defer indexCancel()
-
-	err = mr.setupIndices(indexCtx)
-
-	return mr, err
+	return client, nil
 }
 
 func (mr *mongoRepository) Shutdown(ctx context.Context) error {
 	return mr.collection.Database().Client().Disconnect(ctx)
 }
 
+// Ping checks that the primary is reachable since it is needed for writes
+func (mr *mongoRepository) Ping(ctx context.Context) error {
+	return mr.collection.Database().Client().Ping(ctx, readpref.Primary())
+}
+
 func (mr *mongoRepository) Add(ctx context.Context, user *types.User) error {
 	_, err := mr.collection.InsertOne(ctx, user)
 	if mongo.IsDuplicateKeyError(err) {
-		return types.ErrDuplicateUserId
+		return duplicateKeyError(err)
 	}
 	return err
 }
 
-func (mr *mongoRepository) UpdatePartial(ctx context.Context, filter types.UserFilter, fields types.UpdateUserFields) (types.User, error) {
-	var u types.User
+// duplicateKeyError returns ErrDuplicateEmail for duplicate key errors of an index on email, otherwise ErrDuplicateUserId
+func duplicateKeyError(err error) error {
+	// the server reports the key pattern of the violated index with the error
+	var raws []bson.Raw
+
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, we := range writeErr.WriteErrors {
+			if we.Code == 11000 { // DuplicateKey
+				raws = append(raws, we.Raw)
+			}
+		}
+	}
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 11000 { // DuplicateKey
+		raws = append(raws, cmdErr.Raw)
+	}
+
+	for _, raw := range raws {
+		if _, err := raw.LookupErr("keyPattern", "email"); err == nil {
+			return types.ErrDuplicateEmail
+		}
+	}
+	return types.ErrDuplicateUserId
+}
 
-	opts := []*options.FindOneAndUpdateOptions{options.FindOneAndUpdate().SetReturnDocument(options.After)}
+func (mr *mongoRepository) UpdatePartial(ctx context.Context, filter types.UserFilter, fields types.UpdateUserFields) (types.User, types.User, error) {
+	var before types.User
+
+	opts := []*options.FindOneAndUpdateOptions{options.FindOneAndUpdate().SetReturnDocument(options.Before)}
 
 	updateFields, err := createUpdateDocument(fields)
 	if err != nil {
-		return u, err
+		return before, before, err
 	}
 
+	now := mongoTime(time.Now())
+	updateFields = addChangeMetadata(updateFields, now)
+
 	res := mr.collection.FindOneAndUpdate(ctx, userFilterToMongoFilter(filter), updateFields, opts...)
-	if err := res.Decode(&u); err != nil {
+	if err := res.Decode(&before); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
-			return u, errors.Join(types.ErrNotFound, err)
+			return before, before, errors.Join(types.ErrNotFound, err)
 		}
-		return u, errors.Join(types.ErrUnknownError, err)
+		if mongo.IsDuplicateKeyError(err) {
+			return before, before, duplicateKeyError(err)
+		}
+		return before, before, errors.Join(types.ErrUnknownError, err)
 	}
 
-	return u, nil
+	// the update is deterministic so the after-image can be derived from the before-image
+	after := fields.Apply(before)
+	after.UpdatedAt = &now
+	after.Revision = before.Revision + 1
+
+	return before, after, nil
+}
+
+func (mr *mongoRepository) Upsert(ctx context.Context, user types.User, key types.UpsertKey) (*types.User, types.User, error) {
+	if key != types.UpsertKeyEmail {
+		return mr.upsert(ctx, bson.D{{Key: "_id", Value: user.Id}}, user)
+	}
+
+	filter := bson.D{{Key: "email", Value: user.Email}}
+
+	before, after, err := mr.upsert(ctx, filter, user)
+	if errors.Is(err, types.ErrDuplicateEmail) {
+		// a concurrent upsert inserted the email after this one found no user with it, retrying updates that user
+		return mr.upsert(ctx, filter, user)
+	}
+	return before, after, err
+}
+
+func (mr *mongoRepository) upsert(ctx context.Context, filter bson.D, user types.User) (*types.User, types.User, error) {
+	var before types.User
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+
+	res := mr.collection.FindOneAndUpdate(ctx, filter, createUpsertPipeline(user), opts)
+	if err := res.Decode(&before); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// no document before the upsert means it was inserted
+			after := user
+			after.CreatedAt = mongoTime(user.CreatedAt)
+			after.UpdatedAt = nil
+			after.Revision = 1
+			return nil, after, nil
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, user, duplicateKeyError(err)
+		}
+		return nil, user, errors.Join(types.ErrUnknownError, err)
+	}
+
+	after := types.UpdateUserFields{
+		FirstName: nonEmpty(user.FirstName),
+		LastName:  nonEmpty(user.LastName),
+		Nickname:  nonEmpty(user.Nickname),
+		Email:     nonEmpty(user.Email),
+		Password:  nonEmpty(user.Password),
+		Country:   nonEmpty(user.Country),
+	}.Apply(before)
+	if user.UpdatedAt != nil {
+		after.UpdatedAt = ref(mongoTime(*user.UpdatedAt))
+	}
+	after.Revision = before.Revision + 1
+
+	return &before, after, nil
 }
 
 func (mr *mongoRepository) Delete(ctx context.Context, userId uuid.UUID) error {
@@ -96,6 +196,19 @@ func (mr *mongoRepository) Delete(ctx context.Context, userId uuid.UUID) error {
 	return nil
 }
 
+func (mr *mongoRepository) DeleteMany(ctx context.Context, userIds []uuid.UUID) (uint64, error) {
+	if len(userIds) == 0 {
+		return 0, nil
+	}
+
+	res, err := mr.collection.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: userIds}}}})
+	if err != nil {
+		return 0, errors.Join(types.ErrUnknownError, err)
+	}
+
+	return uint64(res.DeletedCount), nil
+}
+
 func (mr *mongoRepository) List(ctx context.Context, filter types.UserFilter, paging types.Paging) ([]types.User, uint64, error) {
 	type listReturn struct {
 		Users []types.User `bson:"users"`
@@ -165,7 +278,7 @@ func userFilterToMongoFilter(filter types.UserFilter) bson.M {
 		if len(filter.Ids) == 1 {
 			ret["_id"] = filter.Ids[0]
 		} else {
-			ret["_id"] = bson.E{Key: "$in", Value: filter.Ids}
+			ret["_id"] = bson.D{{Key: "$in", Value: filter.Ids}}
 		}
 	}
 
@@ -194,25 +307,41 @@ func userFilterToMongoFilter(filter types.UserFilter) bson.M {
 	}
 
 	if !IsZero(filter.Created) {
-		ret["created_at"] = timeCriteriaToMongo(*filter.Created)
+		if tc := timeCriteriaToMongo(*filter.Created); tc != nil {
+			ret["created_at"] = tc
+		}
 	}
 
 	if !IsZero(filter.Updated) {
-		ret["updated_at"] = timeCriteriaToMongo(*filter.Updated)
+		if tc := timeCriteriaToMongo(*filter.Updated); tc != nil {
+			ret["updated_at"] = tc
+		}
 	}
 
 	return ret
 }
 
 // timeCriteriaToMongo takes a types.TimeFilter filter to create a mongodb chronological filter
-// the function handles both open and closed variants
+// the function handles both open and closed variants, with inclusive or exclusive bounds
+// as well as matching on whether the field is set at all
 func timeCriteriaToMongo(filter types.TimeFilter) bson.M {
 	var ret = make(bson.M)
 	if !IsZero(filter.Before) {
-		ret["$lt"] = filter.Before
+		if filter.BeforeInclusive {
+			ret["$lte"] = filter.Before
+		} else {
+			ret["$lt"] = filter.Before
+		}
 	}
 	if !IsZero(filter.After) {
-		ret["$gt"] = filter.After
+		if filter.AfterInclusive {
+			ret["$gte"] = filter.After
+		} else {
+			ret["$gt"] = filter.After
+		}
+	}
+	if filter.IsSet != nil {
+		ret["$exists"] = *filter.IsSet
 	}
 
 	if len(ret) == 0 {
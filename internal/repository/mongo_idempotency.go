@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// idempotencyLockTimeout is how long a reservation that never completed blocks retries
+// after which the request is assumed to have been abandoned, e.g. by a crashed replica
+const idempotencyLockTimeout = time.Minute
+
+type mongoIdempotencyStore struct {
+	collection *mongo.Collection
+	ttl        time.Duration
+}
+
+// NewMongoIdempotencyStore creates an idempotency store in collection where records are removed by mongodb after ttl
+func NewMongoIdempotencyStore(ctx context.Context, collection *mongo.Collection, ttl time.Duration) (internal.IdempotencyStore, error) {
+	ms := &mongoIdempotencyStore{
+		collection: collection,
+		ttl:        ttl,
+	}
+
+	indexCtx, indexCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer indexCancel()
+
+	err := ms.setupIndices(indexCtx)
+
+	return ms, err
+}
+
+func (ms *mongoIdempotencyStore) Reserve(ctx context.Context, key string, requestHash []byte) (types.IdempotencyRecord, bool, error) {
+	record := types.IdempotencyRecord{
+		Key:         key,
+		RequestHash: requestHash,
+		CreatedAt:   time.Now(),
+	}
+
+	_, err := ms.collection.InsertOne(ctx, record)
+	if err == nil {
+		return record, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return types.IdempotencyRecord{}, false, errors.Join(types.ErrUnknownError, err)
+	}
+
+	var existing types.IdempotencyRecord
+	if err := ms.collection.FindOne(ctx, bson.D{{Key: "_id", Value: key}}).Decode(&existing); err != nil {
+		return types.IdempotencyRecord{}, false, errors.Join(types.ErrUnknownError, err)
+	}
+
+	// take over reservations abandoned mid-request, the conditional update makes sure only one retry wins
+	if !existing.Completed && bytes.Equal(existing.RequestHash, requestHash) && time.Since(existing.CreatedAt) > idempotencyLockTimeout {
+		res, err := ms.collection.UpdateOne(
+			ctx,
+			bson.D{
+				{Key: "_id", Value: key},
+				{Key: "completed", Value: false},
+				{Key: "created_at", Value: existing.CreatedAt},
+			},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "created_at", Value: record.CreatedAt}}}},
+		)
+		if err != nil {
+			return types.IdempotencyRecord{}, false, errors.Join(types.ErrUnknownError, err)
+		}
+		if res.ModifiedCount == 1 {
+			return record, true, nil
+		}
+	}
+
+	return existing, false, nil
+}
+
+func (ms *mongoIdempotencyStore) Complete(ctx context.Context, key string, response []byte) error {
+	_, err := ms.collection.UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: key}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "response", Value: response},
+			{Key: "completed", Value: true},
+		}}},
+	)
+	if err != nil {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+
+	return nil
+}
+
+func (ms *mongoIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := ms.collection.DeleteOne(ctx, bson.D{{Key: "_id", Value: key}, {Key: "completed", Value: false}})
+	if err != nil {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+
+	return nil
+}
+
+// setupIndices creates the ttl-index used to expire records
+// the index is recreated if it exists with another ttl
+func (ms *mongoIdempotencyStore) setupIndices(ctx context.Context) error {
+	index := mongo.IndexModel{
+		Keys: bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().
+			SetName("idempotency_created_at_ttl").
+			SetExpireAfterSeconds(int32(ms.ttl.Seconds())),
+	}
+
+	return createIndexReplacingConflict(ctx, ms.collection, index)
+}
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMongoIdempotencyStore(t *testing.T) {
+	runTestWithMongoConnection(t, func(mr *mongoRepository) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		ms := &mongoIdempotencyStore{
+			collection: mr.collection.Database().Collection("idempotency_keys"),
+			ttl:        time.Hour,
+		}
+		require.NoError(t, ms.setupIndices(ctx), "could not setup indices")
+
+		key := uuid.New().String()
+		hash := []byte("hash")
+
+		t.Run("first reservation succeeds", func(t *testing.T) {
+			_, reserved, err := ms.Reserve(ctx, key, hash)
+			require.NoError(t, err)
+			require.True(t, reserved)
+		})
+
+		t.Run("second reservation returns the uncompleted record", func(t *testing.T) {
+			record, reserved, err := ms.Reserve(ctx, key, hash)
+			require.NoError(t, err)
+			require.False(t, reserved)
+			require.False(t, record.Completed)
+			require.Equal(t, hash, record.RequestHash)
+		})
+
+		t.Run("completed record is returned with response", func(t *testing.T) {
+			require.NoError(t, ms.Complete(ctx, key, []byte("response")))
+
+			record, reserved, err := ms.Reserve(ctx, key, hash)
+			require.NoError(t, err)
+			require.False(t, reserved)
+			require.True(t, record.Completed)
+			require.Equal(t, []byte("response"), record.Response)
+		})
+
+		t.Run("completed record is not released", func(t *testing.T) {
+			require.NoError(t, ms.Release(ctx, key))
+
+			_, reserved, err := ms.Reserve(ctx, key, hash)
+			require.NoError(t, err)
+			require.False(t, reserved)
+		})
+
+		t.Run("released key can be reserved again", func(t *testing.T) {
+			otherKey := uuid.New().String()
+			_, reserved, err := ms.Reserve(ctx, otherKey, hash)
+			require.NoError(t, err)
+			require.True(t, reserved)
+
+			require.NoError(t, ms.Release(ctx, otherKey))
+
+			_, reserved, err = ms.Reserve(ctx, otherKey, hash)
+			require.NoError(t, err)
+			require.True(t, reserved)
+		})
+
+		t.Run("changed ttl recreates the index", func(t *testing.T) {
+			ms.ttl = 2 * time.Hour
+			require.NoError(t, ms.setupIndices(ctx))
+		})
+	})
+}
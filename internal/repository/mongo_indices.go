@@ -2,6 +2,8 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -11,22 +13,61 @@ func ref[T any](v T) *T {
 	return &v
 }
 
+// emailIndexName is the name of the unique index on email
+const emailIndexName = "users_email_unique_asc"
+
 var mongoIndices = []mongo.IndexModel{
 	{
 		Keys: bson.D{{Key: "email", Value: 1}}, Options: &options.IndexOptions{
-			Name: ref("users_email_single_asc"),
+			Name:   ref(emailIndexName),
+			Unique: ref(true),
+			// users without an email are not indexed, so any number of them can exist
+			PartialFilterExpression: bson.D{{Key: "email", Value: bson.D{{Key: "$gt", Value: ""}}}},
 		},
 	},
 
 	// Add more indices here when there is need
 }
 
+// replacedIndices are dropped once mongoIndices are created, so the collection is never left without them
+var replacedIndices = []string{
+	"users_email_single_asc", // replaced by the unique emailIndexName
+}
+
 func (mr *mongoRepository) setupIndices(ctx context.Context) error {
 	for _, v := range mongoIndices {
-		_, err := mr.collection.Indexes().CreateOne(ctx, v)
+		err := createIndexReplacingConflict(ctx, mr.collection, v)
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("could not create unique index %s, the collection holds duplicates that must be resolved first: %w", *v.Options.Name, err)
+		}
 		if err != nil {
 			return err
 		}
 	}
+
+	for _, name := range replacedIndices {
+		_, err := mr.collection.Indexes().DropOne(ctx, name)
+
+		var cmdErr mongo.CommandError
+		if err != nil && !(errors.As(err, &cmdErr) && (cmdErr.Code == 26 || cmdErr.Code == 27)) { // NamespaceNotFound, IndexNotFound
+			return err
+		}
+	}
 	return nil
 }
+
+// createIndexReplacingConflict creates index, replacing an index with the same name but other options
+// such as a ttl-index whose ttl changed
+func createIndexReplacingConflict(ctx context.Context, collection *mongo.Collection, index mongo.IndexModel) error {
+	_, err := collection.Indexes().CreateOne(ctx, index)
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 85 { // IndexOptionsConflict
+		if _, err = collection.Indexes().DropOne(ctx, *index.Options.Name); err != nil {
+			return err
+		}
+		_, err = collection.Indexes().CreateOne(ctx, index)
+	}
+
+	return err
+}
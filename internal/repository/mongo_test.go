@@ -9,18 +9,23 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"log/slog"
 	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 // generateTestUser generates a user that is guaranteed to have all it's public fields set to a non-zero value
-// the id is random for each call
+// the id and email are random for each call
 func generateTestUser() types.User {
 	return fixtures_test.NewUserWith(func(u *types.User) {
 		u.Id = uuid.New()
+		u.Email = u.Id.String() + "@example.com"
 	})
 }
 
@@ -43,7 +48,10 @@ func runTestWithMongoConnection(t *testing.T, test func(mr *mongoRepository)) {
 		collection = u
 	}
 
-	repo, err := NewMongoRepository(ctx, uri, dbName, collection)
+	client, err := ConnectMongo(ctx, uri)
+	require.NoError(t, err)
+
+	repo, err := NewMongoRepository(ctx, client.Database(dbName).Collection(collection))
 	require.NoError(t, err)
 
 	mr := repo.(*mongoRepository)
@@ -90,6 +98,18 @@ func TestMongoRepository_CRUD(t *testing.T) {
 			defer cancel()
 			require.NoError(t, mr.Add(ctx, &usr), "user could not be added")
 			require.ErrorIs(t, mr.Add(ctx, &usr), types.ErrDuplicateUserId, "duplicate user id allowed")
+
+			sameEmail := generateTestUser()
+			sameEmail.Email = usr.Email
+			require.ErrorIs(t, mr.Add(ctx, &sameEmail), types.ErrDuplicateEmail, "duplicate email allowed")
+
+			noEmail := []types.User{generateTestUser(), generateTestUser()}
+			for i := range noEmail {
+				noEmail[i].Email = ""
+				require.NoError(t, mr.Add(ctx, &noEmail[i]), "users without an email should not conflict")
+			}
+			_, err := mr.DeleteMany(ctx, []uuid.UUID{noEmail[0].Id, noEmail[1].Id})
+			require.NoError(t, err)
 		})
 
 		// Just validating that all fields unset read
@@ -108,7 +128,7 @@ func TestMongoRepository_CRUD(t *testing.T) {
 			defer cancel()
 
 			newFirstName := "not test"
-			u, err := mr.UpdatePartial(
+			before, u, err := mr.UpdatePartial(
 				ctx,
 				types.UserFilter{Ids: []uuid.UUID{usr.Id}},
 				types.UpdateUserFields{
@@ -127,6 +147,92 @@ func TestMongoRepository_CRUD(t *testing.T) {
 			if u.LastName != "" {
 				t.Errorf("last name was not cleared properly")
 			}
+
+			require.Equal(t, usr, before, "before-image should be the user as it was before the update")
+			require.Equal(t, usr.Revision+1, u.Revision, "revision was not incremented")
+			require.NotNil(t, u.UpdatedAt, "updated_at was not set")
+
+			stored, _, err := mr.List(ctx, types.UserFilter{Ids: []uuid.UUID{usr.Id}}, types.Paging{Limit: 1, Offset: 0})
+			require.NoError(t, err, "got error fetching user from db")
+			require.Len(t, stored, 1)
+			require.Equal(t, stored[0], u, "after-image should match the stored user")
+		})
+
+		t.Run("upsert", func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			now := time.Now().UTC().Truncate(time.Millisecond)
+			newUser := generateTestUser()
+			newUser.Email = "upsert@example.com"
+			newUser.CreatedAt = now
+			newUser.UpdatedAt = &now
+
+			before, u, err := mr.Upsert(ctx, newUser, types.UpsertKeyId)
+			require.NoError(t, err, "got error upserting new user")
+			require.Nil(t, before, "new user should be created")
+			require.Equal(t, newUser.Id, u.Id)
+			require.Nil(t, u.UpdatedAt, "updated_at should not be set on a created user")
+			require.Equal(t, uint64(1), u.Revision)
+
+			later := now.Add(time.Minute)
+			before, u, err = mr.Upsert(ctx, types.User{Id: newUser.Id, Nickname: "upserted", CreatedAt: later, UpdatedAt: &later}, types.UpsertKeyId)
+			require.NoError(t, err, "got error upserting existing user by id")
+			require.NotNil(t, before, "existing user should be updated")
+			require.Equal(t, newUser.Nickname, before.Nickname)
+			require.Equal(t, "upserted", u.Nickname)
+			require.Equal(t, newUser.FirstName, u.FirstName, "unset fields should be left untouched")
+			require.True(t, now.Equal(u.CreatedAt), "created_at should not change on update")
+			require.NotNil(t, u.UpdatedAt)
+			require.Equal(t, uint64(2), u.Revision)
+
+			stored, _, err := mr.List(ctx, types.UserFilter{Ids: []uuid.UUID{newUser.Id}}, types.Paging{Limit: 1, Offset: 0})
+			require.NoError(t, err, "got error fetching user from db")
+			require.Len(t, stored, 1)
+			require.Equal(t, stored[0], u, "after-image should match the stored user")
+
+			before, u, err = mr.Upsert(ctx, types.User{Id: uuid.New(), Email: newUser.Email, Nickname: "$password", CreatedAt: later, UpdatedAt: &later}, types.UpsertKeyEmail)
+			require.NoError(t, err, "got error upserting existing user by email")
+			require.NotNil(t, before, "existing user should be matched by email")
+			require.Equal(t, newUser.Id, u.Id, "id of existing user should not change")
+			require.Equal(t, "$password", u.Nickname, "values should be stored literally")
+
+			byEmail := types.User{Id: uuid.New(), Email: "upsert-new@example.com", CreatedAt: now}
+			before, u, err = mr.Upsert(ctx, byEmail, types.UpsertKeyEmail)
+			require.NoError(t, err, "got error upserting new user by email")
+			require.Nil(t, before)
+			require.Equal(t, byEmail.Id, u.Id, "created user should get the supplied id")
+
+			_, err = mr.DeleteMany(ctx, []uuid.UUID{newUser.Id, byEmail.Id})
+			require.NoError(t, err)
+		})
+
+		t.Run("delete many", func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			others := []types.User{generateTestUser(), generateTestUser()}
+			for i := range others {
+				require.NoError(t, mr.Add(ctx, &others[i]), "user could not be added")
+			}
+
+			ids := []uuid.UUID{others[0].Id, others[1].Id}
+			users, cnt, err := mr.List(ctx, types.UserFilter{Ids: ids}, types.Paging{Limit: 10, Offset: 0})
+			require.NoError(t, err, "got error fetching users from db")
+			require.Equal(t, uint64(2), cnt, "multiple ids should all be matched")
+			require.Len(t, users, 2)
+
+			deleted, err := mr.DeleteMany(ctx, ids)
+			require.NoError(t, err, "got error trying to delete users")
+			require.Equal(t, uint64(2), deleted)
+
+			_, cnt, err = mr.List(ctx, types.UserFilter{Ids: ids}, types.Paging{Limit: 10, Offset: 0})
+			require.NoError(t, err, "got error fetching users from db")
+			require.Equal(t, uint64(0), cnt)
+
+			deleted, err = mr.DeleteMany(ctx, nil)
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), deleted)
 		})
 
 		t.Run("delete", func(t *testing.T) {
@@ -141,6 +247,45 @@ func TestMongoRepository_CRUD(t *testing.T) {
 	})
 }
 
+func TestMongoRepository_ConcurrentUpsertByEmail(t *testing.T) {
+	runTestWithMongoConnection(t, func(mr *mongoRepository) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		const upserts = 10
+		var (
+			email   = uuid.NewString() + "@example.com"
+			wg      sync.WaitGroup
+			created atomic.Int32
+			errs    = make(chan error, upserts)
+		)
+
+		for range upserts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				before, _, err := mr.Upsert(ctx, types.User{Id: uuid.New(), Email: email, CreatedAt: time.Now()}, types.UpsertKeyEmail)
+				if err == nil && before == nil {
+					created.Add(1)
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err, "concurrent upserts of the same email should not fail")
+		}
+		require.Equal(t, int32(1), created.Load(), "only one upsert should create the user")
+
+		users, cnt, err := mr.List(ctx, types.UserFilter{Email: email}, types.Paging{Limit: upserts})
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), cnt, "only one user should exist with the email")
+		require.Equal(t, uint64(upserts), users[0].Revision, "every upsert should be applied to the user")
+	})
+}
+
 func TestMongoRepository_List(t *testing.T) {
 	runTestWithMongoConnection(t, func(mr *mongoRepository) {
 		usr := generateTestUser()
@@ -155,6 +300,9 @@ func TestMongoRepository_List(t *testing.T) {
 		timeBeforeUserUpdate := usr.UpdatedAt.Add(-1 * time.Hour)
 		timeAfterUserUpdate := usr.UpdatedAt.Add(1 * time.Hour)
 
+		timeUserCreate := usr.CreatedAt
+		timeUserUpdate := *usr.UpdatedAt
+
 		tests := []struct {
 			name      string
 			filter    types.UserFilter
@@ -261,6 +409,54 @@ func TestMongoRepository_List(t *testing.T) {
 				},
 				wantCount: 1,
 			},
+			{
+				name:   "sad match created before exclusive boundary",
+				filter: types.UserFilter{Created: &types.TimeFilter{Before: &timeUserCreate}},
+			},
+			{
+				name:      "happy match created before inclusive boundary",
+				filter:    types.UserFilter{Created: &types.TimeFilter{Before: &timeUserCreate, BeforeInclusive: true}},
+				wantCount: 1,
+			},
+			{
+				name:   "sad match created after exclusive boundary",
+				filter: types.UserFilter{Created: &types.TimeFilter{After: &timeUserCreate}},
+			},
+			{
+				name:      "happy match created after inclusive boundary",
+				filter:    types.UserFilter{Created: &types.TimeFilter{After: &timeUserCreate, AfterInclusive: true}},
+				wantCount: 1,
+			},
+			{
+				name: "happy match updated inclusive on both boundaries",
+				filter: types.UserFilter{
+					Updated: &types.TimeFilter{
+						Before:          &timeUserUpdate,
+						After:           &timeUserUpdate,
+						BeforeInclusive: true,
+						AfterInclusive:  true,
+					},
+				},
+				wantCount: 1,
+			},
+			{
+				name:      "happy match updated is set",
+				filter:    types.UserFilter{Updated: &types.TimeFilter{IsSet: ref(true)}},
+				wantCount: 1,
+			},
+			{
+				name:   "sad match updated is not set",
+				filter: types.UserFilter{Updated: &types.TimeFilter{IsSet: ref(false)}},
+			},
+			{
+				name:   "sad match updated not set combined with bound",
+				filter: types.UserFilter{Updated: &types.TimeFilter{After: &timeBeforeUserUpdate, IsSet: ref(false)}},
+			},
+			{
+				name:      "happy match empty time filter is ignored",
+				filter:    types.UserFilter{Updated: &types.TimeFilter{}},
+				wantCount: 1,
+			},
 			{
 				name:      "sad don't match mis-matched names",
 				filter:    types.UserFilter{FirstName: usr.FirstName, LastName: "this-is-not-a-name"},
@@ -282,6 +478,122 @@ func TestMongoRepository_List(t *testing.T) {
 	})
 }
 
+func TestMongoRepository_ListNeverUpdated(t *testing.T) {
+	runTestWithMongoConnection(t, func(mr *mongoRepository) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		updated := generateTestUser()
+		neverUpdated := fixtures_test.NewUserWith(func(u *types.User) {
+			u.Id = uuid.New()
+			u.Email = u.Id.String() + "@example.com"
+			u.UpdatedAt = nil
+		})
+
+		require.NoError(t, mr.Add(ctx, &updated))
+		require.NoError(t, mr.Add(ctx, &neverUpdated))
+
+		users, cnt, err := mr.List(ctx, types.UserFilter{Updated: &types.TimeFilter{IsSet: ref(false)}}, types.Paging{Limit: 10})
+		require.NoError(t, err, "got unexpected error from db")
+		require.Equal(t, uint64(1), cnt, "unexpected result count")
+		require.Len(t, users, 1)
+		require.Equal(t, neverUpdated.Id, users[0].Id, "wrong user matched")
+
+		users, cnt, err = mr.List(ctx, types.UserFilter{Updated: &types.TimeFilter{IsSet: ref(true)}}, types.Paging{Limit: 10})
+		require.NoError(t, err, "got unexpected error from db")
+		require.Equal(t, uint64(1), cnt, "unexpected result count")
+		require.Len(t, users, 1)
+		require.Equal(t, updated.Id, users[0].Id, "wrong user matched")
+	})
+}
+
+func Test_duplicateKeyError(t *testing.T) {
+	duplicateKey := func(keyPattern bson.D) bson.Raw {
+		raw, err := bson.Marshal(bson.D{{Key: "code", Value: 11000}, {Key: "keyPattern", Value: keyPattern}})
+		require.NoError(t, err)
+		return raw
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{
+			name: "insert with duplicate email",
+			err:  mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error", Raw: duplicateKey(bson.D{{Key: "email", Value: 1}})}}},
+			want: types.ErrDuplicateEmail,
+		},
+		{
+			name: "insert with duplicate id",
+			err:  mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error", Raw: duplicateKey(bson.D{{Key: "_id", Value: 1}})}}},
+			want: types.ErrDuplicateUserId,
+		},
+		{
+			name: "update with duplicate email",
+			err:  mongo.CommandError{Code: 11000, Message: "E11000 duplicate key error", Raw: duplicateKey(bson.D{{Key: "email", Value: 1}})},
+			want: types.ErrDuplicateEmail,
+		},
+		{
+			name: "duplicate key without a key pattern",
+			err:  mongo.CommandError{Code: 11000, Message: "E11000 duplicate key error index: " + emailIndexName},
+			want: types.ErrDuplicateUserId,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorIs(t, duplicateKeyError(tt.err), tt.want)
+		})
+	}
+}
+
+func Test_timeCriteriaToMongo(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		filter types.TimeFilter
+		want   bson.M
+	}{
+		{
+			name:   "exclusive bounds",
+			filter: types.TimeFilter{Before: &now, After: &now},
+			want:   bson.M{"$lt": &now, "$gt": &now},
+		},
+		{
+			name:   "inclusive bounds",
+			filter: types.TimeFilter{Before: &now, After: &now, BeforeInclusive: true, AfterInclusive: true},
+			want:   bson.M{"$lte": &now, "$gte": &now},
+		},
+		{
+			name:   "inclusive flags without bounds are ignored",
+			filter: types.TimeFilter{BeforeInclusive: true, AfterInclusive: true},
+			want:   nil,
+		},
+		{
+			name:   "is set",
+			filter: types.TimeFilter{IsSet: ref(true)},
+			want:   bson.M{"$exists": true},
+		},
+		{
+			name:   "is not set",
+			filter: types.TimeFilter{IsSet: ref(false)},
+			want:   bson.M{"$exists": false},
+		},
+		{
+			name:   "empty filter",
+			filter: types.TimeFilter{},
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, timeCriteriaToMongo(tt.filter))
+		})
+	}
+}
+
 func Test_userCriteriaToMongoFilter(t *testing.T) {
 	now := time.Now()
 	filter := types.UserFilter{
@@ -0,0 +1,228 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+type mongoWebhookRepository struct {
+	webhooks    *mongo.Collection
+	deliveries  *mongo.Collection
+	deadLetters *mongo.Collection
+
+	// deliveryTTL is how long delivery attempts are logged for
+	deliveryTTL time.Duration
+}
+
+// mongoWebhook is how webhooks are stored, the subscription parameters are kept as protobuf
+type mongoWebhook struct {
+	Id        uuid.UUID `bson:"_id"`
+	Url       string    `bson:"url"`
+	Secret    string    `bson:"secret"`
+	Params    []byte    `bson:"params"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// NewMongoWebhookRepository stores webhooks in collection, their delivery log and dead letters are stored
+// in the collections suffixed _deliveries and _dead_letters, delivery attempts are removed by mongodb after deliveryTTL
+func NewMongoWebhookRepository(ctx context.Context, collection *mongo.Collection, deliveryTTL time.Duration) (internal.WebhookRepository, error) {
+	database := collection.Database()
+	mr := &mongoWebhookRepository{
+		webhooks:    collection,
+		deliveries:  database.Collection(collection.Name() + "_deliveries"),
+		deadLetters: database.Collection(collection.Name() + "_dead_letters"),
+		deliveryTTL: deliveryTTL,
+	}
+
+	indexCtx, indexCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer indexCancel()
+
+	err := mr.setupIndices(indexCtx)
+
+	return mr, err
+}
+
+func (mr *mongoWebhookRepository) AddWebhook(ctx context.Context, webhook types.Webhook) error {
+	params, err := proto.Marshal(webhook.Subscription.ParamsProto())
+	if err != nil {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+
+	_, err = mr.webhooks.InsertOne(ctx, mongoWebhook{
+		Id:        webhook.Id,
+		Url:       webhook.Url,
+		Secret:    webhook.Secret,
+		Params:    params,
+		CreatedAt: webhook.CreatedAt,
+	})
+	if err != nil {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+
+	return nil
+}
+
+func (mr *mongoWebhookRepository) DeleteWebhook(ctx context.Context, id uuid.UUID) error {
+	if _, err := mr.webhooks.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}}); err != nil {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+
+	for _, c := range []*mongo.Collection{mr.deliveries, mr.deadLetters} {
+		if _, err := c.DeleteMany(ctx, bson.D{{Key: "webhook_id", Value: id}}); err != nil {
+			return errors.Join(types.ErrUnknownError, err)
+		}
+	}
+
+	return nil
+}
+
+func (mr *mongoWebhookRepository) ListWebhooks(ctx context.Context, paging types.Paging) ([]types.Webhook, uint64, error) {
+	stored, total, err := findPaged[mongoWebhook](ctx, mr.webhooks, bson.D{}, bson.D{{Key: "created_at", Value: 1}}, paging)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	webhooks := make([]types.Webhook, 0, len(stored))
+	for _, w := range stored {
+		params := &generated.SubscriptionParameters{}
+		if err := proto.Unmarshal(w.Params, params); err != nil {
+			return nil, 0, errors.Join(types.ErrUnknownError, err)
+		}
+
+		sub, err := types.SubscriptionRequestFromParams(params)
+		if err != nil {
+			return nil, 0, errors.Join(types.ErrUnknownError, err)
+		}
+
+		webhooks = append(webhooks, types.Webhook{
+			Id:           w.Id,
+			Url:          w.Url,
+			Secret:       w.Secret,
+			Subscription: sub,
+			CreatedAt:    w.CreatedAt,
+		})
+	}
+
+	return webhooks, total, nil
+}
+
+func (mr *mongoWebhookRepository) AddDelivery(ctx context.Context, delivery types.WebhookDelivery) error {
+	if _, err := mr.deliveries.InsertOne(ctx, delivery); err != nil {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+
+	return nil
+}
+
+func (mr *mongoWebhookRepository) ListDeliveries(ctx context.Context, webhookId uuid.UUID, paging types.Paging) ([]types.WebhookDelivery, uint64, error) {
+	return findPaged[types.WebhookDelivery](
+		ctx,
+		mr.deliveries,
+		bson.D{{Key: "webhook_id", Value: webhookId}},
+		bson.D{{Key: "attempted_at", Value: -1}},
+		paging,
+	)
+}
+
+func (mr *mongoWebhookRepository) AddDeadLetter(ctx context.Context, deadLetter types.WebhookDeadLetter) error {
+	// a change is redelivered if its acknowledgement was lost after it was dead-lettered, replace the dead letter then
+	_, err := mr.deadLetters.ReplaceOne(ctx, bson.D{{Key: "_id", Value: deadLetter.Id}}, deadLetter, options.Replace().SetUpsert(true))
+	if err != nil {
+		return errors.Join(types.ErrUnknownError, err)
+	}
+
+	return nil
+}
+
+func (mr *mongoWebhookRepository) ListDeadLetters(ctx context.Context, webhookId uuid.UUID, paging types.Paging) ([]types.WebhookDeadLetter, uint64, error) {
+	return findPaged[types.WebhookDeadLetter](
+		ctx,
+		mr.deadLetters,
+		bson.D{{Key: "webhook_id", Value: webhookId}},
+		bson.D{{Key: "created_at", Value: -1}},
+		paging,
+	)
+}
+
+// findPaged returns a page of the documents matching filter along with the total count of matching documents
+// a limit of 0 returns all documents
+func findPaged[T any](ctx context.Context, collection *mongo.Collection, filter bson.D, sort bson.D, paging types.Paging) ([]T, uint64, error) {
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, errors.Join(types.ErrUnknownError, err)
+	}
+
+	opts := options.Find().SetSort(sort).SetSkip(paging.Offset)
+	if paging.Limit > 0 {
+		opts.SetLimit(paging.Limit)
+	}
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, errors.Join(types.ErrUnknownError, err)
+	}
+
+	ret := make([]T, 0)
+	if err = cursor.All(ctx, &ret); err != nil {
+		return nil, 0, errors.Join(types.ErrUnknownError, err)
+	}
+
+	return ret, uint64(total), nil
+}
+
+// setupIndices creates the indices used to list deliveries and dead letters per webhook
+// and the ttl-index used to expire the delivery log, which is recreated if it exists with another ttl
+func (mr *mongoWebhookRepository) setupIndices(ctx context.Context) error {
+	indices := []struct {
+		collection *mongo.Collection
+		index      mongo.IndexModel
+	}{
+		{
+			collection: mr.webhooks,
+			index: mongo.IndexModel{
+				Keys:    bson.D{{Key: "created_at", Value: 1}},
+				Options: options.Index().SetName("webhooks_created_at_asc"),
+			},
+		},
+		{
+			collection: mr.deliveries,
+			index: mongo.IndexModel{
+				Keys:    bson.D{{Key: "webhook_id", Value: 1}, {Key: "attempted_at", Value: -1}},
+				Options: options.Index().SetName("webhook_deliveries_webhook_id_attempted_at"),
+			},
+		},
+		{
+			collection: mr.deliveries,
+			index: mongo.IndexModel{
+				Keys: bson.D{{Key: "attempted_at", Value: 1}},
+				Options: options.Index().
+					SetName("webhook_deliveries_attempted_at_ttl").
+					SetExpireAfterSeconds(int32(mr.deliveryTTL.Seconds())),
+			},
+		},
+		{
+			collection: mr.deadLetters,
+			index: mongo.IndexModel{
+				Keys:    bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}},
+				Options: options.Index().SetName("webhook_dead_letters_webhook_id_created_at"),
+			},
+		},
+	}
+
+	for _, i := range indices {
+		if err := createIndexReplacingConflict(ctx, i.collection, i.index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
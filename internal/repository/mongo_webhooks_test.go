@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMongoWebhookRepository(t *testing.T) {
+	runTestWithMongoConnection(t, func(mr *mongoRepository) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		db := mr.collection.Database()
+		wr := &mongoWebhookRepository{
+			webhooks:    db.Collection("webhooks"),
+			deliveries:  db.Collection("webhooks_deliveries"),
+			deadLetters: db.Collection("webhooks_dead_letters"),
+			deliveryTTL: time.Hour,
+		}
+		require.NoError(t, wr.setupIndices(ctx), "could not setup indices")
+
+		webhook := types.Webhook{
+			Id:     uuid.New(),
+			Url:    "https://example.com/hook",
+			Secret: "secret",
+			Subscription: types.SubscriptionRequest{
+				UserIds:       []uuid.UUID{uuid.New()},
+				Changes:       []types.UserChangeType{types.UserChangeTypeUpdated},
+				Filter:        types.UserFilter{Countries: []string{"DE"}},
+				IncludeImages: true,
+			},
+			CreatedAt: mongoTime(time.Now()),
+		}
+
+		t.Run("webhook is stored with its subscription", func(t *testing.T) {
+			require.NoError(t, wr.AddWebhook(ctx, webhook))
+
+			webhooks, total, err := wr.ListWebhooks(ctx, types.Paging{})
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), total)
+			require.True(t, cmp.Equal(webhook, webhooks[0]), cmp.Diff(webhook, webhooks[0]))
+		})
+
+		t.Run("deliveries are listed latest first", func(t *testing.T) {
+			deliveryId := uuid.New()
+			for attempt := 1; attempt <= 3; attempt++ {
+				require.NoError(t, wr.AddDelivery(ctx, types.WebhookDelivery{
+					Id:        deliveryId,
+					WebhookId: webhook.Id,
+					Attempt:   attempt,
+					AttemptAt: mongoTime(time.Now().Add(time.Duration(attempt) * time.Second)),
+				}))
+			}
+
+			deliveries, total, err := wr.ListDeliveries(ctx, webhook.Id, types.Paging{Limit: 2})
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), total)
+			require.Len(t, deliveries, 2)
+			require.Equal(t, 3, deliveries[0].Attempt)
+		})
+
+		t.Run("dead letters are stored", func(t *testing.T) {
+			require.NoError(t, wr.AddDeadLetter(ctx, types.WebhookDeadLetter{
+				Id:        uuid.New(),
+				WebhookId: webhook.Id,
+				Body:      []byte("{}"),
+				Attempts:  5,
+				CreatedAt: mongoTime(time.Now()),
+			}))
+
+			deadLetters, total, err := wr.ListDeadLetters(ctx, webhook.Id, types.Paging{})
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), total)
+			require.Equal(t, []byte("{}"), deadLetters[0].Body)
+		})
+
+		t.Run("deleting a webhook removes its deliveries and dead letters", func(t *testing.T) {
+			require.NoError(t, wr.DeleteWebhook(ctx, webhook.Id))
+
+			_, total, err := wr.ListWebhooks(ctx, types.Paging{})
+			require.NoError(t, err)
+			require.Zero(t, total)
+
+			_, total, err = wr.ListDeliveries(ctx, webhook.Id, types.Paging{})
+			require.NoError(t, err)
+			require.Zero(t, total)
+
+			_, total, err = wr.ListDeadLetters(ctx, webhook.Id, types.Paging{})
+			require.NoError(t, err)
+			require.Zero(t, total)
+		})
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"github.com/captainlettuce/users-microservice/internal/types"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"reflect"
+	"time"
 )
 
 // IsZero checks if a pointer is nil or the types zero-value
@@ -90,3 +92,83 @@ func createUpdateDocument(in any) (bson.D, error) {
 
 	return ret, nil
 }
+
+// createUpsertPipeline creates an update pipeline that inserts the user or updates an existing one in a single operation
+// string fields set to their zero-value are left untouched, values are wrapped in $literal since
+// user supplied strings starting with '$' would otherwise be interpreted as field paths
+// _id and created_at are kept if the document exists, and updated_at is only set if it did exist before
+// the revision is incremented, starting at 1 for inserted documents
+func createUpsertPipeline(user types.User) mongo.Pipeline {
+	literal := func(v any) bson.D {
+		return bson.D{{Key: "$literal", Value: v}}
+	}
+
+	isNew := bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$created_at"}}, "missing"}}}
+
+	set := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$_id", literal(user.Id)}}}},
+	}
+
+	for _, f := range []struct {
+		key   string
+		value string
+	}{
+		{"first_name", user.FirstName},
+		{"last_name", user.LastName},
+		{"nickname", user.Nickname},
+		{"email", user.Email},
+		{"password", user.Password},
+		{"country", user.Country},
+	} {
+		if f.value != "" {
+			set = append(set, bson.E{Key: f.key, Value: literal(f.value)})
+		}
+	}
+
+	var updatedAt any = "$$REMOVE"
+	if user.UpdatedAt != nil {
+		updatedAt = literal(*user.UpdatedAt)
+	}
+
+	set = append(set,
+		bson.E{Key: "created_at", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$created_at", literal(user.CreatedAt)}}}},
+		bson.E{Key: "updated_at", Value: bson.D{{Key: "$cond", Value: bson.A{isNew, "$$REMOVE", updatedAt}}}},
+		bson.E{Key: "revision", Value: bson.D{{Key: "$add", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$revision", 0}}}, 1}}}},
+	)
+
+	return mongo.Pipeline{{{Key: "$set", Value: set}}}
+}
+
+// addChangeMetadata adds setting updated_at and incrementing the revision to an update document created by createUpdateDocument
+func addChangeMetadata(update bson.D, updatedAt time.Time) bson.D {
+	metadataSet := bson.E{Key: "updated_at", Value: updatedAt}
+
+	hasSet := false
+	for i, e := range update {
+		if e.Key == "$set" {
+			if set, ok := e.Value.(bson.D); ok {
+				update[i].Value = append(set, metadataSet)
+				hasSet = true
+			}
+		}
+	}
+
+	if !hasSet {
+		update = append(update, bson.E{Key: "$set", Value: bson.D{metadataSet}})
+	}
+
+	return append(update, bson.E{Key: "$inc", Value: bson.D{{Key: "revision", Value: 1}}})
+}
+
+// nonEmpty returns a pointer to s, or nil if s is empty
+func nonEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// mongoTime returns t as it will be read back from mongodb, which stores timestamps in UTC with millisecond precision
+func mongoTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
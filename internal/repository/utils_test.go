@@ -2,6 +2,8 @@ package repository
 
 import (
 	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson"
 	"reflect"
 	"testing"
@@ -149,3 +151,39 @@ func Test_createUpdateDocument(t *testing.T) {
 		})
 	}
 }
+
+func Test_createUpsertPipeline(t *testing.T) {
+	user := types.User{
+		Id:        uuid.New(),
+		FirstName: "$password",
+		Email:     "email@example.com",
+	}
+
+	pipeline := createUpsertPipeline(user)
+	require.Len(t, pipeline, 1, "expected a single $set stage")
+
+	stage := pipeline[0]
+	require.Equal(t, "$set", stage[0].Key)
+
+	set, ok := stage[0].Value.(bson.D)
+	require.True(t, ok)
+
+	fields := set.Map()
+
+	t.Run("zero-value fields are left untouched", func(t *testing.T) {
+		for _, k := range []string{"last_name", "nickname", "password", "country"} {
+			require.NotContains(t, fields, k)
+		}
+	})
+
+	t.Run("values are not interpreted as expressions", func(t *testing.T) {
+		require.Equal(t, bson.D{{Key: "$literal", Value: user.FirstName}}, fields["first_name"])
+		require.Equal(t, bson.D{{Key: "$literal", Value: user.Email}}, fields["email"])
+	})
+
+	t.Run("id and timestamps are always set", func(t *testing.T) {
+		for _, k := range []string{"_id", "created_at", "updated_at"} {
+			require.Contains(t, fields, k)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/internal/auth"
+	middleware "github.com/grpc-ecosystem/go-grpc-middleware/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func authUnaryServerInterceptor(authenticator *auth.Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		ctx, err = authenticator.Authorize(ctx, info.FullMethod, authorizationFromContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func authStreamServerInterceptor(authenticator *auth.Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticator.Authorize(ss.Context(), info.FullMethod, authorizationFromContext(ss.Context()))
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &middleware.WrappedServerStream{ServerStream: ss, WrappedContext: ctx})
+	}
+}
+
+func authorizationFromContext(ctx context.Context) string {
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
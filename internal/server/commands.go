@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"github.com/captainlettuce/users-microservice/internal/auth"
+	"github.com/captainlettuce/users-microservice/internal/wait"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"log/slog"
+	"time"
+)
+
+const (
+	// HeaderCommandError holds why a dead-lettered command failed
+	HeaderCommandError = "Users-Command-Error"
+
+	// HeaderCommandSubject holds the subject a dead-lettered command was received on
+	HeaderCommandSubject = "Users-Command-Subject"
+)
+
+type CommandSettings struct {
+	subject           string
+	queueGroup        string
+	deadLetterSubject string
+	timeout           time.Duration
+	sanitizeErrors    bool
+	authenticator     *auth.Authenticator
+}
+
+type CommandOption func(*CommandSettings)
+
+// WithCommandSubject sets the subject commands are received on and the queue group replicas share it with
+func WithCommandSubject(subject, queueGroup string) CommandOption {
+	return func(settings *CommandSettings) {
+		settings.subject = subject
+		settings.queueGroup = queueGroup
+	}
+}
+
+// WithCommandDeadLetterSubject sets the subject commands that could not be applied are published to
+func WithCommandDeadLetterSubject(subject string) CommandOption {
+	return func(settings *CommandSettings) {
+		settings.deadLetterSubject = subject
+	}
+}
+
+// WithCommandTimeout sets how long applying a single command may take
+func WithCommandTimeout(timeout time.Duration) CommandOption {
+	return func(settings *CommandSettings) {
+		settings.timeout = timeout
+	}
+}
+
+// WithCommandErrorSanitization replaces the message of internal errors replied to senders with a generic text and the
+// request id, dead-lettered commands keep the original error
+func WithCommandErrorSanitization(enabled bool) CommandOption {
+	return func(settings *CommandSettings) {
+		settings.sanitizeErrors = enabled
+	}
+}
+
+// WithCommandAuthenticator requires commands to carry a bearer jwt in the Authorization header, with the scope needed
+// for the grpc method a command calls. Rejected commands are handled like failed ones
+func WithCommandAuthenticator(authenticator *auth.Authenticator) CommandOption {
+	return func(settings *CommandSettings) {
+		settings.authenticator = authenticator
+	}
+}
+
+// CommandConsumer applies UserCommand messages received on a nats queue group
+type CommandConsumer struct {
+	logger            *slog.Logger
+	nc                *nats.Conn
+	users             generated.UsersServiceServer
+	deadLetterSubject string
+	timeout           time.Duration
+	sanitizeErrors    bool
+	authenticator     *auth.Authenticator
+
+	sub *nats.Subscription
+}
+
+// NewNatsCommandConsumer starts applying the commands published to the command subject
+// results are sent to the reply subject of a command if it has one. Commands that can not be decoded, and failed
+// commands nobody is waiting for, are published unchanged to the dead-letter subject with the error in a header
+func NewNatsCommandConsumer(nc *nats.Conn, users generated.UsersServiceServer, logger *slog.Logger, options ...CommandOption) (*CommandConsumer, error) {
+	settings := &CommandSettings{
+		subject:           "commands.users.v1",
+		queueGroup:        "users",
+		deadLetterSubject: "commands.users.v1.dead",
+		timeout:           10 * time.Second,
+	}
+
+	for _, option := range options {
+		option(settings)
+	}
+
+	cc := &CommandConsumer{
+		logger:            logger.With(slog.String("component", "nats.commands")),
+		nc:                nc,
+		users:             users,
+		deadLetterSubject: settings.deadLetterSubject,
+		timeout:           settings.timeout,
+		sanitizeErrors:    settings.sanitizeErrors,
+		authenticator:     settings.authenticator,
+	}
+
+	sub, err := nc.QueueSubscribe(settings.subject, settings.queueGroup, cc.handle)
+	if err != nil {
+		return nil, fmt.Errorf("could not subscribe to command subject: %w", err)
+	}
+	cc.sub = sub
+
+	return cc, nil
+}
+
+// Shutdown stops receiving commands and waits for the ones already received to be applied, or ctx to be done
+func (cc *CommandConsumer) Shutdown(ctx context.Context) error {
+	if err := cc.sub.Drain(); err != nil {
+		return fmt.Errorf("could not drain command subscription: %w", err)
+	}
+
+	for cc.sub.IsValid() {
+		if !wait.Sleep(ctx, 10*time.Millisecond) {
+			return errors.Join(ctx.Err(), cc.sub.Unsubscribe())
+		}
+	}
+
+	return nil
+}
+
+func (cc *CommandConsumer) handle(msg *nats.Msg) {
+	ctx, cancel := context.WithTimeout(addLoggingAttrsToContext(context.Background(), msg.Subject), cc.timeout)
+	defer cancel()
+
+	defer func() {
+		if p := recover(); p != nil {
+			cc.reject(ctx, msg, recoveryHandler(ctx, p))
+		}
+	}()
+
+	cmd := &generated.UserCommand{}
+	if err := proto.Unmarshal(msg.Data, cmd); err != nil {
+		cc.poison(ctx, msg, fmt.Errorf("invalid command: %w", err))
+		return
+	}
+
+	var (
+		result = &generated.UserCommandResult{}
+		err    error
+	)
+	switch c := cmd.GetCommand().(type) {
+	case *generated.UserCommand_Add:
+		if ctx, err = cc.authorize(ctx, msg, "add"); err != nil {
+			break
+		}
+		var resp *generated.AddUserResponse
+		if resp, err = cc.users.Add(ctx, c.Add); err == nil {
+			result.Result = &generated.UserCommandResult_Add{Add: resp}
+		}
+	case *generated.UserCommand_Update:
+		if ctx, err = cc.authorize(ctx, msg, "update"); err != nil {
+			break
+		}
+		var resp *generated.UpdateUserResponse
+		if resp, err = cc.users.Update(ctx, c.Update); err == nil {
+			result.Result = &generated.UserCommandResult_Update{Update: resp}
+		}
+	default:
+		cc.poison(ctx, msg, errors.New("invalid command: no command set"))
+		return
+	}
+
+	if err != nil {
+		cc.reject(ctx, msg, err)
+		return
+	}
+
+	cc.reply(ctx, msg, result)
+}
+
+// authorize checks that the sender of msg may call the grpc method named method
+func (cc *CommandConsumer) authorize(ctx context.Context, msg *nats.Msg, method string) (context.Context, error) {
+	if cc.authenticator == nil {
+		return ctx, nil
+	}
+
+	return cc.authenticator.Authorize(ctx, fullMethodName(method), msg.Header.Get("Authorization"))
+}
+
+// reject replies with err, or dead-letters the command if there is no reply subject
+func (cc *CommandConsumer) reject(ctx context.Context, msg *nats.Msg, err error) {
+	if msg.Reply == "" {
+		cc.deadLetter(ctx, msg, err)
+		return
+	}
+
+	cc.replyError(ctx, msg, err)
+}
+
+// poison dead-letters a command that can never be applied, and tells the sender if there is a reply subject
+func (cc *CommandConsumer) poison(ctx context.Context, msg *nats.Msg, err error) {
+	cc.deadLetter(ctx, msg, err)
+	cc.replyError(ctx, msg, apierror.New(codes.InvalidArgument, apierror.ReasonInvalidArgument, err.Error()))
+}
+
+func (cc *CommandConsumer) replyError(ctx context.Context, msg *nats.Msg, err error) {
+	if cc.sanitizeErrors {
+		err = sanitizeError(ctx, err)
+	}
+
+	st := status.Convert(err)
+	cc.reply(ctx, msg, &generated.UserCommandResult{
+		Result: &generated.UserCommandResult_Error{Error: &generated.CommandError{Code: st.Code().String(), Message: st.Message(), Reason: apierror.Reason(err)}},
+	})
+}
+
+func (cc *CommandConsumer) reply(ctx context.Context, msg *nats.Msg, result *generated.UserCommandResult) {
+	if msg.Reply == "" {
+		return
+	}
+
+	b, err := proto.Marshal(result)
+	if err == nil {
+		err = msg.Respond(b)
+	}
+	if err != nil {
+		cc.logger.With(slog.Any("error", err)).WarnContext(ctx, "Could not reply to user command")
+	}
+}
+
+func (cc *CommandConsumer) deadLetter(ctx context.Context, msg *nats.Msg, reason error) {
+	logger := cc.logger.With(slog.Any("error", reason))
+	logger.WarnContext(ctx, "Dead-lettering user command")
+
+	dead := nats.NewMsg(cc.deadLetterSubject)
+	for k, v := range msg.Header {
+		dead.Header[k] = v
+	}
+	// the dead-letter subject may be readable by more clients than the command subject
+	dead.Header.Del("Authorization")
+	dead.Header.Set(HeaderCommandError, errorMessage(reason))
+	dead.Header.Set(HeaderCommandSubject, msg.Subject)
+	dead.Data = msg.Data
+
+	if err := cc.nc.PublishMsg(dead); err != nil {
+		logger.With(slog.Any("publishError", err)).ErrorContext(ctx, "Could not dead-letter user command, it is lost")
+	}
+}
+
+// errorMessage is the status message of err if it is a grpc status
+func errorMessage(err error) string {
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		return st.Code().String() + ": " + st.Message()
+	}
+	return err.Error()
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/mocks"
+	"github.com/captainlettuce/users-microservice/internal/server/service"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestNewNatsCommandConsumer(t *testing.T) {
+	var (
+		userId = uuid.New()
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		us     = mocks.NewMockUserService(t)
+		nc     = testNatsConn(t)
+	)
+
+	cc, err := NewNatsCommandConsumer(nc, service.NewUsersGrpc(us, nil, logger), logger, WithCommandSubject("test.commands", "test"), WithCommandDeadLetterSubject("test.dead"))
+	require.NoError(t, err)
+
+	deadLetters, err := nc.SubscribeSync("test.dead")
+	require.NoError(t, err)
+
+	update := &generated.UserCommand{Command: &generated.UserCommand_Update{Update: &generated.UpdateUserRequest{
+		User:       &generated.User{FirstName: "first"},
+		Filter:     &generated.SearchFilter{Ids: []string{userId.String()}},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"first_name"}},
+	}}}
+
+	t.Run("applied command is replied to", func(t *testing.T) {
+		us.EXPECT().Add(mock.Anything, mock.Anything).Return(nil).Once()
+
+		result := requestCommand(t, nc, &generated.UserCommand{Command: &generated.UserCommand_Add{Add: &generated.AddUserRequest{
+			User: &generated.User{Id: userId.String(), FirstName: "first"},
+		}}})
+		require.Equal(t, userId.String(), result.GetAdd().GetUser().GetId())
+	})
+
+	t.Run("failed command is replied to with the error", func(t *testing.T) {
+		us.EXPECT().UpdatePartial(mock.Anything, mock.Anything, mock.Anything).Return(types.ErrNotFound).Once()
+
+		result := requestCommand(t, nc, update)
+		require.Equal(t, "NotFound", result.GetError().GetCode())
+	})
+
+	t.Run("failed command without reply subject is dead-lettered", func(t *testing.T) {
+		us.EXPECT().UpdatePartial(mock.Anything, mock.Anything, mock.Anything).Return(types.ErrNotFound).Once()
+
+		b, err := proto.Marshal(update)
+		require.NoError(t, err)
+		require.NoError(t, nc.Publish("test.commands", b))
+
+		dead, err := deadLetters.NextMsg(5 * time.Second)
+		require.NoError(t, err)
+		require.Equal(t, b, dead.Data)
+		require.Contains(t, dead.Header.Get(HeaderCommandError), "NotFound")
+		require.Equal(t, "test.commands", dead.Header.Get(HeaderCommandSubject))
+	})
+
+	t.Run("poison messages are dead-lettered", func(t *testing.T) {
+		require.NoError(t, nc.Publish("test.commands", []byte("not protobuf")))
+
+		dead, err := deadLetters.NextMsg(5 * time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []byte("not protobuf"), dead.Data)
+		require.Contains(t, dead.Header.Get(HeaderCommandError), "invalid command")
+	})
+
+	t.Run("empty commands are dead-lettered and rejected", func(t *testing.T) {
+		result := requestCommand(t, nc, &generated.UserCommand{})
+		require.Equal(t, "InvalidArgument", result.GetError().GetCode())
+
+		_, err := deadLetters.NextMsg(5 * time.Second)
+		require.NoError(t, err)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, cc.Shutdown(ctx))
+	require.False(t, cc.sub.IsValid(), "subscription not closed after shutdown")
+}
+
+func TestNewNatsCommandConsumer_authentication(t *testing.T) {
+	var (
+		userId        = uuid.New()
+		logger        = slog.New(slog.NewTextHandler(io.Discard, nil))
+		us            = mocks.NewMockUserService(t)
+		nc            = testNatsConn(t)
+		authenticator = testAuthenticator(t)
+	)
+
+	cc, err := NewNatsCommandConsumer(nc, service.NewUsersGrpc(us, nil, logger), logger, WithCommandSubject("test.commands", "test"), WithCommandDeadLetterSubject("test.dead"), WithCommandAuthenticator(authenticator.Authenticator))
+	require.NoError(t, err)
+	defer func() { _ = cc.Shutdown(context.Background()) }()
+
+	deadLetters, err := nc.SubscribeSync("test.dead")
+	require.NoError(t, err)
+
+	b, err := proto.Marshal(&generated.UserCommand{Command: &generated.UserCommand_Add{Add: &generated.AddUserRequest{
+		User: &generated.User{Id: userId.String(), FirstName: "first"},
+	}}})
+	require.NoError(t, err)
+
+	command := func(authorization string) *nats.Msg {
+		msg := nats.NewMsg("test.commands")
+		msg.Data = b
+		if authorization != "" {
+			msg.Header.Set("Authorization", authorization)
+		}
+		return msg
+	}
+	request := func(authorization string) *generated.UserCommandResult {
+		msg, err := nc.RequestMsg(command(authorization), 5*time.Second)
+		require.NoError(t, err)
+
+		result := &generated.UserCommandResult{}
+		require.NoError(t, proto.Unmarshal(msg.Data, result))
+		return result
+	}
+
+	t.Run("commands without a token are rejected", func(t *testing.T) {
+		require.Equal(t, "Unauthenticated", request("").GetError().GetCode())
+	})
+
+	t.Run("commands without the scope are rejected", func(t *testing.T) {
+		require.Equal(t, "PermissionDenied", request("Bearer "+authenticator.token(t, "users:read")).GetError().GetCode())
+	})
+
+	t.Run("rejected commands are dead-lettered without the token", func(t *testing.T) {
+		require.NoError(t, nc.PublishMsg(command("Bearer "+authenticator.token(t, "users:read"))))
+
+		dead, err := deadLetters.NextMsg(5 * time.Second)
+		require.NoError(t, err)
+		require.Contains(t, dead.Header.Get(HeaderCommandError), "PermissionDenied")
+		require.Empty(t, dead.Header.Get("Authorization"))
+	})
+
+	t.Run("authorized commands are applied", func(t *testing.T) {
+		us.EXPECT().Add(mock.Anything, mock.Anything).Return(nil).Once()
+
+		require.Equal(t, userId.String(), request("Bearer "+authenticator.token(t, "users:write")).GetAdd().GetUser().GetId())
+	})
+}
+
+func requestCommand(t *testing.T, nc *nats.Conn, cmd *generated.UserCommand) *generated.UserCommandResult {
+	t.Helper()
+
+	b, err := proto.Marshal(cmd)
+	require.NoError(t, err)
+
+	msg, err := nc.Request("test.commands", b, 5*time.Second)
+	require.NoError(t, err)
+
+	result := &generated.UserCommandResult{}
+	require.NoError(t, proto.Unmarshal(msg.Data, result))
+
+	return result
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"google.golang.org/grpc"
+)
+
+type requestIdKey struct{}
+
+// requestIdFromContext returns the id addLoggingAttrsToContext logs requests with
+func requestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// sanitizeError replaces the message of internal errors with a generic text and the id of the request
+func sanitizeError(ctx context.Context, err error) error {
+	return apierror.Sanitize(err, requestIdFromContext(ctx))
+}
+
+func errorSanitizationUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		resp, err = handler(ctx, req)
+		return resp, sanitizeError(ctx, err)
+	}
+}
+
+func errorSanitizationStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return sanitizeError(ss.Context(), handler(srv, ss))
+	}
+}
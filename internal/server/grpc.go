@@ -1,53 +1,198 @@
+// Package server serves the users api over grpc, and over http, nats micro and nats commands for clients that can't
+// use grpc. The other transports hand their requests to the grpc service, so validation, business rules and error
+// mapping are the same for all of them
 package server
 
 import (
 	"context"
+	"crypto/tls"
+	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"github.com/captainlettuce/users-microservice/internal/auth"
 	"github.com/captainlettuce/users-microservice/internal/logging"
 	"github.com/google/uuid"
 	middleware "github.com/grpc-ecosystem/go-grpc-middleware/v2"
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/recovery"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
-	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
 	"log/slog"
 	"runtime/debug"
+	"time"
 )
 
-func NewGrpc(configure func(s *grpc.Server, hs *health.Server)) *grpc.Server {
-	server := grpc.NewServer(
-		grpc.ChainUnaryInterceptor(
+type GrpcSettings struct {
+	idempotencyStore internal.IdempotencyStore
+	healthServer     *health.Server
+	keepaliveParams  keepalive.ServerParameters
+	keepalivePolicy  keepalive.EnforcementPolicy
+	reflection       bool
+	authenticator    *auth.Authenticator
+	tlsConfig        *tls.Config
+	sanitizeErrors   bool
+	streamContext    context.Context
+}
 
-			// recover any uncaught panics
-			recovery.UnaryServerInterceptor(
-				recovery.WithRecoveryHandler(recoveryHandler),
-			),
+type Option func(*GrpcSettings)
 
-			logInjectionUnaryServerInterceptor(),
+// WithIdempotencyStore makes retries of mutating requests sent with an idempotency-key header replay the original response
+func WithIdempotencyStore(store internal.IdempotencyStore) Option {
+	return func(settings *GrpcSettings) {
+		settings.idempotencyStore = store
+	}
+}
 
-			// add tracing, for example https://github.com/open-telemetry/opentelemetry-go-contrib/tree/main/instrumentation/google.golang.org/grpc
-		),
+// WithHealthServer registers hs as the health service, so that serving statuses can be set from outside the server
+func WithHealthServer(hs *health.Server) Option {
+	return func(settings *GrpcSettings) {
+		settings.healthServer = hs
+	}
+}
+
+// WithKeepalive sets how often idle connections are pinged and how long a missing ping ack is tolerated before the
+// connection is closed, and how often clients may ping the server
+func WithKeepalive(params keepalive.ServerParameters, policy keepalive.EnforcementPolicy) Option {
+	return func(settings *GrpcSettings) {
+		settings.keepaliveParams = params
+		settings.keepalivePolicy = policy
+	}
+}
+
+// WithAuthenticator requires callers to present a bearer jwt with the scope of the called method
+func WithAuthenticator(authenticator *auth.Authenticator) Option {
+	return func(settings *GrpcSettings) {
+		settings.authenticator = authenticator
+	}
+}
+
+// WithTLS serves tls with config, e.g. from NewTLSConfig. The identity of clients with a verified certificate is added
+// to the request context, see auth.ClientIdentityFromContext
+func WithTLS(config *tls.Config) Option {
+	return func(settings *GrpcSettings) {
+		settings.tlsConfig = config
+	}
+}
+
+// WithErrorSanitization replaces the message of internal errors with a generic text and the request id, so that e.g.
+// database errors are not leaked to callers
+func WithErrorSanitization(enabled bool) Option {
+	return func(settings *GrpcSettings) {
+		settings.sanitizeErrors = enabled
+	}
+}
+
+// WithStreamContext ends all open streams, e.g. Subscribe, when ctx is done. GracefulStop waits for open streams
+// to end, so ctx should be cancelled before it is called
+func WithStreamContext(ctx context.Context) Option {
+	return func(settings *GrpcSettings) {
+		settings.streamContext = ctx
+	}
+}
+
+// WithReflection sets whether the server reflection service is registered, so tools like grpcurl can describe the api
+func WithReflection(enabled bool) Option {
+	return func(settings *GrpcSettings) {
+		settings.reflection = enabled
+	}
+}
+
+func NewGrpc(configure func(s *grpc.Server, hs *health.Server), options ...Option) *grpc.Server {
+	settings := &GrpcSettings{
+		healthServer: health.NewServer(),
+		reflection:   true,
+
+		// ping idle connections so half-open ones are closed instead of keeping subscriptions around
+		keepaliveParams: keepalive.ServerParameters{
+			Time:    time.Minute,
+			Timeout: 20 * time.Second,
+		},
+		keepalivePolicy: keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		},
+	}
+
+	for _, option := range options {
+		option(settings)
+	}
+
+	// the request id is added first so that recovered panics and sanitized errors can refer to it
+	unaryInterceptors := []grpc.UnaryServerInterceptor{logInjectionUnaryServerInterceptor()}
+	streamInterceptors := []grpc.StreamServerInterceptor{logInjectionStreamServerInterceptor()}
 
-		grpc.ChainStreamInterceptor(
+	if settings.streamContext != nil {
+		streamInterceptors = append(streamInterceptors, streamContextServerInterceptor(settings.streamContext))
+	}
+
+	if settings.sanitizeErrors {
+		unaryInterceptors = append(unaryInterceptors, errorSanitizationUnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, errorSanitizationStreamServerInterceptor())
+	}
+
+	unaryInterceptors = append(unaryInterceptors,
 
-			// recover any uncaught panics
-			recovery.StreamServerInterceptor(
-				recovery.WithRecoveryHandler(recoveryHandler),
-			),
+		// recover any uncaught panics
+		recovery.UnaryServerInterceptor(
+			recovery.WithRecoveryHandlerContext(recoveryHandler),
+		),
+
+		// add tracing, for example https://github.com/open-telemetry/opentelemetry-go-contrib/tree/main/instrumentation/google.golang.org/grpc
+	)
 
-			logInjectionStreamServerInterceptor(),
+	streamInterceptors = append(streamInterceptors,
 
-			// add tracing, for example https://github.com/open-telemetry/opentelemetry-go-contrib/tree/main/instrumentation/google.golang.org/grpc
+		// recover any uncaught panics
+		recovery.StreamServerInterceptor(
+			recovery.WithRecoveryHandlerContext(recoveryHandler),
 		),
+
+		// add tracing, for example https://github.com/open-telemetry/opentelemetry-go-contrib/tree/main/instrumentation/google.golang.org/grpc
 	)
 
-	healthServer := health.NewServer()
+	if settings.tlsConfig != nil {
+		unaryInterceptors = append(unaryInterceptors, clientIdentityUnaryServerInterceptor())
+		streamInterceptors = append(streamInterceptors, clientIdentityStreamServerInterceptor())
+	}
+
+	// authenticate before anything else is done with the request, e.g. reserving an idempotency key
+	if settings.authenticator != nil {
+		unaryInterceptors = append(unaryInterceptors, authUnaryServerInterceptor(settings.authenticator))
+		streamInterceptors = append(streamInterceptors, authStreamServerInterceptor(settings.authenticator))
+	}
+
+	if settings.idempotencyStore != nil {
+		unaryInterceptors = append(unaryInterceptors, idempotencyUnaryServerInterceptor(settings.idempotencyStore))
+	}
+
+	serverOptions := []grpc.ServerOption{
+		grpc.KeepaliveParams(settings.keepaliveParams),
+		grpc.KeepaliveEnforcementPolicy(settings.keepalivePolicy),
+
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
+
+	if settings.tlsConfig != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(settings.tlsConfig)))
+	}
+
+	server := grpc.NewServer(serverOptions...)
+
+	healthServer := settings.healthServer
 	grpc_health_v1.RegisterHealthServer(server, healthServer)
 	healthServer.SetServingStatus("grpc.health.v1", grpc_health_v1.HealthCheckResponse_SERVING)
 
 	configure(server, healthServer)
 
+	if settings.reflection {
+		reflection.Register(server)
+	}
+
 	return server
 }
 
@@ -70,21 +215,36 @@ func logInjectionStreamServerInterceptor() grpc.StreamServerInterceptor {
 	}
 }
 
+// streamContextServerInterceptor cancels the context of streams when base is done
+func streamContextServerInterceptor(base context.Context) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, cancel := context.WithCancel(ss.Context())
+		defer cancel()
+		stop := context.AfterFunc(base, cancel)
+		defer stop()
+
+		return handler(srv, &middleware.WrappedServerStream{ServerStream: ss, WrappedContext: ctx})
+	}
+}
+
 func addLoggingAttrsToContext(ctx context.Context, endpoint string) context.Context {
+	requestId := uuid.New().String()
+
 	return logging.LogToContext(
-		ctx,
-		slog.String("request-id", uuid.New().String()),
+		context.WithValue(ctx, requestIdKey{}, requestId),
+		slog.String("request-id", requestId),
 		slog.String("endpoint", endpoint),
 	)
 }
 
-func recoveryHandler(p any) error {
+// recoveryHandler logs the recovered panic p, the panic value is not returned since it may hold anything
+func recoveryHandler(ctx context.Context, p any) error {
 	panicLogger := slog.With(slog.Any("panic", p))
-	panicLogger.Warn("panic triggered")
+	panicLogger.WarnContext(ctx, "panic triggered")
 
 	panicLogger.With(
 		slog.String("stack", string(debug.Stack())),
-	).Debug("panic debug information")
+	).DebugContext(ctx, "panic debug information")
 
-	return status.Errorf(codes.Internal, "panic triggered: %v", p)
+	return apierror.New(codes.Internal, apierror.ReasonInternal, "panic triggered")
 }
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/mocks"
+	"github.com/captainlettuce/users-microservice/internal/pubsub"
+	"github.com/captainlettuce/users-microservice/internal/server/service"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewGrpc_shutdownWithOpenStream(t *testing.T) {
+	var (
+		userId = uuid.New()
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		us     = mocks.NewMockUserService(t)
+	)
+
+	embedded, err := pubsub.StartEmbeddedNats(t.TempDir(), 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = embedded.Shutdown(context.Background()) })
+
+	ps, err := pubsub.NewNatsClient(logger, embedded.ClientURL(), pubsub.WithInProcessServer(embedded), pubsub.WithAsyncPublish(100, 10, 3))
+	require.NoError(t, err)
+
+	us.EXPECT().SubscribeToUserChanges(mock.Anything, mock.Anything).RunAndReturn(func(ctx context.Context, req types.SubscriptionRequest) (<-chan types.SubscriptionPayload, func() int, error) {
+		ch, err := ps.SubscribeToUserChanges(ctx, req)
+		return ch, func() int { return len(ch) }, err
+	})
+
+	streamCtx, cancelStreams := context.WithCancel(context.Background())
+	srv := NewGrpc(func(s *grpc.Server, _ *health.Server) {
+		generated.RegisterUsersServiceServer(s, service.NewUsersGrpc(us, nil, logger))
+	}, WithStreamContext(streamCtx))
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = srv.Serve(listen) }()
+
+	conn, err := grpc.NewClient(listen.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	stream, err := generated.NewUsersServiceClient(conn).Subscribe(context.Background(), &generated.SubscriptionRequest{})
+	require.NoError(t, err)
+
+	// the stream is open once it received a change
+	published := 0
+	publish := func() {
+		published++
+		require.NoError(t, ps.PublishUserChange(types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeUpdated}))
+	}
+	require.Eventually(t, func() bool {
+		publish()
+		_, err := stream.Recv()
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// queued when shutting down
+	for i := 0; i < 20; i++ {
+		publish()
+	}
+
+	// in the order of cmd/users
+	stopped := make(chan struct{})
+	go func() {
+		cancelStreams()
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("GracefulStop waited for the open stream")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, ps.GracefulShutdown(ctx))
+
+	t.Run("queued changes are published", func(t *testing.T) {
+		reader, err := pubsub.NewNatsClient(logger, embedded.ClientURL(), pubsub.WithInProcessServer(embedded))
+		require.NoError(t, err)
+		defer func() { _ = reader.GracefulShutdown(context.Background()) }()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch, err := reader.SubscribeToUserChanges(ctx, types.SubscriptionRequest{UserIds: []uuid.UUID{userId}, StartSequence: 1})
+		require.NoError(t, err)
+
+		var last uint64
+		timeout := time.After(5 * time.Second)
+		for received := 0; received < published; {
+			select {
+			case p := <-ch:
+				require.NoError(t, p.Err)
+				last = p.Sequence
+				received++
+			case <-timeout:
+				t.Fatalf("got %d of the %d published changes, last sequence %d", received, published, last)
+			}
+		}
+	})
+}
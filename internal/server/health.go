@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"log/slog"
+	"time"
+)
+
+// HealthCheck returns an error if a dependency is not usable
+type HealthCheck func(ctx context.Context) error
+
+type HealthSettings struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+type HealthOption func(*HealthSettings)
+
+// WithHealthInterval sets how often dependencies are checked and how long a single check may take
+func WithHealthInterval(interval, timeout time.Duration) HealthOption {
+	return func(settings *HealthSettings) {
+		settings.interval = interval
+		settings.timeout = timeout
+	}
+}
+
+type namedCheck struct {
+	name    string
+	check   HealthCheck
+	healthy bool
+}
+
+// HealthChecker periodically checks dependencies and reports them on a health server
+// each dependency is reported under its own name, the services depending on them are NOT_SERVING if any check fails
+type HealthChecker struct {
+	hs       *health.Server
+	logger   *slog.Logger
+	services []string
+	interval time.Duration
+	timeout  time.Duration
+
+	checks []*namedCheck
+
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewHealthChecker creates a checker reporting the overall status as the status of services on hs
+func NewHealthChecker(hs *health.Server, logger *slog.Logger, services []string, options ...HealthOption) *HealthChecker {
+	settings := &HealthSettings{
+		interval: 10 * time.Second,
+		timeout:  2 * time.Second,
+	}
+
+	for _, option := range options {
+		option(settings)
+	}
+
+	return &HealthChecker{
+		hs:       hs,
+		logger:   logger.With(slog.String("component", "health")),
+		services: services,
+		interval: settings.interval,
+		timeout:  settings.timeout,
+		trigger:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// AddCheck adds a dependency to check, it must be called before Start
+func (h *HealthChecker) AddCheck(name string, check HealthCheck) {
+	h.checks = append(h.checks, &namedCheck{name: name, check: check, healthy: true})
+}
+
+// Start runs the checks once before returning so the statuses are set, and then every interval until Shutdown
+func (h *HealthChecker) Start() {
+	h.run()
+
+	go func() {
+		defer close(h.done)
+
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-h.trigger:
+			case <-h.stop:
+				return
+			}
+			h.run()
+		}
+	}()
+}
+
+// Trigger runs the checks as soon as possible instead of waiting for the interval, e.g. when a connection is lost
+func (h *HealthChecker) Trigger() {
+	select {
+	case h.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Shutdown stops checking and reports all services as NOT_SERVING so no new requests are routed here
+func (h *HealthChecker) Shutdown(ctx context.Context) error {
+	close(h.stop)
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+	}
+
+	h.hs.Shutdown()
+	return nil
+}
+
+// run checks all dependencies, it is only called from Start and the goroutine it starts
+func (h *HealthChecker) run() {
+	overall := grpc_health_v1.HealthCheckResponse_SERVING
+	for _, c := range h.checks {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		err := c.check(ctx)
+		cancel()
+
+		status := grpc_health_v1.HealthCheckResponse_SERVING
+		if err != nil {
+			status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+			overall = status
+		}
+
+		// only log changes to not flood the logs while a dependency is down
+		switch {
+		case err != nil && c.healthy:
+			h.logger.With(slog.String("dependency", c.name), slog.Any("error", err)).Warn("Dependency health check failed")
+		case err == nil && !c.healthy:
+			h.logger.With(slog.String("dependency", c.name)).Info("Dependency healthy again")
+		}
+		c.healthy = err == nil
+
+		h.hs.SetServingStatus(c.name, status)
+	}
+
+	for _, service := range h.services {
+		h.hs.SetServingStatus(service, overall)
+	}
+}
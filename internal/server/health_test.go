@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var (
+		hs        = health.NewServer()
+		logger    = slog.New(slog.NewTextHandler(io.Discard, nil))
+		mongoDown atomic.Bool
+	)
+
+	checker := NewHealthChecker(hs, logger, []string{"users.v1", ""}, WithHealthInterval(time.Hour, time.Second))
+	checker.AddCheck("mongo", func(context.Context) error {
+		if mongoDown.Load() {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	checker.AddCheck("nats", func(context.Context) error { return nil })
+
+	servingStatus := func(service string) grpc_health_v1.HealthCheckResponse_ServingStatus {
+		resp, err := hs.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		return resp.GetStatus()
+	}
+
+	checker.Start()
+
+	t.Run("statuses are set when started", func(t *testing.T) {
+		for _, service := range []string{"users.v1", "", "mongo", "nats"} {
+			require.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, servingStatus(service), "service %q", service)
+		}
+	})
+
+	t.Run("failing dependency makes the services not serving", func(t *testing.T) {
+		mongoDown.Store(true)
+		checker.Trigger()
+
+		require.Eventually(t, func() bool {
+			return servingStatus("users.v1") == grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, servingStatus(""))
+		require.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, servingStatus("mongo"))
+		require.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, servingStatus("nats"))
+	})
+
+	t.Run("services are serving again when the dependency recovers", func(t *testing.T) {
+		mongoDown.Store(false)
+		checker.Trigger()
+
+		require.Eventually(t, func() bool {
+			return servingStatus("users.v1") == grpc_health_v1.HealthCheckResponse_SERVING
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, servingStatus("mongo"))
+	})
+
+	t.Run("nothing is serving after shutdown", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		require.NoError(t, checker.Shutdown(ctx))
+		require.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, servingStatus("users.v1"))
+		require.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, servingStatus("mongo"))
+	})
+}
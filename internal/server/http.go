@@ -0,0 +1,593 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"github.com/captainlettuce/users-microservice/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpStatusCodes maps grpc status codes to http status codes, anything else is 500
+var httpStatusCodes = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.Aborted:            http.StatusConflict,
+	codes.FailedPrecondition: http.StatusPreconditionFailed,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+func httpStatus(code codes.Code) int {
+	if c, ok := httpStatusCodes[code]; ok {
+		return c
+	}
+	return http.StatusInternalServerError
+}
+
+type HttpSettings struct {
+	maxBodySize    int64
+	authenticator  *auth.Authenticator
+	sanitizeErrors bool
+}
+
+type HttpOption func(*HttpSettings)
+
+// WithHttpMaxBodySize sets how many bytes a request body may have
+func WithHttpMaxBodySize(size int64) HttpOption {
+	return func(settings *HttpSettings) {
+		settings.maxBodySize = size
+	}
+}
+
+// WithHttpAuthenticator requires callers to send a bearer jwt in the Authorization header, with the scope needed for
+// the grpc method a route is served by
+func WithHttpAuthenticator(authenticator *auth.Authenticator) HttpOption {
+	return func(settings *HttpSettings) {
+		settings.authenticator = authenticator
+	}
+}
+
+// WithHttpErrorSanitization replaces the message of internal errors with a generic text and the request id
+func WithHttpErrorSanitization(enabled bool) HttpOption {
+	return func(settings *HttpSettings) {
+		settings.sanitizeErrors = enabled
+	}
+}
+
+type httpGateway struct {
+	users          generated.UsersServiceServer
+	logger         *slog.Logger
+	maxBodySize    int64
+	authenticator  *auth.Authenticator
+	sanitizeErrors bool
+}
+
+// NewHttpGateway exposes the users api as http/json, bodies and responses are the protojson encoding of the grpc messages
+// errors are returned as the json encoded grpc status with the matching http status code
+func NewHttpGateway(users generated.UsersServiceServer, logger *slog.Logger, options ...HttpOption) http.Handler {
+	settings := &HttpSettings{
+		maxBodySize: 1 << 20,
+	}
+
+	for _, option := range options {
+		option(settings)
+	}
+
+	g := &httpGateway{
+		users:          users,
+		logger:         logger.With(slog.String("component", "http.gateway")),
+		maxBodySize:    settings.maxBodySize,
+		authenticator:  settings.authenticator,
+		sanitizeErrors: settings.sanitizeErrors,
+	}
+
+	mux := http.NewServeMux()
+	g.handle(mux, "POST /v1/users", "add", g.add)
+	g.handle(mux, "GET /v1/users", "list", g.list)
+	g.handle(mux, "GET /v1/users/changes", "subscribe", g.subscribe)
+	g.handle(mux, "GET /v1/users/{id}", "get", g.get)
+	g.handle(mux, "PATCH /v1/users/{id}", "update", g.update)
+	g.handle(mux, "DELETE /v1/users/{id}", "delete", g.delete)
+
+	return mux
+}
+
+// handle serves pattern with handler, method is the grpc method handler calls
+func (g *httpGateway) handle(mux *http.ServeMux, pattern, method string, handler func(http.ResponseWriter, *http.Request) error) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(addLoggingAttrsToContext(r.Context(), pattern))
+		r.Body = http.MaxBytesReader(w, r.Body, g.maxBodySize)
+
+		defer func() {
+			if p := recover(); p != nil {
+				g.writeError(r.Context(), w, recoveryHandler(r.Context(), p))
+			}
+		}()
+
+		if g.authenticator != nil {
+			ctx, err := g.authenticator.Authorize(r.Context(), fullMethodName(method), r.Header.Get("Authorization"))
+			if err != nil {
+				g.writeError(r.Context(), w, err)
+				return
+			}
+			r = r.WithContext(ctx)
+		}
+
+		if err := handler(w, r); err != nil {
+			g.writeError(r.Context(), w, err)
+		}
+	})
+}
+
+func (g *httpGateway) add(w http.ResponseWriter, r *http.Request) error {
+	user := &generated.User{}
+	if _, err := readBody(r, user); err != nil {
+		return err
+	}
+
+	resp, err := g.users.Add(r.Context(), &generated.AddUserRequest{User: user})
+	if err != nil {
+		return err
+	}
+
+	return g.respond(r.Context(), w, http.StatusCreated, resp)
+}
+
+// update sets the fields in update_mask, or the fields present in the body if there is no update_mask
+func (g *httpGateway) update(w http.ResponseWriter, r *http.Request) error {
+	user := &generated.User{}
+	body, err := readBody(r, user)
+	if err != nil {
+		return err
+	}
+
+	paths := queryValues(r.URL.Query(), "update_mask")
+	if len(paths) == 0 {
+		if paths, err = updateMaskFromBody(body); err != nil {
+			return apierror.InvalidArgument("body", err)
+		}
+	}
+
+	resp, err := g.users.Update(r.Context(), &generated.UpdateUserRequest{
+		User:       user,
+		Filter:     &generated.SearchFilter{Ids: []string{r.PathValue("id")}},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+	})
+	if err != nil {
+		return err
+	}
+
+	return g.respond(r.Context(), w, http.StatusOK, resp)
+}
+
+func (g *httpGateway) delete(w http.ResponseWriter, r *http.Request) error {
+	resp, err := g.users.Delete(r.Context(), &generated.DeleteUserRequest{Id: r.PathValue("id")})
+	if err != nil {
+		return err
+	}
+
+	return g.respond(r.Context(), w, http.StatusOK, resp)
+}
+
+func (g *httpGateway) get(w http.ResponseWriter, r *http.Request) error {
+	resp, err := g.users.Get(r.Context(), &generated.GetUserRequest{Id: r.PathValue("id")})
+	if err != nil {
+		return err
+	}
+
+	return g.respond(r.Context(), w, http.StatusOK, resp)
+}
+
+func (g *httpGateway) list(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+
+	filter, err := searchFilterFromQuery(q)
+	if err != nil {
+		return err
+	}
+
+	req := &generated.ListUsersRequest{Filters: filter}
+	if q.Has("limit") || q.Has("offset") {
+		req.Paging = &generated.Paging{}
+		if req.Paging.Limit, err = queryInt(q, "limit"); err != nil {
+			return err
+		}
+		if req.Paging.Offset, err = queryInt(q, "offset"); err != nil {
+			return err
+		}
+	}
+
+	resp, err := g.users.List(r.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	return g.respond(r.Context(), w, http.StatusOK, resp)
+}
+
+// subscribe streams changes as server-sent events, with the change sequence as event id so that
+// reconnecting clients sending Last-Event-ID resume after the last change they received
+// errors after the stream has started are sent as an error event before the stream is closed
+func (g *httpGateway) subscribe(w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return apierror.New(codes.Internal, apierror.ReasonInternal, "streaming is not supported")
+	}
+
+	req, err := subscriptionRequestFromQuery(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	if id := r.Header.Get("Last-Event-ID"); id != "" && req.StartSequence == 0 && req.StartTime == nil {
+		sequence, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return apierror.InvalidArgument("Last-Event-ID", err)
+		}
+		req.StartSequence = sequence + 1
+	}
+
+	// the event stream starts once the subscription is open, errors before it are responded to as for other routes
+	stream := &sseStream{ctx: r.Context(), w: w, flusher: flusher}
+	if err := g.users.Subscribe(req, stream); err != nil {
+		if !stream.started {
+			return err
+		}
+		if g.sanitizeErrors {
+			err = sanitizeError(r.Context(), err)
+		}
+
+		b, _ := protojson.Marshal(status.Convert(err).Proto())
+		if err := stream.write("error", "", b); err != nil {
+			g.logger.With(slog.Any("error", err)).DebugContext(r.Context(), "Could not send error event to subscriber")
+		}
+	}
+
+	return nil
+}
+
+func (g *httpGateway) respond(ctx context.Context, w http.ResponseWriter, code int, resp proto.Message) error {
+	b, err := protojson.Marshal(resp)
+	if err != nil {
+		return apierror.New(codes.Internal, apierror.ReasonInternal, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(b); err != nil {
+		g.logger.With(slog.Any("error", err)).DebugContext(ctx, "Could not write http response")
+	}
+
+	return nil
+}
+
+func (g *httpGateway) writeError(ctx context.Context, w http.ResponseWriter, err error) {
+	if g.sanitizeErrors {
+		err = sanitizeError(ctx, err)
+	}
+	st := status.Convert(err)
+
+	b, err := protojson.Marshal(st.Proto())
+	if err != nil {
+		g.logger.With(slog.Any("error", err)).WarnContext(ctx, "Could not encode http error response")
+		b = []byte(`{"code":13,"message":"could not encode error"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st.Code()))
+	if _, err := w.Write(b); err != nil {
+		g.logger.With(slog.Any("error", err)).DebugContext(ctx, "Could not write http error response")
+	}
+}
+
+// readBody decodes the protojson request body into m and returns the raw body
+func readBody(r *http.Request, m proto.Message) ([]byte, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, apierror.InvalidArgument("body", err)
+	}
+
+	if err := protojson.Unmarshal(b, m); err != nil {
+		return nil, apierror.InvalidArgument("body", err)
+	}
+
+	return b, nil
+}
+
+// updateMaskFromBody returns the user field paths present in the json body
+func updateMaskFromBody(body []byte) ([]string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	descriptor := (&generated.User{}).ProtoReflect().Descriptor().Fields()
+
+	paths := make([]string, 0, len(fields))
+	for key := range fields {
+		fd := descriptor.ByJSONName(key)
+		if fd == nil {
+			fd = descriptor.ByName(protoreflect.Name(key))
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("unknown field %q", key)
+		}
+		paths = append(paths, string(fd.Name()))
+	}
+	slices.Sort(paths)
+
+	return paths, nil
+}
+
+// searchFilterFromQuery reads the filter fields from their proto names, time filters from created_before, created_after,
+// created_before_inclusive, created_after_inclusive, created_is_set and their updated_ equivalents
+func searchFilterFromQuery(q url.Values) (*generated.SearchFilter, error) {
+	filter := &generated.SearchFilter{
+		Ids:       queryValues(q, "ids"),
+		FirstName: queryString(q, "first_name"),
+		LastName:  queryString(q, "last_name"),
+		Nickname:  queryString(q, "nickname"),
+		Email:     queryString(q, "email"),
+		Countries: queryValues(q, "countries"),
+	}
+
+	var err error
+	if filter.Created, err = timeFilterFromQuery(q, "created"); err != nil {
+		return nil, err
+	}
+	if filter.Updated, err = timeFilterFromQuery(q, "updated"); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+func timeFilterFromQuery(q url.Values, field string) (*generated.TimeFilter, error) {
+	var (
+		filter = &generated.TimeFilter{}
+		err    error
+	)
+
+	if filter.Before, err = queryTime(q, field+"_before"); err != nil {
+		return nil, err
+	}
+	if filter.After, err = queryTime(q, field+"_after"); err != nil {
+		return nil, err
+	}
+	if filter.IsSet, err = queryBool(q, field+"_is_set"); err != nil {
+		return nil, err
+	}
+
+	beforeInclusive, err := queryBool(q, field+"_before_inclusive")
+	if err != nil {
+		return nil, err
+	}
+	afterInclusive, err := queryBool(q, field+"_after_inclusive")
+	if err != nil {
+		return nil, err
+	}
+	filter.BeforeInclusive = beforeInclusive != nil && *beforeInclusive
+	filter.AfterInclusive = afterInclusive != nil && *afterInclusive
+
+	if proto.Equal(filter, &generated.TimeFilter{}) {
+		return nil, nil
+	}
+
+	return filter, nil
+}
+
+// subscriptionRequestFromQuery reads user_ids, change_types, include_images, start_sequence, start_time and the
+// filter fields as for listing users
+func subscriptionRequestFromQuery(q url.Values) (*generated.SubscriptionRequest, error) {
+	filter, err := searchFilterFromQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if proto.Equal(filter, &generated.SearchFilter{}) {
+		filter = nil
+	}
+
+	params := &generated.SubscriptionParameters{
+		UserIds: queryValues(q, "user_ids"),
+		Filter:  filter,
+	}
+
+	for _, c := range queryValues(q, "change_types") {
+		change, ok := generated.UserChangeType_value[strings.ToUpper(c)]
+		if !ok {
+			return nil, apierror.InvalidArgument("change_types", fmt.Errorf("unknown change type %q", c))
+		}
+		params.ChangeTypes = append(params.ChangeTypes, generated.UserChangeType(change))
+	}
+
+	if q.Has("include_images") {
+		if params.IncludeImages, err = strconv.ParseBool(q.Get("include_images")); err != nil {
+			return nil, apierror.InvalidArgument("include_images", err)
+		}
+	}
+
+	req := &generated.SubscriptionRequest{Params: params}
+	if q.Has("start_sequence") {
+		if req.StartSequence, err = strconv.ParseUint(q.Get("start_sequence"), 10, 64); err != nil {
+			return nil, apierror.InvalidArgument("start_sequence", err)
+		}
+	}
+	if req.StartTime, err = queryTime(q, "start_time"); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// queryValues returns all values of key, comma separated values are split
+func queryValues(q url.Values, key string) []string {
+	var values []string
+	for _, v := range q[key] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+
+	return values
+}
+
+// queryString returns the value of key, nil if it is not in the query
+func queryString(q url.Values, key string) *string {
+	if !q.Has(key) {
+		return nil
+	}
+
+	v := q.Get(key)
+	return &v
+}
+
+func queryInt(q url.Values, key string) (int64, error) {
+	if !q.Has(key) {
+		return 0, nil
+	}
+
+	i, err := strconv.ParseInt(q.Get(key), 10, 64)
+	if err != nil {
+		return 0, apierror.InvalidArgument(key, err)
+	}
+
+	return i, nil
+}
+
+// queryBool parses the boolean value of key, nil if it is not in the query
+func queryBool(q url.Values, key string) (*bool, error) {
+	if !q.Has(key) {
+		return nil, nil
+	}
+
+	b, err := strconv.ParseBool(q.Get(key))
+	if err != nil {
+		return nil, apierror.InvalidArgument(key, err)
+	}
+
+	return &b, nil
+}
+
+// queryTime parses the RFC 3339 time of key, nil if it is not in the query
+func queryTime(q url.Values, key string) (*timestamppb.Timestamp, error) {
+	if !q.Has(key) {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, q.Get(key))
+	if err != nil {
+		return nil, apierror.InvalidArgument(key, err)
+	}
+
+	return timestamppb.New(t), nil
+}
+
+// sseStream sends subscription responses as server-sent events, the event id is the change sequence
+type sseStream struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+// start responds with the event stream headers, the status can't be changed afterwards
+func (s *sseStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("X-Accel-Buffering", "no")
+	s.w.WriteHeader(http.StatusOK)
+	s.flusher.Flush()
+}
+
+func (s *sseStream) Send(resp *generated.SubscriptionResponse) error {
+	b, err := protojson.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.GetHeartbeat() != nil {
+		return s.write("heartbeat", "", b)
+	}
+
+	var id string
+	if resp.GetSequence() != 0 {
+		id = strconv.FormatUint(resp.GetSequence(), 10)
+	}
+
+	return s.write("update", id, b)
+}
+
+// write sends a single event, data must not contain newlines which compact protojson never does
+func (s *sseStream) write(event, id string, data []byte) error {
+	s.start()
+
+	var buf bytes.Buffer
+	if id != "" {
+		buf.WriteString("id: " + id + "\n")
+	}
+	buf.WriteString("event: " + event + "\n")
+	buf.WriteString("data: ")
+	buf.Write(data)
+	buf.WriteString("\n\n")
+
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+
+	return nil
+}
+
+func (s *sseStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *sseStream) SendMsg(m any) error {
+	resp, ok := m.(*generated.SubscriptionResponse)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", m)
+	}
+	return s.Send(resp)
+}
+
+// SendHeader starts the event stream, the headers themselves and trailers have no equivalent
+func (s *sseStream) SendHeader(metadata.MD) error {
+	s.start()
+	return nil
+}
+
+func (s *sseStream) SetHeader(metadata.MD) error  { return nil }
+func (s *sseStream) SetTrailer(metadata.MD)       {}
+func (s *sseStream) RecvMsg(any) error            { return io.EOF }
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"github.com/captainlettuce/users-microservice/internal/mocks"
+	"github.com/captainlettuce/users-microservice/internal/server/service"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHttpGateway(t *testing.T) {
+	var (
+		userId    = uuid.New()
+		firstName = "first"
+		logger    = slog.New(slog.NewTextHandler(io.Discard, nil))
+		us        = mocks.NewMockUserService(t)
+	)
+
+	srv := httptest.NewServer(NewHttpGateway(service.NewUsersGrpc(us, nil, logger), logger))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		setup      func()
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:   "happy case add",
+			method: http.MethodPost,
+			path:   "/v1/users",
+			body:   `{"id":"` + userId.String() + `","firstName":"first"}`,
+			setup: func() {
+				us.EXPECT().Add(mock.Anything, mock.MatchedBy(func(u *types.User) bool {
+					return u.Id == userId && u.FirstName == firstName
+				})).Return(nil).Once()
+			},
+			wantStatus: http.StatusCreated,
+			wantBody:   `"firstName":"first"`,
+		},
+		{
+			name:   "happy case update with the fields in the body",
+			method: http.MethodPatch,
+			path:   "/v1/users/" + userId.String(),
+			body:   `{"first_name":"first"}`,
+			setup: func() {
+				us.EXPECT().UpdatePartial(mock.Anything, types.UserFilter{Ids: []uuid.UUID{userId}}, types.UpdateUserFields{FirstName: &firstName}).Return(nil).Once()
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "happy case update with update mask",
+			method: http.MethodPatch,
+			path:   "/v1/users/" + userId.String() + "?update_mask=first_name",
+			body:   `{"firstName":"first","lastName":"ignored"}`,
+			setup: func() {
+				us.EXPECT().UpdatePartial(mock.Anything, types.UserFilter{Ids: []uuid.UUID{userId}}, types.UpdateUserFields{FirstName: &firstName}).Return(nil).Once()
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "happy case delete",
+			method: http.MethodDelete,
+			path:   "/v1/users/" + userId.String(),
+			setup: func() {
+				us.EXPECT().Delete(mock.Anything, userId).Return(nil).Once()
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `{}`,
+		},
+		{
+			name:   "happy case list with filters",
+			method: http.MethodGet,
+			path:   "/v1/users?countries=DE,SE&first_name=first&created_after=2024-08-01T00:00:00Z&limit=10",
+			setup: func() {
+				us.EXPECT().List(mock.Anything, mock.MatchedBy(func(f types.UserFilter) bool {
+					return strings.Join(f.Countries, ",") == "DE,SE" && f.FirstName == firstName &&
+						f.Created != nil && f.Created.After != nil && f.Created.After.Equal(time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC))
+				}), types.Paging{Limit: 10}).Return([]types.User{{Id: userId, FirstName: firstName}}, 1, nil).Once()
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   userId.String(),
+		},
+		{
+			name:   "happy case list with inclusive and is set time filters",
+			method: http.MethodGet,
+			path:   "/v1/users?created_before=2024-08-01T00:00:00Z&created_before_inclusive=true&updated_is_set=false",
+			setup: func() {
+				us.EXPECT().List(mock.Anything, mock.MatchedBy(func(f types.UserFilter) bool {
+					return f.Created != nil && f.Created.Before != nil && f.Created.BeforeInclusive && !f.Created.AfterInclusive &&
+						f.Updated != nil && f.Updated.IsSet != nil && !*f.Updated.IsSet
+				}), types.Paging{}).Return(nil, 0, nil).Once()
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:   "sad case get not found",
+			method: http.MethodGet,
+			path:   "/v1/users/" + userId.String(),
+			setup: func() {
+				us.EXPECT().Get(mock.Anything, userId).Return(types.User{}, types.ErrNotFound).Once()
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   `"code":5,"message":"notfound","details":[{"@type":"type.googleapis.com/google.rpc.ErrorInfo","reason":"NOT_FOUND","domain":"users.v1"}]`,
+		},
+		{
+			name:       "sad case invalid body",
+			method:     http.MethodPost,
+			path:       "/v1/users",
+			body:       `{"unknown":true}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "sad case invalid query",
+			method:     http.MethodGet,
+			path:       "/v1/users?limit=ten",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `"fieldViolations":[{"field":"limit"`,
+		},
+		{
+			name:       "sad case invalid time filter option",
+			method:     http.MethodGet,
+			path:       "/v1/users?updated_is_set=maybe",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `"fieldViolations":[{"field":"updated_is_set"`,
+		},
+		{
+			name:       "sad case subscribe with invalid ids",
+			method:     http.MethodGet,
+			path:       "/v1/users/changes?user_ids=invalid",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `"code":3`,
+		},
+		{
+			name:       "sad case subscribe with invalid start time",
+			method:     http.MethodGet,
+			path:       "/v1/users/changes?start_time=yesterday",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `"field":"start_time"`,
+		},
+		{
+			name:       "sad case unknown field in update",
+			method:     http.MethodPatch,
+			path:       "/v1/users/" + userId.String(),
+			body:       `{"first_name":"first","unknown":true}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			require.NoError(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			require.Equal(t, tt.wantStatus, resp.StatusCode, string(b))
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			require.Contains(t, strings.ReplaceAll(string(b), " ", ""), tt.wantBody)
+		})
+	}
+
+	t.Run("subscribe streams server-sent events", func(t *testing.T) {
+		ch := make(chan types.SubscriptionPayload, 1)
+		ch <- types.SubscriptionPayload{UserId: userId, Change: types.UserChangeTypeUpdated, Sequence: 8}
+
+		// the stream resumes after the last event id the client received
+		us.EXPECT().SubscribeToUserChanges(mock.Anything, mock.MatchedBy(func(r types.SubscriptionRequest) bool {
+			return r.StartSequence == 8 && len(r.UserIds) == 1 && r.UserIds[0] == userId
+		})).Return(ch, func() int { return len(ch) }, nil).Once()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/v1/users/changes?user_ids="+userId.String(), nil)
+		require.NoError(t, err)
+		req.Header.Set("Last-Event-ID", "7")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		r := bufio.NewReader(resp.Body)
+		var lines []string
+		for len(lines) < 3 {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			lines = append(lines, strings.TrimSpace(line))
+		}
+
+		require.Equal(t, "id: 8", lines[0])
+		require.Equal(t, "event: update", lines[1])
+		require.True(t, strings.HasPrefix(lines[2], "data: "), lines[2])
+		require.Contains(t, lines[2], userId.String())
+	})
+
+	t.Run("subscribe errors after the stream started are sent as an event", func(t *testing.T) {
+		ch := make(chan types.SubscriptionPayload, 1)
+		ch <- types.SubscriptionPayload{Err: types.ErrSubscriberLagging}
+		us.EXPECT().SubscribeToUserChanges(mock.Anything, mock.Anything).Return(ch, func() int { return len(ch) }, nil).Once()
+
+		resp, err := http.Get(srv.URL + "/v1/users/changes")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(b), "event: error\ndata: ")
+		require.Contains(t, strings.ReplaceAll(string(b), " ", ""), `"code":8`)
+	})
+}
+
+func TestNewHttpGateway_errorSanitization(t *testing.T) {
+	var (
+		userId = uuid.New()
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		us     = mocks.NewMockUserService(t)
+	)
+
+	srv := httptest.NewServer(NewHttpGateway(service.NewUsersGrpc(us, nil, logger), logger, WithHttpErrorSanitization(true)))
+	defer srv.Close()
+
+	get := func(t *testing.T) (int, *spb.Status) {
+		resp, err := http.Get(srv.URL + "/v1/users/" + userId.String())
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		st := &spb.Status{}
+		require.NoError(t, protojson.Unmarshal(b, st))
+		return resp.StatusCode, st
+	}
+
+	t.Run("internal errors are replaced", func(t *testing.T) {
+		us.EXPECT().Get(mock.Anything, userId).Return(types.User{}, errors.New("connection refused to mongo-0.internal:27017")).Once()
+
+		code, st := get(t)
+		require.Equal(t, http.StatusInternalServerError, code)
+		require.NotContains(t, st.GetMessage(), "mongo")
+		require.Contains(t, st.GetMessage(), "request id ")
+		require.Equal(t, apierror.ReasonInternal, apierror.Reason(status.ErrorProto(st)))
+	})
+
+	t.Run("other errors are kept", func(t *testing.T) {
+		us.EXPECT().Get(mock.Anything, userId).Return(types.User{}, types.ErrNotFound).Once()
+
+		code, st := get(t)
+		require.Equal(t, http.StatusNotFound, code)
+		require.Equal(t, "not found", st.GetMessage())
+		require.Equal(t, apierror.ReasonNotFound, apierror.Reason(status.ErrorProto(st)))
+	})
+}
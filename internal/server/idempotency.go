@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"github.com/captainlettuce/users-microservice/internal/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"log/slog"
+	"strconv"
+)
+
+const (
+	idempotencyKeyHeader    = "idempotency-key"
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotentMethods are the mutating methods that can be safely retried using an idempotency key
+// registerWebhook is left out since its response holds the webhook secret, which must not be stored
+var idempotentMethods = map[string]bool{
+	fullMethodName("add"):           true,
+	fullMethodName("update"):        true,
+	fullMethodName("upsert"):        true,
+	fullMethodName("delete"):        true,
+	fullMethodName("deleteMany"):    true,
+	fullMethodName("deleteWebhook"): true,
+}
+
+// idempotencyUnaryServerInterceptor replays the original response for retried requests sent with the same idempotency-key
+// requests are only executed once per key, reusing a key with a different request is rejected
+// failed requests release the key so that they can be retried, keys are scoped to the caller and method
+func idempotencyUnaryServerInterceptor(store internal.IdempotencyStore) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		keys := metadata.ValueFromIncomingContext(ctx, idempotencyKeyHeader)
+		if !idempotentMethods[info.FullMethod] || len(keys) == 0 {
+			return handler(ctx, req)
+		}
+
+		key := keys[0]
+		if key == "" || len(key) > maxIdempotencyKeyLength {
+			return nil, apierror.InvalidArgument(idempotencyKeyHeader, fmt.Errorf("has to be between 1 and %d characters", maxIdempotencyKeyLength))
+		}
+
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		hash, err := requestHash(info.FullMethod, msg)
+		if err != nil {
+			return nil, apierror.New(codes.Internal, apierror.ReasonInternal, err.Error())
+		}
+
+		key = idempotencyStoreKey(ctx, info.FullMethod, key)
+
+		record, reserved, err := store.Reserve(ctx, key, hash)
+		if err != nil {
+			slog.With(slog.Any("error", err)).WarnContext(ctx, "Got unexpected error reserving idempotency key")
+			return nil, apierror.New(codes.Internal, apierror.ReasonInternal, err.Error())
+		}
+
+		if !reserved {
+			if !bytes.Equal(record.RequestHash, hash) {
+				return nil, apierror.New(codes.InvalidArgument, apierror.ReasonIdempotencyKeyReused, idempotencyKeyHeader+" has already been used for a different request")
+			}
+			if !record.Completed {
+				return nil, apierror.New(codes.Aborted, apierror.ReasonRequestInProgress, "a request with the same "+idempotencyKeyHeader+" is in progress")
+			}
+
+			return replayResponse(record.Response)
+		}
+
+		resp, err = handler(ctx, req)
+		if err != nil {
+			if releaseErr := store.Release(ctx, key); releaseErr != nil {
+				slog.With(slog.Any("error", releaseErr)).WarnContext(ctx, "Failed to release idempotency key")
+			}
+			return resp, err
+		}
+
+		b, err := marshalResponse(resp)
+		if err == nil {
+			err = store.Complete(ctx, key, b)
+		}
+		if err != nil {
+			slog.With(slog.Any("error", err)).WarnContext(ctx, "Failed to store response for idempotency key")
+			// not error-ing out here since the request actually was executed
+		}
+
+		return resp, nil
+	}
+}
+
+// idempotencyStoreKey scopes key to the caller and method, so that callers can't replay the responses of other callers
+// callers are identified by the subject of their token, otherwise by their client certificate
+func idempotencyStoreKey(ctx context.Context, method, key string) string {
+	var caller string
+	if claims, ok := auth.ClaimsFromContext(ctx); ok {
+		caller = claims.Subject
+	} else if identity, ok := auth.ClientIdentityFromContext(ctx); ok {
+		caller = identity.Name
+	}
+
+	// the quoted caller ends at its closing quote and methods contain no spaces, so scopes can't collide
+	return strconv.Quote(caller) + " " + method + " " + key
+}
+
+// requestHash identifies a request by its method and deterministically serialized content
+func requestHash(method string, req proto.Message) ([]byte, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write(b)
+
+	return h.Sum(nil), nil
+}
+
+// marshalResponse serializes a response along with its type so it can be replayed without knowing the type beforehand
+func marshalResponse(resp any) ([]byte, error) {
+	msg, ok := resp.(proto.Message)
+	if !ok {
+		return nil, apierror.New(codes.Internal, apierror.ReasonInternal, "response is not a protobuf message")
+	}
+
+	a, err := anypb.New(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(a)
+}
+
+func replayResponse(b []byte) (any, error) {
+	a := &anypb.Any{}
+	if err := proto.Unmarshal(b, a); err != nil {
+		return nil, apierror.New(codes.Internal, apierror.ReasonInternal, err.Error())
+	}
+
+	msg, err := a.UnmarshalNew()
+	if err != nil {
+		return nil, apierror.New(codes.Internal, apierror.ReasonInternal, err.Error())
+	}
+
+	return msg, nil
+}
+
+func fullMethodName(method string) string {
+	return "/" + generated.UsersService_ServiceDesc.ServiceName + "/" + method
+}
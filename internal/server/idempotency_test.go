@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/auth"
+	"github.com/captainlettuce/users-microservice/internal/mocks"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"testing"
+)
+
+func Test_idempotencyUnaryServerInterceptor(t *testing.T) {
+	var (
+		key      = "test-key"
+		method   = fullMethodName("add")
+		req      = &generated.AddUserRequest{User: &generated.User{FirstName: "first"}}
+		otherReq = &generated.AddUserRequest{User: &generated.User{FirstName: "other"}}
+		resp     = &generated.AddUserResponse{User: &generated.User{Id: "b9e52eb0-5bb1-4d34-a8b8-802f8f5b7a36"}}
+	)
+
+	hash, err := requestHash(method, req)
+	require.NoError(t, err)
+
+	otherHash, err := requestHash(method, otherReq)
+	require.NoError(t, err)
+
+	storedResp, err := marshalResponse(resp)
+	require.NoError(t, err)
+
+	var (
+		callerClaims   = &auth.Claims{Subject: "caller"}
+		storeKey       = idempotencyStoreKey(context.Background(), method, key)
+		callerStoreKey = idempotencyStoreKey(auth.ContextWithClaims(context.Background(), *callerClaims), method, key)
+	)
+	require.NotEqual(t, storeKey, callerStoreKey, "keys of callers should not collide")
+
+	tests := []struct {
+		name        string
+		method      string
+		key         *string
+		claims      *auth.Claims
+		setupStore  func(m *mocks.MockIdempotencyStore)
+		handlerErr  error
+		wantHandler bool
+		wantCode    codes.Code
+	}{
+		{
+			name:        "no key executes the request",
+			method:      method,
+			wantHandler: true,
+		},
+		{
+			name:        "non-mutating method ignores the key",
+			method:      fullMethodName("list"),
+			key:         &key,
+			wantHandler: true,
+		},
+		{
+			name:        "registering webhooks ignores the key",
+			method:      fullMethodName("registerWebhook"),
+			key:         &key,
+			wantHandler: true,
+		},
+		{
+			name:   "keys are scoped to the caller",
+			method: method,
+			key:    &key,
+			claims: callerClaims,
+			setupStore: func(m *mocks.MockIdempotencyStore) {
+				m.EXPECT().Reserve(mock.Anything, callerStoreKey, hash).Return(types.IdempotencyRecord{}, true, nil)
+				m.EXPECT().Complete(mock.Anything, callerStoreKey, storedResp).Return(nil)
+			},
+			wantHandler: true,
+		},
+		{
+			name:   "first request is executed and stored",
+			method: method,
+			key:    &key,
+			setupStore: func(m *mocks.MockIdempotencyStore) {
+				m.EXPECT().Reserve(mock.Anything, storeKey, hash).Return(types.IdempotencyRecord{}, true, nil)
+				m.EXPECT().Complete(mock.Anything, storeKey, storedResp).Return(nil)
+			},
+			wantHandler: true,
+		},
+		{
+			name:   "failed request releases the key",
+			method: method,
+			key:    &key,
+			setupStore: func(m *mocks.MockIdempotencyStore) {
+				m.EXPECT().Reserve(mock.Anything, storeKey, hash).Return(types.IdempotencyRecord{}, true, nil)
+				m.EXPECT().Release(mock.Anything, storeKey).Return(nil)
+			},
+			handlerErr:  status.Error(codes.Internal, "error"),
+			wantHandler: true,
+			wantCode:    codes.Internal,
+		},
+		{
+			name:   "retry replays the stored response",
+			method: method,
+			key:    &key,
+			setupStore: func(m *mocks.MockIdempotencyStore) {
+				m.EXPECT().Reserve(mock.Anything, storeKey, hash).Return(types.IdempotencyRecord{Key: storeKey, RequestHash: hash, Response: storedResp, Completed: true}, false, nil)
+			},
+		},
+		{
+			name:   "retry while in progress is aborted",
+			method: method,
+			key:    &key,
+			setupStore: func(m *mocks.MockIdempotencyStore) {
+				m.EXPECT().Reserve(mock.Anything, storeKey, hash).Return(types.IdempotencyRecord{Key: storeKey, RequestHash: hash}, false, nil)
+			},
+			wantCode: codes.Aborted,
+		},
+		{
+			name:   "key reused for another request is rejected",
+			method: method,
+			key:    &key,
+			setupStore: func(m *mocks.MockIdempotencyStore) {
+				m.EXPECT().Reserve(mock.Anything, storeKey, hash).Return(types.IdempotencyRecord{Key: storeKey, RequestHash: otherHash, Completed: true}, false, nil)
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:   "store error",
+			method: method,
+			key:    &key,
+			setupStore: func(m *mocks.MockIdempotencyStore) {
+				m.EXPECT().Reserve(mock.Anything, storeKey, hash).Return(types.IdempotencyRecord{}, false, errors.New("error"))
+			},
+			wantCode: codes.Internal,
+		},
+		{
+			name:     "empty key is rejected",
+			method:   method,
+			key:      new(string),
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := mocks.NewMockIdempotencyStore(t)
+			if tt.setupStore != nil {
+				tt.setupStore(store)
+			}
+
+			ctx := context.Background()
+			if tt.claims != nil {
+				ctx = auth.ContextWithClaims(ctx, *tt.claims)
+			}
+			if tt.key != nil {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(idempotencyKeyHeader, *tt.key))
+			}
+
+			handlerCalled := false
+			handler := func(ctx context.Context, req any) (any, error) {
+				handlerCalled = true
+				if tt.handlerErr != nil {
+					return nil, tt.handlerErr
+				}
+				return resp, nil
+			}
+
+			got, err := idempotencyUnaryServerInterceptor(store)(ctx, req, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+			require.Equal(t, tt.wantHandler, handlerCalled, "unexpected handler execution")
+
+			if tt.wantCode != codes.OK {
+				require.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+
+			require.NoError(t, err)
+			require.True(t, cmp.Equal(resp, got.(proto.Message), protocmp.Transform()), "unexpected response")
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"github.com/captainlettuce/users-microservice/internal/auth"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+const (
+	microServiceName    = "users"
+	microServiceVersion = "1.0.0"
+
+	// HeaderErrorReason holds the reason of the ErrorInfo of an error response, see apierror
+	HeaderErrorReason = "Users-Error-Reason"
+)
+
+type MicroSettings struct {
+	subjectPrefix  string
+	requestTimeout time.Duration
+	sanitizeErrors bool
+	authenticator  *auth.Authenticator
+}
+
+type MicroOption func(*MicroSettings)
+
+// WithMicroSubjectPrefix sets the subject prefix of the endpoints, it must not overlap the subjects changes are published on
+func WithMicroSubjectPrefix(prefix string) MicroOption {
+	return func(settings *MicroSettings) {
+		settings.subjectPrefix = prefix
+	}
+}
+
+// WithMicroRequestTimeout sets how long a request may take before it is cancelled
+func WithMicroRequestTimeout(timeout time.Duration) MicroOption {
+	return func(settings *MicroSettings) {
+		settings.requestTimeout = timeout
+	}
+}
+
+// WithMicroErrorSanitization replaces the message of internal errors with a generic text and the request id
+func WithMicroErrorSanitization(enabled bool) MicroOption {
+	return func(settings *MicroSettings) {
+		settings.sanitizeErrors = enabled
+	}
+}
+
+// WithMicroAuthenticator requires requests to carry a bearer jwt in the Authorization header, with the scope needed for
+// the grpc method an endpoint calls
+func WithMicroAuthenticator(authenticator *auth.Authenticator) MicroOption {
+	return func(settings *MicroSettings) {
+		settings.authenticator = authenticator
+	}
+}
+
+// NewNatsMicro exposes the users api as a nats micro service with protobuf requests and responses
+// replicas share a queue group, and the service answers the micro framework's PING, INFO and STATS requests
+func NewNatsMicro(nc *nats.Conn, users generated.UsersServiceServer, logger *slog.Logger, options ...MicroOption) (micro.Service, error) {
+	settings := &MicroSettings{
+		subjectPrefix:  "api.users.v1",
+		requestTimeout: 10 * time.Second,
+	}
+
+	for _, option := range options {
+		option(settings)
+	}
+
+	logger = logger.With(slog.String("component", "nats.micro"))
+
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:        microServiceName,
+		Version:     microServiceVersion,
+		Description: "users api over nats request/reply, protobuf payloads as in users.v1.usersService",
+		ErrorHandler: func(_ micro.Service, err *micro.NATSError) {
+			logger.With(slog.String("subject", err.Subject), slog.String("error", err.Description)).Warn("Got asynchronous nats micro error")
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create nats micro service: %w", err)
+	}
+
+	group := svc.AddGroup(settings.subjectPrefix)
+	endpoints := []struct {
+		name    string
+		handler micro.Handler
+		meta    map[string]string
+	}{
+		{"add", microHandler(logger, settings, "add", users.Add), microMetadata[*generated.AddUserRequest, *generated.AddUserResponse]()},
+		{"update", microHandler(logger, settings, "update", users.Update), microMetadata[*generated.UpdateUserRequest, *generated.UpdateUserResponse]()},
+		{"delete", microHandler(logger, settings, "delete", users.Delete), microMetadata[*generated.DeleteUserRequest, *generated.DeleteUserResponse]()},
+		{"list", microHandler(logger, settings, "list", users.List), microMetadata[*generated.ListUsersRequest, *generated.ListUsersResponse]()},
+		{"get", microHandler(logger, settings, "get", users.Get), microMetadata[*generated.GetUserRequest, *generated.GetUserResponse]()},
+	}
+
+	for _, e := range endpoints {
+		if err := group.AddEndpoint(e.name, e.handler, micro.WithEndpointMetadata(e.meta)); err != nil {
+			_ = svc.Stop()
+			return nil, fmt.Errorf("could not add nats micro endpoint %s: %w", e.name, err)
+		}
+	}
+
+	return svc, nil
+}
+
+// microHandler decodes the protobuf request, calls the grpc method named method and responds with its protobuf response
+// errors are returned as micro service errors with the status message as description
+func microHandler[Req any, ReqPtr interface {
+	*Req
+	proto.Message
+}, Resp proto.Message](logger *slog.Logger, settings *MicroSettings, method string, call func(context.Context, ReqPtr) (Resp, error)) micro.Handler {
+	return micro.HandlerFunc(func(r micro.Request) {
+		ctx, cancel := context.WithTimeout(addLoggingAttrsToContext(context.Background(), r.Subject()), settings.requestTimeout)
+		defer cancel()
+
+		respond := func(resp proto.Message, err error) {
+			if err != nil && settings.sanitizeErrors {
+				err = sanitizeError(ctx, err)
+			}
+			respondMicro(ctx, logger, r, resp, err)
+		}
+
+		defer func() {
+			if p := recover(); p != nil {
+				respond(nil, recoveryHandler(ctx, p))
+			}
+		}()
+
+		if settings.authenticator != nil {
+			var err error
+			if ctx, err = settings.authenticator.Authorize(ctx, fullMethodName(method), r.Headers().Get("Authorization")); err != nil {
+				respond(nil, err)
+				return
+			}
+		}
+
+		req := ReqPtr(new(Req))
+		if err := proto.Unmarshal(r.Data(), req); err != nil {
+			respond(nil, apierror.New(codes.InvalidArgument, apierror.ReasonInvalidArgument, "invalid request: "+err.Error()))
+			return
+		}
+
+		resp, err := call(ctx, req)
+		respond(resp, err)
+	})
+}
+
+func respondMicro(ctx context.Context, logger *slog.Logger, r micro.Request, resp proto.Message, err error) {
+	if err != nil {
+		st := status.Convert(err)
+		err = r.Error(microErrorCode(st.Code()), st.Message(), nil, micro.WithHeaders(micro.Headers{HeaderErrorReason: {apierror.Reason(err)}}))
+	} else {
+		var b []byte
+		if b, err = proto.Marshal(resp); err == nil {
+			err = r.Respond(b)
+		}
+	}
+
+	if err != nil {
+		logger.With(slog.Any("error", err)).WarnContext(ctx, "Could not respond to nats micro request")
+	}
+}
+
+// microErrorCode is the http style error code used by nats micro services for code
+func microErrorCode(code codes.Code) string {
+	return strconv.Itoa(httpStatus(code))
+}
+
+// microMetadata describes the protobuf messages of an endpoint for discovery
+func microMetadata[Req, Resp proto.Message]() map[string]string {
+	var (
+		req  Req
+		resp Resp
+	)
+
+	return map[string]string{
+		"request":  string(req.ProtoReflect().Descriptor().FullName()),
+		"response": string(resp.ProtoReflect().Descriptor().FullName()),
+	}
+}
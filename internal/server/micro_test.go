@@ -0,0 +1,245 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/auth"
+	"github.com/captainlettuce/users-microservice/internal/mocks"
+	"github.com/captainlettuce/users-microservice/internal/server/service"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/google/uuid"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewNatsMicro(t *testing.T) {
+	var (
+		userId = uuid.New()
+		user   = types.User{Id: userId, FirstName: "first"}
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		us     = mocks.NewMockUserService(t)
+		nc     = testNatsConn(t)
+	)
+
+	svc, err := NewNatsMicro(nc, service.NewUsersGrpc(us, nil, logger), logger, WithMicroSubjectPrefix("test.users"))
+	require.NoError(t, err)
+	defer func() { _ = svc.Stop() }()
+
+	tests := []struct {
+		name      string
+		subject   string
+		req       proto.Message
+		setup     func()
+		resp      proto.Message
+		wantResp  proto.Message
+		wantError string
+	}{
+		{
+			name:    "happy case get",
+			subject: "test.users.get",
+			req:     &generated.GetUserRequest{Id: userId.String()},
+			setup: func() {
+				us.EXPECT().Get(mock.Anything, userId).Return(user, nil).Once()
+			},
+			resp:     &generated.GetUserResponse{},
+			wantResp: &generated.GetUserResponse{User: user.Proto()},
+		},
+		{
+			name:    "happy case delete",
+			subject: "test.users.delete",
+			req:     &generated.DeleteUserRequest{Id: userId.String()},
+			setup: func() {
+				us.EXPECT().Delete(mock.Anything, userId).Return(nil).Once()
+			},
+			resp:     &generated.DeleteUserResponse{},
+			wantResp: &generated.DeleteUserResponse{},
+		},
+		{
+			name:    "sad case not found",
+			subject: "test.users.get",
+			req:     &generated.GetUserRequest{Id: userId.String()},
+			setup: func() {
+				us.EXPECT().Get(mock.Anything, userId).Return(types.User{}, types.ErrNotFound).Once()
+			},
+			wantError: "404",
+		},
+		{
+			name:      "sad case invalid argument",
+			subject:   "test.users.delete",
+			req:       &generated.DeleteUserRequest{Id: "invalid"},
+			wantError: "400",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+
+			b, err := proto.Marshal(tt.req)
+			require.NoError(t, err)
+
+			msg, err := nc.Request(tt.subject, b, 5*time.Second)
+			require.NoError(t, err)
+
+			if tt.wantError != "" {
+				require.Equal(t, tt.wantError, msg.Header.Get(micro.ErrorCodeHeader))
+				require.NotEmpty(t, msg.Header.Get(micro.ErrorHeader))
+				return
+			}
+
+			require.Empty(t, msg.Header.Get(micro.ErrorCodeHeader), msg.Header.Get(micro.ErrorHeader))
+			require.NoError(t, proto.Unmarshal(msg.Data, tt.resp))
+			require.True(t, proto.Equal(tt.wantResp, tt.resp), "got %v", tt.resp)
+		})
+	}
+
+	t.Run("malformed request", func(t *testing.T) {
+		msg, err := nc.Request("test.users.add", []byte("not protobuf"), 5*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, "400", msg.Header.Get(micro.ErrorCodeHeader))
+	})
+
+	t.Run("service is discoverable", func(t *testing.T) {
+		subject, err := micro.ControlSubject(micro.InfoVerb, microServiceName, "")
+		require.NoError(t, err)
+
+		msg, err := nc.Request(subject, nil, 5*time.Second)
+		require.NoError(t, err)
+
+		var info micro.Info
+		require.NoError(t, json.Unmarshal(msg.Data, &info))
+		require.Equal(t, microServiceVersion, info.Version)
+		require.Len(t, info.Endpoints, 5)
+		for _, e := range info.Endpoints {
+			require.NotEmpty(t, e.Metadata["request"], "endpoint %s has no request type", e.Name)
+		}
+	})
+
+	t.Run("requests are counted in stats", func(t *testing.T) {
+		var requests, errs int
+		for _, e := range svc.Stats().Endpoints {
+			requests += e.NumRequests
+			errs += e.NumErrors
+		}
+		require.Equal(t, 5, requests)
+		require.Equal(t, 3, errs)
+	})
+}
+
+func testNatsConn(t *testing.T) *nats.Conn {
+	t.Helper()
+
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: natsserver.RANDOM_PORT, NoLog: true, NoSigs: true})
+	require.NoError(t, err)
+	go ns.Start()
+	require.True(t, ns.ReadyForConnections(5*time.Second), "nats server not ready")
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+func TestNewNatsMicro_authentication(t *testing.T) {
+	var (
+		userId        = uuid.New()
+		logger        = slog.New(slog.NewTextHandler(io.Discard, nil))
+		us            = mocks.NewMockUserService(t)
+		nc            = testNatsConn(t)
+		authenticator = testAuthenticator(t)
+	)
+
+	svc, err := NewNatsMicro(nc, service.NewUsersGrpc(us, nil, logger), logger, WithMicroSubjectPrefix("test.users"), WithMicroAuthenticator(authenticator.Authenticator))
+	require.NoError(t, err)
+	defer func() { _ = svc.Stop() }()
+
+	b, err := proto.Marshal(&generated.DeleteUserRequest{Id: userId.String()})
+	require.NoError(t, err)
+
+	request := func(authorization string) *nats.Msg {
+		req := nats.NewMsg("test.users.delete")
+		req.Data = b
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		msg, err := nc.RequestMsg(req, 5*time.Second)
+		require.NoError(t, err)
+		return msg
+	}
+
+	t.Run("requests without a token are rejected", func(t *testing.T) {
+		require.Equal(t, "401", request("").Header.Get(micro.ErrorCodeHeader))
+	})
+
+	t.Run("requests without the scope are rejected", func(t *testing.T) {
+		require.Equal(t, "403", request("Bearer "+authenticator.token(t, "users:read")).Header.Get(micro.ErrorCodeHeader))
+	})
+
+	t.Run("authorized requests are served", func(t *testing.T) {
+		us.EXPECT().Delete(mock.Anything, userId).Return(nil).Once()
+
+		msg := request("Bearer " + authenticator.token(t, "users:write"))
+		require.Empty(t, msg.Header.Get(micro.ErrorCodeHeader), msg.Header.Get(micro.ErrorHeader))
+	})
+}
+
+type testAuth struct {
+	*auth.Authenticator
+	signer jose.Signer
+}
+
+// testAuthenticator returns an authenticator trusting a generated key, tokens signed with it are made with token
+func testAuthenticator(t *testing.T) testAuth {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	keys, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: public, KeyID: "test", Algorithm: string(jose.EdDSA), Use: "sig"}}})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, keys, 0o600))
+
+	authenticator, err := auth.NewAuthenticator(path, slog.New(slog.NewTextHandler(io.Discard, nil)), auth.WithIssuer("https://issuer.example"), auth.WithAudience("users"))
+	require.NoError(t, err)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.EdDSA, Key: private}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	require.NoError(t, err)
+
+	return testAuth{Authenticator: authenticator, signer: signer}
+}
+
+// token is a bearer token with scope that expires in a minute
+func (a testAuth) token(t *testing.T, scope string) string {
+	t.Helper()
+
+	token, err := jwt.Signed(a.signer).Claims(map[string]any{
+		"iss":   "https://issuer.example",
+		"sub":   "test",
+		"aud":   "users",
+		"scope": scope,
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}).Serialize()
+	require.NoError(t, err)
+
+	return token
+}
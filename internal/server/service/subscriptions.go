@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errSubscriptionTerminated is the cancel cause of a subscription terminated through the admin rpc
+var errSubscriptionTerminated = errors.New("subscription terminated by an administrator")
+
+// subscription is an open Subscribe stream
+type subscription struct {
+	id        uuid.UUID
+	peer      string
+	request   *generated.SubscriptionRequest
+	startedAt time.Time
+	lag       func() int
+	cancel    context.CancelCauseFunc
+
+	delivered    atomic.Uint64
+	dropped      atomic.Uint64
+	lastSequence atomic.Uint64
+}
+
+// sent records that p was sent to the client
+func (s *subscription) sent(p types.SubscriptionPayload) {
+	s.delivered.Add(1)
+	s.dropped.Store(p.Dropped)
+	s.lastSequence.Store(p.Sequence)
+}
+
+func (s *subscription) Proto() *generated.ActiveSubscription {
+	return &generated.ActiveSubscription{
+		Id:           s.id.String(),
+		Peer:         s.peer,
+		Request:      s.request,
+		StartedAt:    timestamppb.New(s.startedAt),
+		Delivered:    s.delivered.Load(),
+		Dropped:      s.dropped.Load(),
+		Lag:          uint64(s.lag()),
+		LastSequence: s.lastSequence.Load(),
+	}
+}
+
+// subscriptionRegistry keeps track of the open Subscribe streams of this replica
+type subscriptionRegistry struct {
+	mu            sync.RWMutex
+	subscriptions map[uuid.UUID]*subscription
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	return &subscriptionRegistry{
+		subscriptions: make(map[uuid.UUID]*subscription),
+	}
+}
+
+// add registers a subscription with lag reporting its buffered changes, the returned context is cancelled when it is
+// terminated, remove must be called with the subscription when the stream ends
+func (r *subscriptionRegistry) add(ctx context.Context, req *generated.SubscriptionRequest, lag func() int) (context.Context, *subscription) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	sub := &subscription{
+		id:        uuid.New(),
+		request:   req,
+		startedAt: time.Now(),
+		lag:       lag,
+		cancel:    cancel,
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		sub.peer = p.Addr.String()
+	}
+
+	r.mu.Lock()
+	r.subscriptions[sub.id] = sub
+	r.mu.Unlock()
+
+	return ctx, sub
+}
+
+func (r *subscriptionRegistry) remove(sub *subscription) {
+	r.mu.Lock()
+	delete(r.subscriptions, sub.id)
+	r.mu.Unlock()
+
+	sub.cancel(nil)
+}
+
+// list returns the open subscriptions, oldest first
+func (r *subscriptionRegistry) list() []*subscription {
+	r.mu.RLock()
+	subs := make([]*subscription, 0, len(r.subscriptions))
+	for _, sub := range r.subscriptions {
+		subs = append(subs, sub)
+	}
+	r.mu.RUnlock()
+
+	slices.SortFunc(subs, func(a, b *subscription) int {
+		return a.startedAt.Compare(b.startedAt)
+	})
+
+	return subs
+}
+
+// terminate ends the stream of the subscription with cause, returns false if there is no such subscription
+func (r *subscriptionRegistry) terminate(id uuid.UUID, cause error) bool {
+	r.mu.RLock()
+	sub, ok := r.subscriptions[id]
+	r.mu.RUnlock()
+
+	if ok {
+		sub.cancel(cause)
+	}
+
+	return ok
+}
+
+func (u *usersGrpc) ListSubscriptions(_ context.Context, _ *generated.ListSubscriptionsRequest) (*generated.ListSubscriptionsResponse, error) {
+	resp := &generated.ListSubscriptionsResponse{}
+	for _, sub := range u.subscriptions.list() {
+		resp.Subscriptions = append(resp.Subscriptions, sub.Proto())
+	}
+
+	return resp, nil
+}
+
+func (u *usersGrpc) TerminateSubscription(ctx context.Context, req *generated.TerminateSubscriptionRequest) (*generated.TerminateSubscriptionResponse, error) {
+	id, err := uuid.Parse(req.GetId())
+	if err != nil {
+		return nil, apierror.InvalidArgument("id", err)
+	}
+
+	cause := errSubscriptionTerminated
+	if req.GetReason() != "" {
+		cause = errors.New(req.GetReason())
+	}
+
+	if !u.subscriptions.terminate(id, cause) {
+		return nil, apierror.New(codes.NotFound, apierror.ReasonNotFound, "no such subscription on this replica")
+	}
+
+	u.logger.With(slog.Any("subscriptionId", id), slog.String("reason", cause.Error())).InfoContext(ctx, "Terminated subscription")
+
+	return &generated.TerminateSubscriptionResponse{}, nil
+}
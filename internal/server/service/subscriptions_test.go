@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/generated/generated_mocks"
+	"github.com/captainlettuce/users-microservice/internal/mocks"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_usersGrpc_subscriptionAdmin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4321}})
+
+	ms := mocks.NewMockUserService(t)
+	mgrpcServer := generated_mocks.NewMockUsersService_SubscribeServer(t)
+	ch := make(chan types.SubscriptionPayload, 4)
+
+	mgrpcServer.EXPECT().Context().Return(ctx)
+	mgrpcServer.EXPECT().SendHeader(mock.Anything).Return(nil).Once()
+	mgrpcServer.EXPECT().Send(mock.Anything).Return(nil)
+	ms.EXPECT().SubscribeToUserChanges(ctx, mock.Anything).Return(ch, func() int { return len(ch) }, nil)
+
+	u := newTestService(ms)
+	req := &generated.SubscriptionRequest{StartSequence: 1}
+
+	done := make(chan error)
+	go func() {
+		done <- u.Subscribe(req, mgrpcServer)
+	}()
+
+	ch <- types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeCreated, Sequence: 1}
+	ch <- types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeCreated, Sequence: 5, Dropped: 3}
+
+	var active *generated.ActiveSubscription
+	require.Eventually(t, func() bool {
+		resp, err := u.ListSubscriptions(context.Background(), &generated.ListSubscriptionsRequest{})
+		require.NoError(t, err)
+		if len(resp.GetSubscriptions()) != 1 {
+			return false
+		}
+		active = resp.GetSubscriptions()[0]
+		return active.GetDelivered() == 2
+	}, 5*time.Second, 10*time.Millisecond, "subscription not listed with its delivered changes")
+
+	require.Equal(t, "10.0.0.1:4321", active.GetPeer())
+	require.Equal(t, uint64(1), active.GetRequest().GetStartSequence())
+	require.Equal(t, uint64(3), active.GetDropped())
+	require.Equal(t, uint64(5), active.GetLastSequence())
+	require.Zero(t, active.GetLag())
+	require.NotNil(t, active.GetStartedAt())
+
+	t.Run("sad case terminate invalid id", func(t *testing.T) {
+		_, err := u.TerminateSubscription(context.Background(), &generated.TerminateSubscriptionRequest{Id: "invalid"})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("sad case terminate unknown subscription", func(t *testing.T) {
+		_, err := u.TerminateSubscription(context.Background(), &generated.TerminateSubscriptionRequest{Id: uuid.NewString()})
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("happy case terminate", func(t *testing.T) {
+		_, err := u.TerminateSubscription(context.Background(), &generated.TerminateSubscriptionRequest{Id: active.GetId(), Reason: "maintenance"})
+		require.NoError(t, err)
+
+		select {
+		case err := <-done:
+			st, _ := status.FromError(err)
+			require.Equal(t, codes.Aborted, st.Code())
+			require.Equal(t, "maintenance", st.Message())
+		case <-time.After(5 * time.Second):
+			t.Fatal("terminated subscription did not end")
+		}
+
+		resp, err := u.ListSubscriptions(context.Background(), &generated.ListSubscriptionsRequest{})
+		require.NoError(t, err)
+		require.Empty(t, resp.GetSubscriptions())
+	})
+}
@@ -3,46 +3,70 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/captainlettuce/field_mask"
 	"github.com/captainlettuce/users-microservice/generated"
 	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
 	"github.com/captainlettuce/users-microservice/internal/types"
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"log/slog"
+	"time"
 )
 
+type Settings struct {
+	heartbeatInterval time.Duration
+}
+
+type Option func(*Settings)
+
+// WithHeartbeatInterval sets how long a subscription stream may be idle before a heartbeat is sent, 0 disables heartbeats
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(settings *Settings) {
+		settings.heartbeatInterval = interval
+	}
+}
+
 type usersGrpc struct {
 	generated.UnimplementedUsersServiceServer
-	service internal.UserService
-	logger  *slog.Logger
+	service           internal.UserService
+	webhooks          internal.WebhookService
+	logger            *slog.Logger
+	heartbeatInterval time.Duration
+	subscriptions     *subscriptionRegistry
 }
 
-func NewUsersGrpc(service internal.UserService, logger *slog.Logger) generated.UsersServiceServer {
+// NewUsersGrpc creates the users grpc service, webhook rpcs return Unimplemented if webhooks is nil
+func NewUsersGrpc(service internal.UserService, webhooks internal.WebhookService, logger *slog.Logger, options ...Option) generated.UsersServiceServer {
+	settings := &Settings{
+		heartbeatInterval: 30 * time.Second,
+	}
+
+	for _, option := range options {
+		option(settings)
+	}
+
 	return &usersGrpc{
-		service: service,
-		logger:  logger.With(slog.String("component", "grpc.service")),
+		service:           service,
+		webhooks:          webhooks,
+		logger:            logger.With(slog.String("component", "grpc.service")),
+		heartbeatInterval: settings.heartbeatInterval,
+		subscriptions:     newSubscriptionRegistry(),
 	}
 }
 
 func (u *usersGrpc) Add(ctx context.Context, req *generated.AddUserRequest) (*generated.AddUserResponse, error) {
 	user, err := types.UserFromProto(req.User)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, apierror.InvalidArgument("user.id", err)
 	}
 
 	err = u.service.Add(ctx, &user)
 	if err != nil {
-		if errors.Is(err, types.ErrInvalidUserId) || errors.Is(err, types.ErrDuplicateUserId) {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
-		}
-		u.logger.With(
-			slog.Any("error", err),
-			slog.Any("userId", user.Id),
-		).WarnContext(ctx, "Got unexpected error deleting user")
-
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, u.statusError(ctx, err, "Got unexpected error adding user", slog.Any("userId", user.Id))
 	}
 
 	return &generated.AddUserResponse{User: user.Proto()}, nil
@@ -56,67 +80,72 @@ func (u *usersGrpc) Update(ctx context.Context, req *generated.UpdateUserRequest
 	)
 
 	if err = field_mask.Apply(req.UpdateMask, req.User, &updateRequest); err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, apierror.InvalidArgument("update_mask", err)
 	}
 
 	if filter, err = types.UserFilterFromProto(req.Filter); err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, apierror.InvalidArgument("filter.ids", err)
 	}
 
 	if err = u.service.UpdatePartial(ctx, filter, updateRequest); err != nil {
-		if errors.Is(err, types.ErrNotFound) {
+		return nil, u.statusError(ctx, err, "Got unexpected error updating user", slog.Any("filter", updateRequest))
+	}
 
-			return nil, status.Error(codes.NotFound, err.Error())
-		}
+	return &generated.UpdateUserResponse{}, nil
+}
 
-		u.logger.With(
-			slog.Any("error", err),
-			slog.Any("filter", updateRequest),
-		).WarnContext(ctx, "Got unexpected error updating user")
+func (u *usersGrpc) Upsert(ctx context.Context, req *generated.UpsertUserRequest) (*generated.UpsertUserResponse, error) {
+	user, err := types.UserFromProto(req.GetUser())
+	if err != nil {
+		return nil, apierror.InvalidArgument("user.id", err)
+	}
 
-		return nil, status.Error(codes.Internal, err.Error())
+	created, err := u.service.Upsert(ctx, &user, types.UpsertKeyFromString(req.GetKey().String()))
+	if err != nil {
+		return nil, u.statusError(ctx, err, "Got unexpected error upserting user", slog.Any("userId", user.Id))
 	}
 
-	return &generated.UpdateUserResponse{}, nil
+	return &generated.UpsertUserResponse{User: user.Proto(), Created: created}, nil
 }
 
 func (u *usersGrpc) Delete(ctx context.Context, req *generated.DeleteUserRequest) (*generated.DeleteUserResponse, error) {
 	id, err := uuid.Parse(req.GetId())
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, apierror.InvalidArgument("id", fmt.Errorf("%w: %w", types.ErrInvalidUserId, err))
 	}
 
 	err = u.service.Delete(ctx, id)
 	if err != nil {
-		if errors.Is(err, types.ErrInvalidUserId) {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
-		}
+		return nil, u.statusError(ctx, err, "Got unexpected error deleting user", slog.Any("req", req))
+	}
 
-		u.logger.With(
-			slog.Any("error", err),
-			slog.Any("req", req),
-		).WarnContext(ctx, "Got unexpected error deleting user")
+	return &generated.DeleteUserResponse{}, nil
+}
 
-		return nil, status.Error(codes.Internal, err.Error())
+func (u *usersGrpc) DeleteMany(ctx context.Context, req *generated.DeleteManyUsersRequest) (*generated.DeleteManyUsersResponse, error) {
+	filter, err := types.UserFilterFromProto(req.GetFilter())
+	if err != nil {
+		return nil, apierror.InvalidArgument("filter.ids", err)
 	}
 
-	return &generated.DeleteUserResponse{}, nil
+	res, err := u.service.DeleteMany(ctx, filter, req.GetDryRun())
+	if err != nil {
+		return nil, u.statusError(ctx, err, "Got unexpected error deleting users", slog.Any("filter", &filter), slog.Bool("dryRun", req.GetDryRun()))
+	}
+
+	return res.Proto(), nil
 }
 
 func (u *usersGrpc) List(ctx context.Context, req *generated.ListUsersRequest) (*generated.ListUsersResponse, error) {
 
 	filters, err := types.UserFilterFromProto(req.GetFilters())
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, apierror.InvalidArgument("filters.ids", err)
 	}
 
 	users, total, err := u.service.List(ctx, filters, types.PagingFromProto(req.GetPaging()))
 	if err != nil {
-		u.logger.With(
-			slog.Any("error", err),
-			slog.Any("req", req),
-		).WarnContext(ctx, "Got unexpected error listing users")
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, u.statusError(ctx, err, "Got unexpected error listing users", slog.Any("req", req))
 	}
 
 	resp := &generated.ListUsersResponse{
@@ -132,26 +161,68 @@ func (u *usersGrpc) List(ctx context.Context, req *generated.ListUsersRequest) (
 	return resp, nil
 }
 
+func (u *usersGrpc) Get(ctx context.Context, req *generated.GetUserRequest) (*generated.GetUserResponse, error) {
+	id, err := uuid.Parse(req.GetId())
+	if err != nil {
+		return nil, apierror.InvalidArgument("id", fmt.Errorf("%w: %w", types.ErrInvalidUserId, err))
+	}
+
+	user, err := u.service.Get(ctx, id)
+	if err != nil {
+		return nil, u.statusError(ctx, err, "Got unexpected error getting user", slog.Any("userId", id))
+	}
+
+	return &generated.GetUserResponse{User: user.Proto()}, nil
+}
+
 func (u *usersGrpc) Subscribe(req *generated.SubscriptionRequest, serv generated.UsersService_SubscribeServer) error {
 
 	r, err := types.SubscriptionRequestFromProto(req)
 	if err != nil {
-		return status.Error(codes.InvalidArgument, err.Error())
+		return apierror.InvalidArgument("params", err)
 	}
 
 	ctx := serv.Context()
-	ch, err := u.service.SubscribeToUserChanges(ctx, r)
+	ch, lag, err := u.service.SubscribeToUserChanges(ctx, r)
 	if err != nil {
-		u.logger.With(slog.Any("error", err)).WarnContext(ctx, "Got unexpected error subscribing to user updates")
-		return status.Error(codes.Internal, err.Error())
+		return u.statusError(ctx, err, "Got unexpected error subscribing to user updates")
+	}
+
+	ctx, sub := u.subscriptions.add(ctx, req, lag)
+	defer u.subscriptions.remove(sub)
+
+	// tell the client that the subscription is open, e.g. the http gateway starts its event stream
+	if err := serv.SendHeader(nil); err != nil {
+		u.logger.With(slog.Any("error", err)).WarnContext(ctx, "Got unexpected error sending headers to subscription")
+	}
+
+	// the heartbeat channel stays nil when heartbeats are disabled, so it never fires
+	var (
+		heartbeat  *time.Timer
+		heartbeatC <-chan time.Time
+	)
+	if u.heartbeatInterval > 0 {
+		heartbeat = time.NewTimer(u.heartbeatInterval)
+		defer heartbeat.Stop()
+		heartbeatC = heartbeat.C
 	}
 
 	for {
 		select {
 		case resp, ok := <-ch:
 			if !ok {
-				return status.Error(codes.Internal, "subscription channel closed")
+				return apierror.New(codes.Internal, apierror.ReasonInternal, "subscription channel closed")
+			}
+			if errors.Is(resp.Err, types.ErrSubscriberLagging) {
+				return apierror.New(codes.ResourceExhausted, apierror.ReasonSubscriberLagging, "subscriber could not keep up with changes, resubscribe from the last received sequence")
 			}
+			if resp.Err != nil {
+				return u.statusError(ctx, resp.Err, "Got unexpected error from user change subscription")
+			}
+			if !r.IncludeImages {
+				resp = resp.WithoutImages()
+			}
+
 			pb, ok := resp.Proto()
 			if !ok {
 				u.logger.With(slog.Any("error", err), slog.Any("req", req)).WarnContext(serv.Context(), "Got invalid object from user change subscription")
@@ -163,8 +234,45 @@ func (u *usersGrpc) Subscribe(req *generated.SubscriptionRequest, serv generated
 				u.logger.With(slog.Any("error", err)).WarnContext(serv.Context(), "Got unexpected error sending grpc message to subscription")
 				continue
 			}
-		case <-serv.Context().Done():
-			return nil
+			sub.sent(resp)
+			resetTimer(heartbeat, u.heartbeatInterval)
+		case <-heartbeatC:
+			err = serv.Send(&generated.SubscriptionResponse{
+				Event: &generated.SubscriptionResponse_Heartbeat{Heartbeat: &generated.SubscriptionHeartbeat{Timestamp: timestamppb.Now()}},
+			})
+			if err != nil {
+				u.logger.With(slog.Any("error", err)).WarnContext(serv.Context(), "Got unexpected error sending heartbeat to subscription")
+			}
+			heartbeat.Reset(u.heartbeatInterval)
+		case <-ctx.Done():
+			if serv.Context().Err() != nil {
+				return nil
+			}
+			return apierror.New(codes.Aborted, apierror.ReasonSubscriptionTerminated, context.Cause(ctx).Error())
 		}
 	}
 }
+
+// resetTimer restarts t with d, a nil t is ignored
+func resetTimer(t *time.Timer, d time.Duration) {
+	if t == nil {
+		return
+	}
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// statusError translates err to a status error with the error catalog, errors that are not in the catalog are unexpected
+// and logged with msg and attrs
+func (u *usersGrpc) statusError(ctx context.Context, err error, msg string, attrs ...any) error {
+	st := apierror.FromError(err)
+	if status.Code(st) == codes.Internal {
+		u.logger.With(slog.Any("error", err)).With(attrs...).WarnContext(ctx, msg)
+	}
+	return st
+}
@@ -22,7 +22,7 @@ import (
 )
 
 func newTestService(mock internal.UserService) generated.UsersServiceServer {
-	return NewUsersGrpc(mock, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	return NewUsersGrpc(mock, nil, slog.New(slog.NewTextHandler(os.Stdout, nil)))
 }
 
 func Test_usersGrpc_Add(t *testing.T) {
@@ -99,6 +99,81 @@ func Test_usersGrpc_Add(t *testing.T) {
 	}
 }
 
+func Test_usersGrpc_Upsert(t *testing.T) {
+
+	tests := []struct {
+		name                   string
+		req                    *generated.UpsertUserRequest
+		key                    types.UpsertKey
+		wantErr                bool
+		wantCode               codes.Code
+		errFromMock            error
+		discardMockExpectation bool
+	}{
+		{
+			name: "happy case",
+			req:  &generated.UpsertUserRequest{User: &generated.User{Id: uuid.New().String()}},
+			key:  types.UpsertKeyId,
+		},
+		{
+			name: "happy case by email",
+			req:  &generated.UpsertUserRequest{User: &generated.User{Email: "email@example.com"}, Key: generated.UpsertKey_EMAIL},
+			key:  types.UpsertKeyEmail,
+		},
+		{
+			name:                   "sad case bad uuid",
+			req:                    &generated.UpsertUserRequest{User: &generated.User{Id: "invalid-uuid"}},
+			wantErr:                true,
+			wantCode:               codes.InvalidArgument,
+			discardMockExpectation: true,
+		},
+		{
+			name:        "sad case missing email",
+			req:         &generated.UpsertUserRequest{User: &generated.User{}, Key: generated.UpsertKey_EMAIL},
+			key:         types.UpsertKeyEmail,
+			wantErr:     true,
+			wantCode:    codes.InvalidArgument,
+			errFromMock: types.ErrInvalidEmail,
+		},
+		{
+			name:        "sad case error from service",
+			req:         &generated.UpsertUserRequest{User: &generated.User{Id: uuid.New().String()}},
+			key:         types.UpsertKeyId,
+			wantErr:     true,
+			wantCode:    codes.Internal,
+			errFromMock: errors.New("mock error"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			m := mocks.NewMockUserService(t)
+			if !tt.discardMockExpectation {
+				m.EXPECT().Upsert(ctx, mock.Anything, tt.key).Return(true, tt.errFromMock)
+			}
+
+			u := newTestService(m)
+
+			resp, err := u.Upsert(ctx, tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Upsert() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if tt.wantErr {
+				st, ok := status.FromError(err)
+				require.Truef(t, ok, "No status was found on returned error")
+				require.Equal(t, tt.wantCode, st.Code(), "unexpected status code set on returned error")
+				return
+			}
+
+			require.True(t, resp.GetCreated(), "created flag not passed on")
+		})
+	}
+}
+
 func Test_usersGrpc_Delete(t *testing.T) {
 
 	tests := []struct {
@@ -160,6 +235,86 @@ func Test_usersGrpc_Delete(t *testing.T) {
 	}
 }
 
+func Test_usersGrpc_DeleteMany(t *testing.T) {
+	country := "UK"
+
+	tests := []struct {
+		name                   string
+		req                    *generated.DeleteManyUsersRequest
+		filter                 types.UserFilter
+		wantErr                bool
+		wantCode               codes.Code
+		errFromMock            error
+		discardMockExpectation bool
+	}{
+		{
+			name:   "happy case",
+			req:    &generated.DeleteManyUsersRequest{Filter: &generated.SearchFilter{Countries: []string{country}}},
+			filter: types.UserFilter{Countries: []string{country}},
+		},
+		{
+			name:   "happy case dry-run",
+			req:    &generated.DeleteManyUsersRequest{Filter: &generated.SearchFilter{Countries: []string{country}}, DryRun: true},
+			filter: types.UserFilter{Countries: []string{country}},
+		},
+		{
+			name:                   "sad case invalid filter",
+			req:                    &generated.DeleteManyUsersRequest{Filter: &generated.SearchFilter{Ids: []string{"invalid"}}},
+			wantErr:                true,
+			wantCode:               codes.InvalidArgument,
+			discardMockExpectation: true,
+		},
+		{
+			name:        "sad case empty filter",
+			req:         &generated.DeleteManyUsersRequest{},
+			wantErr:     true,
+			wantCode:    codes.InvalidArgument,
+			errFromMock: types.ErrEmptyFilter,
+		},
+		{
+			name:        "sad case limit exceeded",
+			req:         &generated.DeleteManyUsersRequest{Filter: &generated.SearchFilter{Countries: []string{country}}},
+			filter:      types.UserFilter{Countries: []string{country}},
+			wantErr:     true,
+			wantCode:    codes.InvalidArgument,
+			errFromMock: types.ErrLimitExceeded,
+		},
+		{
+			name:        "sad case error from service",
+			req:         &generated.DeleteManyUsersRequest{Filter: &generated.SearchFilter{Countries: []string{country}}},
+			filter:      types.UserFilter{Countries: []string{country}},
+			wantErr:     true,
+			wantCode:    codes.Internal,
+			errFromMock: errors.New("mock error"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			m := mocks.NewMockUserService(t)
+			if !tt.discardMockExpectation {
+				m.EXPECT().DeleteMany(ctx, tt.filter, tt.req.GetDryRun()).Return(types.DeleteManyResult{Count: 1}, tt.errFromMock)
+			}
+
+			u := newTestService(m)
+
+			_, err := u.DeleteMany(ctx, tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DeleteMany() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if tt.wantErr {
+				st, ok := status.FromError(err)
+				require.Truef(t, ok, "No status was found on returned error")
+				require.Equal(t, tt.wantCode, st.Code(), "unexpected status code set on returned error")
+			}
+		})
+	}
+}
+
 func Test_usersGrpc_Update(t *testing.T) {
 
 	// CreatedAt & UpdatedAt fields of user creates problems when using cmp so init them to a static time
@@ -315,26 +470,103 @@ func Test_usersGrpc_List(t *testing.T) {
 	}
 }
 
+func Test_usersGrpc_Get(t *testing.T) {
+	userId := uuid.New()
+
+	tests := []struct {
+		name                   string
+		req                    *generated.GetUserRequest
+		errFromMock            error
+		discardMockExpectation bool
+		wantCode               codes.Code
+	}{
+		{
+			name: "happy case",
+			req:  &generated.GetUserRequest{Id: userId.String()},
+		},
+		{
+			name:                   "sad case bad userId",
+			req:                    &generated.GetUserRequest{Id: "invalid-uuid"},
+			discardMockExpectation: true,
+			wantCode:               codes.InvalidArgument,
+		},
+		{
+			name:        "sad case user not found",
+			req:         &generated.GetUserRequest{Id: userId.String()},
+			errFromMock: types.ErrNotFound,
+			wantCode:    codes.NotFound,
+		},
+		{
+			name:        "sad case error from service",
+			req:         &generated.GetUserRequest{Id: userId.String()},
+			errFromMock: errors.New("mock error"),
+			wantCode:    codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			m := mocks.NewMockUserService(t)
+			if !tt.discardMockExpectation {
+				m.EXPECT().Get(ctx, userId).Return(types.User{Id: userId}, tt.errFromMock)
+			}
+
+			u := newTestService(m)
+
+			resp, err := u.Get(ctx, tt.req)
+			if tt.wantCode != codes.OK {
+				require.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, userId.String(), resp.GetUser().GetId())
+		})
+	}
+}
+
 func Test_usersGrpc_Subscribe(t *testing.T) {
 	invalidId := "invalid-uuid"
 	tests := []struct {
 		name                   string
 		req                    *generated.SubscriptionRequest
 		wantErr                bool
+		wantCode               codes.Code
 		discardMockExpectation bool
 		mockError              error
+		payloadError           error
 	}{
 		{
 			name:    "happy case",
 			req:     &generated.SubscriptionRequest{},
 			wantErr: true, // we close the channel from the producer which should generate an error
 		},
+		{
+			name:    "happy case include images",
+			req:     &generated.SubscriptionRequest{Params: &generated.SubscriptionParameters{IncludeImages: true}},
+			wantErr: true, // we close the channel from the producer which should generate an error
+		},
 		{
 			name:      "sad case error from service",
 			req:       &generated.SubscriptionRequest{},
 			wantErr:   true,
 			mockError: errors.New("error"),
 		},
+		{
+			name:         "sad case subscriber cut off for lagging",
+			req:          &generated.SubscriptionRequest{},
+			wantErr:      true,
+			wantCode:     codes.ResourceExhausted,
+			payloadError: types.ErrSubscriberLagging,
+		},
+		{
+			name:      "sad case invalid start from service",
+			req:       &generated.SubscriptionRequest{StartSequence: 1, StartTime: timestamppb.Now()},
+			wantErr:   true,
+			mockError: types.ErrInvalidSubscriptionStart,
+		},
 		{
 			name:                   "sad case invalid input",
 			req:                    &generated.SubscriptionRequest{Params: &generated.SubscriptionParameters{UserId: &invalidId}},
@@ -350,7 +582,7 @@ func Test_usersGrpc_Subscribe(t *testing.T) {
 
 			ms := mocks.NewMockUserService(t)
 			mgrpcServer := generated_mocks.NewMockUsersService_SubscribeServer(t)
-			result := types.SubscriptionPayload{UserId: uuid.New(), Change: types.UserChangeTypeCreated}
+			result := types.NewUserChangePayload(types.UserChangeTypeCreated, nil, types.User{Id: uuid.New(), FirstName: "first"})
 
 			req, _ := types.SubscriptionRequestFromProto(tt.req)
 
@@ -358,8 +590,15 @@ func Test_usersGrpc_Subscribe(t *testing.T) {
 			if !tt.discardMockExpectation {
 
 				mgrpcServer.EXPECT().Context().Return(ctx)
-
 				if tt.mockError == nil {
+					mgrpcServer.EXPECT().SendHeader(mock.Anything).Return(nil).Once()
+				}
+
+				if tt.payloadError != nil {
+					ch = make(chan types.SubscriptionPayload, 1)
+					ch <- types.SubscriptionPayload{Err: tt.payloadError}
+					close(ch)
+				} else if tt.mockError == nil {
 
 					// setup subscription mock
 					ch = make(chan types.SubscriptionPayload)
@@ -368,14 +607,18 @@ func Test_usersGrpc_Subscribe(t *testing.T) {
 						close(ch)
 					}()
 
-					// setup server receiving mock
-					pb, ok := result.Proto()
+					// setup server receiving mock, images are only sent when requested
+					sent := result
+					if !req.IncludeImages {
+						sent = result.WithoutImages()
+					}
+					pb, ok := sent.Proto()
 					require.True(t, ok)
 
 					mgrpcServer.EXPECT().Send(pb).Return(nil)
 				}
 
-				ms.EXPECT().SubscribeToUserChanges(ctx, req).Return(ch, tt.mockError)
+				ms.EXPECT().SubscribeToUserChanges(ctx, req).Return(ch, func() int { return len(ch) }, tt.mockError)
 			}
 
 			u := newTestService(ms)
@@ -389,7 +632,41 @@ func Test_usersGrpc_Subscribe(t *testing.T) {
 				st, ok := status.FromError(err)
 				require.True(t, ok, "No status was found on returned error")
 				require.NotEqual(t, codes.Unknown, st.Code(), "unknown status code set on returned error")
+				if tt.wantCode != codes.OK {
+					require.Equal(t, tt.wantCode, st.Code())
+				}
 			}
 		})
 	}
 }
+
+func Test_usersGrpc_Subscribe_heartbeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ms := mocks.NewMockUserService(t)
+	mgrpcServer := generated_mocks.NewMockUsersService_SubscribeServer(t)
+	ch := make(chan types.SubscriptionPayload)
+
+	mgrpcServer.EXPECT().Context().Return(ctx)
+	mgrpcServer.EXPECT().SendHeader(mock.Anything).Return(nil).Once()
+	ms.EXPECT().SubscribeToUserChanges(ctx, mock.Anything).Return(ch, func() int { return len(ch) }, nil)
+
+	// cancel the stream once a few heartbeats have been sent on the idle subscription
+	heartbeats := 0
+	mgrpcServer.EXPECT().Send(mock.Anything).RunAndReturn(func(resp *generated.SubscriptionResponse) error {
+		require.NotNil(t, resp.GetHeartbeat(), "expected heartbeat, got %v", resp)
+		require.NotNil(t, resp.GetHeartbeat().GetTimestamp())
+		require.Zero(t, resp.GetSequence())
+
+		if heartbeats++; heartbeats == 3 {
+			cancel()
+		}
+		return nil
+	})
+
+	u := NewUsersGrpc(ms, nil, slog.New(slog.NewTextHandler(os.Stdout, nil)), WithHeartbeatInterval(10*time.Millisecond))
+
+	require.NoError(t, u.Subscribe(&generated.SubscriptionRequest{}, mgrpcServer))
+	require.Equal(t, 3, heartbeats)
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/apierror"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"log/slog"
+)
+
+func (u *usersGrpc) RegisterWebhook(ctx context.Context, req *generated.RegisterWebhookRequest) (*generated.RegisterWebhookResponse, error) {
+	if u.webhooks == nil {
+		return nil, apierror.New(codes.Unimplemented, apierror.ReasonWebhooksDisabled, "webhooks are not enabled")
+	}
+
+	sub, err := types.SubscriptionRequestFromParams(req.GetParams())
+	if err != nil {
+		return nil, apierror.InvalidArgument("params", err)
+	}
+
+	webhook := types.Webhook{
+		Url:          req.GetUrl(),
+		Secret:       req.GetSecret(),
+		Subscription: sub,
+	}
+
+	if err = u.webhooks.Register(ctx, &webhook); err != nil {
+		if errors.Is(err, types.ErrInvalidWebhookUrl) {
+			return nil, apierror.InvalidArgument("url", err)
+		}
+
+		return nil, u.statusError(ctx, err, "Got unexpected error registering webhook")
+	}
+
+	return &generated.RegisterWebhookResponse{Webhook: webhook.Proto(), Secret: webhook.Secret}, nil
+}
+
+func (u *usersGrpc) DeleteWebhook(ctx context.Context, req *generated.DeleteWebhookRequest) (*generated.DeleteWebhookResponse, error) {
+	if u.webhooks == nil {
+		return nil, apierror.New(codes.Unimplemented, apierror.ReasonWebhooksDisabled, "webhooks are not enabled")
+	}
+
+	id, err := uuid.Parse(req.GetId())
+	if err != nil {
+		return nil, apierror.InvalidArgument("id", err)
+	}
+
+	if err = u.webhooks.Delete(ctx, id); err != nil {
+		return nil, u.statusError(ctx, err, "Got unexpected error deleting webhook", slog.Any("webhookId", id))
+	}
+
+	return &generated.DeleteWebhookResponse{}, nil
+}
+
+func (u *usersGrpc) ListWebhooks(ctx context.Context, req *generated.ListWebhooksRequest) (*generated.ListWebhooksResponse, error) {
+	if u.webhooks == nil {
+		return nil, apierror.New(codes.Unimplemented, apierror.ReasonWebhooksDisabled, "webhooks are not enabled")
+	}
+
+	webhooks, total, err := u.webhooks.List(ctx, types.PagingFromProto(req.GetPaging()))
+	if err != nil {
+		return nil, u.statusError(ctx, err, "Got unexpected error listing webhooks")
+	}
+
+	resp := &generated.ListWebhooksResponse{Paging: &generated.PagingMetadata{Count: total}}
+	for _, w := range webhooks {
+		resp.Webhooks = append(resp.Webhooks, w.Proto())
+	}
+
+	return resp, nil
+}
+
+func (u *usersGrpc) ListWebhookDeliveries(ctx context.Context, req *generated.ListWebhookDeliveriesRequest) (*generated.ListWebhookDeliveriesResponse, error) {
+	if u.webhooks == nil {
+		return nil, apierror.New(codes.Unimplemented, apierror.ReasonWebhooksDisabled, "webhooks are not enabled")
+	}
+
+	id, err := uuid.Parse(req.GetWebhookId())
+	if err != nil {
+		return nil, apierror.InvalidArgument("webhook_id", err)
+	}
+
+	deliveries, total, err := u.webhooks.ListDeliveries(ctx, id, types.PagingFromProto(req.GetPaging()))
+	if err != nil {
+		return nil, u.statusError(ctx, err, "Got unexpected error listing webhook deliveries", slog.Any("webhookId", id))
+	}
+
+	resp := &generated.ListWebhookDeliveriesResponse{Paging: &generated.PagingMetadata{Count: total}}
+	for _, d := range deliveries {
+		resp.Deliveries = append(resp.Deliveries, d.Proto())
+	}
+
+	return resp, nil
+}
+
+func (u *usersGrpc) ListWebhookDeadLetters(ctx context.Context, req *generated.ListWebhookDeadLettersRequest) (*generated.ListWebhookDeadLettersResponse, error) {
+	if u.webhooks == nil {
+		return nil, apierror.New(codes.Unimplemented, apierror.ReasonWebhooksDisabled, "webhooks are not enabled")
+	}
+
+	id, err := uuid.Parse(req.GetWebhookId())
+	if err != nil {
+		return nil, apierror.InvalidArgument("webhook_id", err)
+	}
+
+	deadLetters, total, err := u.webhooks.ListDeadLetters(ctx, id, types.PagingFromProto(req.GetPaging()))
+	if err != nil {
+		return nil, u.statusError(ctx, err, "Got unexpected error listing webhook dead letters", slog.Any("webhookId", id))
+	}
+
+	resp := &generated.ListWebhookDeadLettersResponse{Paging: &generated.PagingMetadata{Count: total}}
+	for _, d := range deadLetters {
+		resp.DeadLetters = append(resp.DeadLetters, d.Proto())
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/mocks"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func Test_usersGrpc_RegisterWebhook(t *testing.T) {
+	invalidId := "invalid-uuid"
+
+	tests := []struct {
+		name                   string
+		req                    *generated.RegisterWebhookRequest
+		errFromMock            error
+		discardMockExpectation bool
+		wantCode               codes.Code
+	}{
+		{
+			name: "happy case",
+			req:  &generated.RegisterWebhookRequest{Url: "https://example.com/hook"},
+		},
+		{
+			name:        "sad case invalid url",
+			req:         &generated.RegisterWebhookRequest{Url: "example"},
+			errFromMock: types.ErrInvalidWebhookUrl,
+			wantCode:    codes.InvalidArgument,
+		},
+		{
+			name:                   "sad case invalid params",
+			req:                    &generated.RegisterWebhookRequest{Url: "https://example.com/hook", Params: &generated.SubscriptionParameters{UserId: &invalidId}},
+			discardMockExpectation: true,
+			wantCode:               codes.InvalidArgument,
+		},
+		{
+			name:        "sad case error from service",
+			req:         &generated.RegisterWebhookRequest{Url: "https://example.com/hook"},
+			errFromMock: errors.New("error"),
+			wantCode:    codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := mocks.NewMockWebhookService(t)
+			if !tt.discardMockExpectation {
+				ms.EXPECT().Register(mock.Anything, mock.Anything).RunAndReturn(func(_ context.Context, w *types.Webhook) error {
+					w.Id = uuid.New()
+					w.Secret = "secret"
+					return tt.errFromMock
+				})
+			}
+
+			u := NewUsersGrpc(mocks.NewMockUserService(t), ms, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+
+			resp, err := u.RegisterWebhook(context.Background(), tt.req)
+			if tt.wantCode != codes.OK {
+				require.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "secret", resp.GetSecret())
+			require.Equal(t, tt.req.GetUrl(), resp.GetWebhook().GetUrl())
+		})
+	}
+}
+
+func Test_usersGrpc_webhooksDisabled(t *testing.T) {
+	u := newTestService(mocks.NewMockUserService(t))
+
+	_, err := u.ListWebhooks(context.Background(), &generated.ListWebhooksRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func Test_usersGrpc_ListWebhookDeliveries(t *testing.T) {
+	webhookId := uuid.New()
+
+	t.Run("happy case", func(t *testing.T) {
+		ms := mocks.NewMockWebhookService(t)
+		ms.EXPECT().ListDeliveries(mock.Anything, webhookId, types.Paging{Limit: 10}).
+			Return([]types.WebhookDelivery{{Id: uuid.New(), WebhookId: webhookId, Change: types.UserChangeTypeCreated, Attempt: 1}}, 3, nil)
+
+		u := NewUsersGrpc(mocks.NewMockUserService(t), ms, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+
+		resp, err := u.ListWebhookDeliveries(context.Background(), &generated.ListWebhookDeliveriesRequest{
+			WebhookId: webhookId.String(),
+			Paging:    &generated.Paging{Limit: 10},
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), resp.GetPaging().GetCount())
+		require.Len(t, resp.GetDeliveries(), 1)
+		require.Equal(t, generated.UserChangeType_CREATED, resp.GetDeliveries()[0].GetChangeType())
+	})
+
+	t.Run("sad case invalid webhook id", func(t *testing.T) {
+		u := NewUsersGrpc(mocks.NewMockUserService(t), mocks.NewMockWebhookService(t), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+
+		_, err := u.ListWebhookDeliveries(context.Background(), &generated.ListWebhookDeliveriesRequest{WebhookId: "invalid"})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
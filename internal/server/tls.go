@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/internal/auth"
+	"github.com/captainlettuce/users-microservice/internal/logging"
+	middleware "github.com/grpc-ecosystem/go-grpc-middleware/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadCheckInterval limits how often handshakes check the certificate files for changes
+var tlsReloadCheckInterval = 5 * time.Second
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// certReloader serves the certificate, key and client ca in files, and reloads them when the files change
+// if reloading fails, e.g. while only the certificate has been replaced, the previously loaded files are kept
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	logger       *slog.Logger
+
+	mu           sync.Mutex
+	config       *tls.Config
+	stamps       []fileStamp
+	checkedAt    time.Time
+	reloadFailed bool
+}
+
+// NewTLSConfig serves the certificate and key in certFile and keyFile. If clientCAFile is set, clients must present a
+// certificate signed by one of the certificate authorities in it (mutual tls)
+// the files are reloaded when they change, without restarting the server
+func NewTLSConfig(certFile, keyFile, clientCAFile string, logger *slog.Logger) (*tls.Config, error) {
+	r := &certReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		logger:       logger.With(slog.String("component", "tls")),
+	}
+
+	stamps, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if r.config, err = r.load(); err != nil {
+		return nil, err
+	}
+	r.stamps = stamps
+	r.checkedAt = time.Now()
+
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.configForClient,
+	}, nil
+}
+
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) > tlsReloadCheckInterval {
+		r.checkedAt = time.Now()
+		r.reload()
+	}
+
+	return r.config, nil
+}
+
+func (r *certReloader) reload() {
+	stamps, err := r.stat()
+	if err == nil && stampsEqual(stamps, r.stamps) {
+		return
+	}
+
+	var config *tls.Config
+	if err == nil {
+		config, err = r.load()
+	}
+	if err != nil {
+		if !r.reloadFailed {
+			r.logger.With(slog.Any("error", err)).Warn("Could not reload tls certificates, keeping the previous certificates")
+		}
+		r.reloadFailed = true
+		return
+	}
+
+	r.config = config
+	r.stamps = stamps
+	r.reloadFailed = false
+	r.logger.Info("Reloaded tls certificates")
+}
+
+func (r *certReloader) stat() ([]fileStamp, error) {
+	var stamps []fileStamp
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if file == "" {
+			continue
+		}
+
+		// stat follows symlinks, so swapped symlinks, e.g. of mounted kubernetes secrets, are detected
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{modTime: info.ModTime(), size: info.Size()})
+	}
+	return stamps, nil
+}
+
+func (r *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+
+		// the config returned for a client replaces the one grpc adds h2 to
+		NextProtos: []string{"h2"},
+	}
+
+	if r.clientCAFile != "" {
+		b, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("client ca file contains no certificates")
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+func stampsEqual(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+func clientIdentityUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		return handler(contextWithClientIdentity(ctx), req)
+	}
+}
+
+func clientIdentityStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &middleware.WrappedServerStream{ServerStream: ss, WrappedContext: contextWithClientIdentity(ss.Context())})
+	}
+}
+
+// contextWithClientIdentity adds the identity in the verified certificate of the client to the context and its log attributes
+func contextWithClientIdentity(ctx context.Context) context.Context {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return ctx
+	}
+
+	identity := auth.ClientIdentityFromCertificate(info.State.VerifiedChains[0][0])
+	return logging.LogToContext(auth.ContextWithClientIdentity(ctx, identity), slog.String("client", identity.Name))
+}
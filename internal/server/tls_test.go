@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/captainlettuce/users-microservice/internal/auth"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return testCert{cert: cert, key: key}
+}
+
+func (c testCert) write(t *testing.T, certFile, keyFile string) {
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600))
+
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600))
+	}
+}
+
+func (c testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func newTestCA(t *testing.T) testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newServerCert(t *testing.T, ca testCert, commonName string) testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+}
+
+type identityUsersServer struct {
+	generated.UnimplementedUsersServiceServer
+	identity chan auth.ClientIdentity
+}
+
+func (s *identityUsersServer) Get(ctx context.Context, _ *generated.GetUserRequest) (*generated.GetUserResponse, error) {
+	identity, _ := auth.ClientIdentityFromContext(ctx)
+	s.identity <- identity
+	return &generated.GetUserResponse{}, nil
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	var (
+		logger   = slog.New(slog.NewTextHandler(io.Discard, nil))
+		dir      = t.TempDir()
+		certFile = filepath.Join(dir, "tls.crt")
+		keyFile  = filepath.Join(dir, "tls.key")
+		caFile   = filepath.Join(dir, "ca.crt")
+		ca       = newTestCA(t)
+		spiffeId = &url.URL{Scheme: "spiffe", Host: "users.test", Path: "/client"}
+		client   = newTestCert(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "client"},
+			URIs:        []*url.URL{spiffeId},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, &ca)
+		users = &identityUsersServer{identity: make(chan auth.ClientIdentity, 1)}
+	)
+
+	newServerCert(t, ca, "first").write(t, certFile, keyFile)
+	ca.write(t, caFile, "")
+
+	config, err := NewTLSConfig(certFile, keyFile, caFile, logger)
+	require.NoError(t, err)
+
+	grpcServer := NewGrpc(func(s *grpc.Server, _ *health.Server) {
+		generated.RegisterUsersServiceServer(s, users)
+	}, WithTLS(config))
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = grpcServer.Serve(listen) }()
+	defer grpcServer.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	dial := func(t *testing.T, certificates ...tls.Certificate) *grpc.ClientConn {
+		conn, err := grpc.NewClient(listen.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: certificates,
+		})))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("client identity is added to the context", func(t *testing.T) {
+		_, err := generated.NewUsersServiceClient(dial(t, client.tls())).Get(ctx, &generated.GetUserRequest{})
+		require.NoError(t, err)
+
+		identity := <-users.identity
+		require.Equal(t, spiffeId.String(), identity.Name)
+		require.Equal(t, "client", identity.CommonName)
+	})
+
+	t.Run("clients without a certificate are rejected", func(t *testing.T) {
+		_, err := grpc_health_v1.NewHealthClient(dial(t)).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		require.Error(t, err)
+	})
+
+	t.Run("changed certificates are reloaded", func(t *testing.T) {
+		defer func(interval time.Duration) { tlsReloadCheckInterval = interval }(tlsReloadCheckInterval)
+		tlsReloadCheckInterval = 0
+
+		serverName := func() string {
+			conn, err := tls.Dial("tcp", listen.Addr().String(), &tls.Config{
+				RootCAs:      roots,
+				ServerName:   "localhost",
+				Certificates: []tls.Certificate{client.tls()},
+			})
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+
+		require.Equal(t, "first", serverName())
+
+		second := newServerCert(t, ca, "second")
+		second.write(t, certFile, keyFile)
+		require.NoError(t, os.Chtimes(certFile, time.Now(), time.Now().Add(time.Minute)))
+		require.Equal(t, "second", serverName())
+
+		// a certificate without its key is not used, the previous one is kept
+		newServerCert(t, ca, "third").write(t, certFile, "")
+		require.NoError(t, os.Chtimes(certFile, time.Now(), time.Now().Add(2*time.Minute)))
+		require.Equal(t, "second", serverName())
+	})
+}
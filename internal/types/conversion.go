@@ -1,6 +1,7 @@
 package types
 
 import (
+	"fmt"
 	"github.com/google/uuid"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"time"
@@ -19,7 +20,7 @@ func convertStringsToUUIDs(strs []string) ([]uuid.UUID, error) {
 	for _, s := range strs {
 		u, err := uuid.Parse(s)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrInvalidUserId, err)
 		}
 		uuids = append(uuids, u)
 	}
@@ -4,6 +4,7 @@ import (
 	"github.com/captainlettuce/users-microservice/generated"
 	"github.com/google/uuid"
 	"log/slog"
+	"slices"
 	"time"
 )
 
@@ -21,6 +22,44 @@ type UserFilter struct {
 type TimeFilter struct {
 	Before *time.Time
 	After  *time.Time
+
+	// BeforeInclusive and AfterInclusive makes the corresponding bound match timestamps equal to it
+	BeforeInclusive bool
+	AfterInclusive  bool
+
+	// IsSet matches only entities where the field is set (true) or missing (false), nil matches both
+	IsSet *bool
+}
+
+// IsEmpty returns true if the filter does not restrict matches in any way
+func (tc *TimeFilter) IsEmpty() bool {
+	return tc == nil || (tc.Before == nil && tc.After == nil && tc.IsSet == nil)
+}
+
+// matches reports whether t matches the filter, a nil or zero t is treated as a missing field
+func (tc *TimeFilter) matches(t *time.Time) bool {
+	if tc == nil {
+		return true
+	}
+
+	isSet := t != nil && !t.IsZero()
+	if tc.IsSet != nil && *tc.IsSet != isSet {
+		return false
+	}
+
+	if tc.Before != nil {
+		if !isSet || t.After(*tc.Before) || (!tc.BeforeInclusive && t.Equal(*tc.Before)) {
+			return false
+		}
+	}
+
+	if tc.After != nil {
+		if !isSet || t.Before(*tc.After) || (!tc.AfterInclusive && t.Equal(*tc.After)) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (tc *TimeFilter) Proto() *generated.TimeFilter {
@@ -28,8 +67,11 @@ func (tc *TimeFilter) Proto() *generated.TimeFilter {
 		return nil
 	}
 	return &generated.TimeFilter{
-		Before: convertTimeToTimestamppb(tc.Before),
-		After:  convertTimeToTimestamppb(tc.After),
+		Before:          convertTimeToTimestamppb(tc.Before),
+		After:           convertTimeToTimestamppb(tc.After),
+		BeforeInclusive: tc.BeforeInclusive,
+		AfterInclusive:  tc.AfterInclusive,
+		IsSet:           tc.IsSet,
 	}
 }
 
@@ -39,9 +81,45 @@ func TimeFilterFromProto(proto *generated.TimeFilter) *TimeFilter {
 	}
 
 	return &TimeFilter{
-		Before: convertTimestamppbToTime(proto.GetBefore()),
-		After:  convertTimestamppbToTime(proto.GetAfter()),
+		Before:          convertTimestamppbToTime(proto.GetBefore()),
+		After:           convertTimestamppbToTime(proto.GetAfter()),
+		BeforeInclusive: proto.GetBeforeInclusive(),
+		AfterInclusive:  proto.GetAfterInclusive(),
+		IsSet:           proto.IsSet,
+	}
+}
+
+// IsEmpty returns true if the filter would match all users
+func (uf *UserFilter) IsEmpty() bool {
+	return len(uf.Ids) == 0 &&
+		uf.FirstName == "" &&
+		uf.LastName == "" &&
+		uf.Nickname == "" &&
+		uf.Email == "" &&
+		len(uf.Countries) == 0 &&
+		uf.Created.IsEmpty() &&
+		uf.Updated.IsEmpty()
+}
+
+// Matches reports whether u matches the filter with the same semantics as the repository filter
+// all set criteria have to match, list criteria match any of their values and empty user fields are treated as missing
+func (uf *UserFilter) Matches(u User) bool {
+	if len(uf.Ids) > 0 && !slices.Contains(uf.Ids, u.Id) {
+		return false
+	}
+
+	if len(uf.Countries) > 0 && (u.Country == "" || !slices.Contains(uf.Countries, u.Country)) {
+		return false
 	}
+
+	if (uf.FirstName != "" && uf.FirstName != u.FirstName) ||
+		(uf.LastName != "" && uf.LastName != u.LastName) ||
+		(uf.Nickname != "" && uf.Nickname != u.Nickname) ||
+		(uf.Email != "" && uf.Email != u.Email) {
+		return false
+	}
+
+	return uf.Created.matches(&u.CreatedAt) && uf.Updated.matches(u.UpdatedAt)
 }
 
 func (uf *UserFilter) Proto() *generated.SearchFilter {
@@ -12,9 +12,13 @@ import (
 
 func TestTimeFilterConversion(t *testing.T) {
 	now := time.Now()
+	isSet := true
 	pb := &generated.TimeFilter{
-		After:  convertTimeToTimestamppb(&now),
-		Before: convertTimeToTimestamppb(&now),
+		After:           convertTimeToTimestamppb(&now),
+		Before:          convertTimeToTimestamppb(&now),
+		BeforeInclusive: true,
+		AfterInclusive:  true,
+		IsSet:           &isSet,
 	}
 
 	t.Run("all fields get tested", func(t *testing.T) {
@@ -67,3 +71,92 @@ func TestUserFilterConversion(t *testing.T) {
 		require.Error(t, err, "should not accept invalid uuids")
 	})
 }
+
+func TestUserFilterIsEmpty(t *testing.T) {
+	now := time.Now()
+	isSet := false
+	tests := []struct {
+		name   string
+		filter UserFilter
+		want   bool
+	}{
+		{
+			name:   "zero-value filter",
+			filter: UserFilter{},
+			want:   true,
+		},
+		{
+			name:   "empty time filters",
+			filter: UserFilter{Created: &TimeFilter{}, Updated: &TimeFilter{AfterInclusive: true}},
+			want:   true,
+		},
+		{
+			name:   "ids set",
+			filter: UserFilter{Ids: []uuid.UUID{uuid.New()}},
+		},
+		{
+			name:   "country set",
+			filter: UserFilter{Countries: []string{"UK"}},
+		},
+		{
+			name:   "time bound set",
+			filter: UserFilter{Created: &TimeFilter{Before: &now}},
+		},
+		{
+			name:   "time is set set",
+			filter: UserFilter{Updated: &TimeFilter{IsSet: &isSet}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.filter.IsEmpty())
+		})
+	}
+}
+
+func TestUserFilterMatches(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+	later := now.Add(time.Hour)
+	isSet := true
+	isNotSet := false
+
+	user := User{
+		Id:        uuid.New(),
+		FirstName: "first",
+		LastName:  "last",
+		Nickname:  "nick",
+		Email:     "email@example.com",
+		Country:   "DE",
+		CreatedAt: now,
+	}
+
+	tests := []struct {
+		name   string
+		filter UserFilter
+		want   bool
+	}{
+		{name: "empty filter matches", filter: UserFilter{}, want: true},
+		{name: "id matches any", filter: UserFilter{Ids: []uuid.UUID{uuid.New(), user.Id}}, want: true},
+		{name: "id mismatch", filter: UserFilter{Ids: []uuid.UUID{uuid.New()}}, want: false},
+		{name: "country matches any", filter: UserFilter{Countries: []string{"SE", "DE"}}, want: true},
+		{name: "country mismatch", filter: UserFilter{Countries: []string{"SE"}}, want: false},
+		{name: "all string fields match", filter: UserFilter{FirstName: "first", LastName: "last", Nickname: "nick", Email: "email@example.com"}, want: true},
+		{name: "string matching is exact", filter: UserFilter{FirstName: "First"}, want: false},
+		{name: "all criteria have to match", filter: UserFilter{Countries: []string{"DE"}, Email: "other@example.com"}, want: false},
+		{name: "created within range", filter: UserFilter{Created: &TimeFilter{After: &earlier, Before: &later}}, want: true},
+		{name: "created exclusive bound", filter: UserFilter{Created: &TimeFilter{After: &now}}, want: false},
+		{name: "created inclusive bound", filter: UserFilter{Created: &TimeFilter{After: &now, AfterInclusive: true, Before: &now, BeforeInclusive: true}}, want: true},
+		{name: "created before range", filter: UserFilter{Created: &TimeFilter{After: &later}}, want: false},
+		{name: "never updated matches unset", filter: UserFilter{Updated: &TimeFilter{IsSet: &isNotSet}}, want: true},
+		{name: "never updated does not match set", filter: UserFilter{Updated: &TimeFilter{IsSet: &isSet}}, want: false},
+		{name: "range never matches unset field", filter: UserFilter{Updated: &TimeFilter{Before: &later}}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.filter.Matches(user))
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package types
+
+import (
+	"time"
+)
+
+// IdempotencyRecord keeps track of a request made with an idempotency key
+// so that retries of the request can be replayed instead of executed again
+type IdempotencyRecord struct {
+	Key         string `bson:"_id"`
+	RequestHash []byte `bson:"request_hash"`
+
+	// Response is the serialized response of the original request, only set once Completed
+	Response  []byte `bson:"response,omitempty"`
+	Completed bool   `bson:"completed"`
+
+	CreatedAt time.Time `bson:"created_at"`
+}
@@ -21,9 +21,22 @@ func checkProtobufAllFieldsSet(pb proto.Message) error {
 		return fmt.Errorf("could not unmarshal proto to map[string]any: %w", err)
 	}
 
-	protoFields := pb.ProtoReflect().Descriptor().Fields()
+	descriptor := pb.ProtoReflect().Descriptor()
 
-	if len(anyMap) != protoFields.Len() {
+	// only one field of each oneof can be set
+	want := 0
+	for i := 0; i < descriptor.Fields().Len(); i++ {
+		if oneof := descriptor.Fields().Get(i).ContainingOneof(); oneof == nil || oneof.IsSynthetic() {
+			want++
+		}
+	}
+	for i := 0; i < descriptor.Oneofs().Len(); i++ {
+		if !descriptor.Oneofs().Get(i).IsSynthetic() {
+			want++
+		}
+	}
+
+	if len(anyMap) != want {
 		return errors.New("unset fields found")
 	}
 
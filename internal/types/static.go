@@ -10,10 +10,17 @@ const (
 )
 
 var (
-	ErrInvalidUserId   = errors.New("invalid userId")
-	ErrDuplicateUserId = errors.New("duplicate userId")
-	ErrNotFound        = errors.New("not found")
-	ErrUnknownError    = errors.New("unknown error")
+	ErrInvalidUserId            = errors.New("invalid userId")
+	ErrInvalidEmail             = errors.New("invalid email")
+	ErrDuplicateUserId          = errors.New("duplicate userId")
+	ErrDuplicateEmail           = errors.New("duplicate email")
+	ErrNotFound                 = errors.New("not found")
+	ErrUnknownError             = errors.New("unknown error")
+	ErrEmptyFilter              = errors.New("empty filter")
+	ErrLimitExceeded            = errors.New("limit exceeded")
+	ErrInvalidSubscriptionStart = errors.New("invalid subscription start")
+	ErrSubscriberLagging        = errors.New("subscriber lagging")
+	ErrInvalidWebhookUrl        = errors.New("invalid webhook url")
 )
 
 var ()
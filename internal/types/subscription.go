@@ -1,9 +1,13 @@
 package types
 
 import (
+	"errors"
+	"fmt"
 	"github.com/captainlettuce/users-microservice/generated"
 	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"slices"
+	"time"
 )
 
 type UserChangeType string
@@ -31,6 +35,58 @@ func UserChangeTypeFromString(s string) UserChangeType {
 type SubscriptionPayload struct {
 	UserId uuid.UUID
 	Change UserChangeType
+
+	// Sequence is the position of the change in the change stream, 0 until the change has been published
+	Sequence uint64
+
+	// ChangedFields are the paths of the user fields changed
+	ChangedFields []string
+
+	// Revision is the revision of the user after the change, 0 if unknown
+	Revision  uint64
+	Timestamp time.Time
+
+	// Before and After are images of the user before and after the change, they never include the password
+	// Before is only set for updates
+	Before *User
+	After  *User
+
+	// Dropped is how many changes were dropped for the subscriber before this one because it lagged
+	// it is only set on payloads received from a subscription and never published
+	Dropped uint64
+
+	// Err is only set on the last payload of a subscription that was terminated, e.g. with ErrSubscriberLagging
+	Err error
+}
+
+// NewUserChangePayload creates the payload for a change resulting in the user after, before is nil for created users
+func NewUserChangePayload(change UserChangeType, before *User, after User) SubscriptionPayload {
+	return SubscriptionPayload{
+		UserId:        after.Id,
+		Change:        change,
+		ChangedFields: changedFields(before, &after),
+		Revision:      after.Revision,
+		Timestamp:     time.Now(),
+		Before:        changeImage(before),
+		After:         changeImage(&after),
+	}
+}
+
+// MatchesFilter reports whether the user after the change matches filter, deletes only match an empty filter
+// payloads terminating the subscription always match so the subscriber is told why
+func (sr SubscriptionPayload) MatchesFilter(filter UserFilter) bool {
+	if filter.IsEmpty() || sr.Err != nil {
+		return true
+	}
+
+	return sr.After != nil && filter.Matches(*sr.After)
+}
+
+// WithoutImages returns a copy of the payload without the before and after images
+func (sr SubscriptionPayload) WithoutImages() SubscriptionPayload {
+	sr.Before = nil
+	sr.After = nil
+	return sr
 }
 
 func (sr SubscriptionPayload) Proto() (*generated.SubscriptionResponse, bool) {
@@ -44,11 +100,22 @@ func (sr SubscriptionPayload) Proto() (*generated.SubscriptionResponse, bool) {
 		return nil, false
 	}
 
+	var timestamp *timestamppb.Timestamp
+	if !sr.Timestamp.IsZero() {
+		timestamp = timestamppb.New(sr.Timestamp)
+	}
+
 	resp := &generated.SubscriptionResponse{
-		Update: &generated.SubscriptionMessage{
-			UserId:     sr.UserId.String(),
-			ChangeType: generated.UserChangeType(s),
-		},
+		Event: &generated.SubscriptionResponse_Update{Update: &generated.SubscriptionMessage{
+			UserId:        sr.UserId.String(),
+			ChangeType:    generated.UserChangeType(s),
+			ChangedFields: sr.ChangedFields,
+			Revision:      sr.Revision,
+			Timestamp:     timestamp,
+			Before:        changeImageProto(sr.Before),
+			After:         changeImageProto(sr.After),
+		}},
+		Sequence: sr.Sequence,
 	}
 
 	return resp, true
@@ -64,35 +131,154 @@ func SubscriptionPayloadFromProto(in *generated.SubscriptionResponse) (Subscript
 		return SubscriptionPayload{}, err
 	}
 
-	return SubscriptionPayload{
-		UserId: id,
-		Change: UserChangeTypeFromString(in.GetUpdate().GetChangeType().String()),
-	}, nil
+	sp := SubscriptionPayload{
+		UserId:        id,
+		Change:        UserChangeTypeFromString(in.GetUpdate().GetChangeType().String()),
+		Sequence:      in.GetSequence(),
+		ChangedFields: in.GetUpdate().GetChangedFields(),
+		Revision:      in.GetUpdate().GetRevision(),
+	}
+
+	if ts := convertTimestamppbToTime(in.GetUpdate().GetTimestamp()); ts != nil {
+		sp.Timestamp = *ts
+	}
+
+	if sp.Before, err = changeImageFromProto(in.GetUpdate().GetBefore()); err != nil {
+		return SubscriptionPayload{}, err
+	}
+
+	if sp.After, err = changeImageFromProto(in.GetUpdate().GetAfter()); err != nil {
+		return SubscriptionPayload{}, err
+	}
+
+	return sp, nil
+}
+
+func changeImageProto(u *User) *generated.User {
+	if u == nil {
+		return nil
+	}
+	return changeImage(u).Proto()
+}
+
+func changeImageFromProto(pb *generated.User) (*User, error) {
+	if pb == nil {
+		return nil, nil
+	}
+
+	u, err := UserFromProto(pb)
+	if err != nil {
+		return nil, err
+	}
+
+	return changeImage(&u), nil
 }
 
+// MaxSubscriptionUserIds is the maximum number of user ids a single subscription can filter on
+const MaxSubscriptionUserIds = 1000
+
 type SubscriptionRequest struct {
-	UserId *uuid.UUID
-	Change *UserChangeType
+	// UserIds and Changes limits the subscription to changes matching any of the ids and any of the change types, empty matches all
+	UserIds []uuid.UUID
+	Changes []UserChangeType
+
+	// Filter limits the subscription to changes where the user after the change matches the filter
+	Filter UserFilter
+
+	// IncludeImages adds the before and after images of the user to each payload
+	IncludeImages bool
+
+	// StartSequence and StartTime replays changes from a point in the change stream, only new changes are delivered if neither is set
+	StartSequence uint64
+	StartTime     *time.Time
 }
 
 func SubscriptionRequestFromProto(in *generated.SubscriptionRequest) (SubscriptionRequest, error) {
+	sr, err := SubscriptionRequestFromParams(in.GetParams())
+	if err != nil {
+		return sr, err
+	}
+
+	sr.StartSequence = in.GetStartSequence()
+	sr.StartTime = convertTimestamppbToTime(in.GetStartTime())
+
+	return sr, nil
+}
+
+// SubscriptionRequestFromParams creates a request for new changes matching params
+func SubscriptionRequestFromParams(params *generated.SubscriptionParameters) (SubscriptionRequest, error) {
 	sr := SubscriptionRequest{}
-	if in == nil {
+	if params == nil {
 		return sr, nil
 	}
-	if userId := in.GetParams().GetUserId(); userId != "" {
+
+	userIds := params.GetUserIds()
+	if userId := params.GetUserId(); userId != "" {
+		userIds = append([]string{userId}, userIds...)
+	}
+	if len(userIds) > MaxSubscriptionUserIds {
+		return sr, errors.Join(ErrLimitExceeded, fmt.Errorf("at most %d user ids can be subscribed to", MaxSubscriptionUserIds))
+	}
+
+	for _, userId := range userIds {
 		id, err := uuid.Parse(userId)
 		if err != nil {
-			return sr, err
+			return sr, fmt.Errorf("%w: %w", ErrInvalidUserId, err)
+		}
+
+		if !slices.Contains(sr.UserIds, id) {
+			sr.UserIds = append(sr.UserIds, id)
 		}
+	}
 
-		sr.UserId = &id
+	changes := params.GetChangeTypes()
+	if params.ChangeType != nil {
+		changes = append([]generated.UserChangeType{params.GetChangeType()}, changes...)
 	}
 
-	if in.GetParams() != nil && in.GetParams().ChangeType != nil {
-		ch := UserChangeTypeFromString(in.GetParams().GetChangeType().String())
-		sr.Change = &ch
+	for _, change := range changes {
+		if ch := UserChangeTypeFromString(change.String()); !slices.Contains(sr.Changes, ch) {
+			sr.Changes = append(sr.Changes, ch)
+		}
+	}
+
+	filter, err := UserFilterFromProto(params.GetFilter())
+	if err != nil {
+		return sr, err
 	}
+	sr.Filter = filter
+
+	sr.IncludeImages = params.GetIncludeImages()
 
 	return sr, nil
 }
+
+// ParamsProto converts the parts of the request that select changes, the start point is not included
+func (sr SubscriptionRequest) ParamsProto() *generated.SubscriptionParameters {
+	params := &generated.SubscriptionParameters{
+		IncludeImages: sr.IncludeImages,
+		UserIds:       convertUUIDsToStrings(sr.UserIds),
+	}
+
+	for _, change := range sr.Changes {
+		params.ChangeTypes = append(params.ChangeTypes, generated.UserChangeType(generated.UserChangeType_value[string(change)]))
+	}
+
+	if !sr.Filter.IsEmpty() {
+		params.Filter = sr.Filter.Proto()
+	}
+
+	return params
+}
+
+// Matches reports whether p is one of the changes selected by the request
+func (sr SubscriptionRequest) Matches(p SubscriptionPayload) bool {
+	if len(sr.UserIds) > 0 && !slices.Contains(sr.UserIds, p.UserId) {
+		return false
+	}
+	if len(sr.Changes) > 0 && !slices.Contains(sr.Changes, p.Change) {
+		return false
+	}
+
+	return p.MatchesFilter(sr.Filter)
+}
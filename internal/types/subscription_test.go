@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/testing/protocmp"
 	"testing"
+	"time"
 )
 
 func TestSubscriptionRequestConversion(t *testing.T) {
@@ -17,17 +18,29 @@ func TestSubscriptionRequestConversion(t *testing.T) {
 	require.True(t, ok)
 
 	ct := generated.UserChangeType(changePb)
+	startTime := time.Now()
+	otherId := uuid.New()
 
 	pb := &generated.SubscriptionRequest{
 		Params: &generated.SubscriptionParameters{
-			UserId:     &staticIdStr,
-			ChangeType: &ct,
+			UserId:        &staticIdStr,
+			ChangeType:    &ct,
+			IncludeImages: true,
+			UserIds:       []string{otherId.String(), staticIdStr},
+			ChangeTypes:   []generated.UserChangeType{generated.UserChangeType_DELETED},
+			Filter:        &generated.SearchFilter{Countries: []string{"DE"}},
 		},
+		StartSequence: 42,
+		StartTime:     convertTimeToTimestamppb(&startTime),
 	}
 
 	og := SubscriptionRequest{
-		UserId: &staticId,
-		Change: &change,
+		UserIds:       []uuid.UUID{staticId, otherId},
+		Changes:       []UserChangeType{change, UserChangeTypeDeleted},
+		Filter:        UserFilter{Countries: []string{"DE"}},
+		IncludeImages: true,
+		StartSequence: 42,
+		StartTime:     &startTime,
 	}
 
 	t.Run("all fields get tested", func(t *testing.T) {
@@ -48,11 +61,79 @@ func TestSubscriptionRequestConversion(t *testing.T) {
 		require.Error(t, err, "function should not accept invalid uuid")
 	})
 
+	t.Run("sad case too many user ids", func(t *testing.T) {
+		ids := make([]string, MaxSubscriptionUserIds+1)
+		for i := range ids {
+			ids[i] = uuid.New().String()
+		}
+		_, err := SubscriptionRequestFromProto(&generated.SubscriptionRequest{Params: &generated.SubscriptionParameters{UserIds: ids}})
+		require.ErrorIs(t, err, ErrLimitExceeded)
+	})
+
 	t.Run("empty Id is treated as valid", func(t *testing.T) {
 		emptyId := ""
 		_, err := SubscriptionRequestFromProto(&generated.SubscriptionRequest{Params: &generated.SubscriptionParameters{UserId: &emptyId}})
 		require.NoError(t, err)
 	})
+
+	t.Run("params round trip", func(t *testing.T) {
+		withoutStart := og
+		withoutStart.StartSequence = 0
+		withoutStart.StartTime = nil
+
+		f, err := SubscriptionRequestFromParams(og.ParamsProto())
+		require.NoError(t, err)
+		require.True(t, cmp.Equal(f, withoutStart, protocmp.Transform()), "fields are not set correctly")
+	})
+}
+
+func TestSubscriptionRequest_Matches(t *testing.T) {
+	userA, userB := uuid.New(), uuid.New()
+
+	payload := SubscriptionPayload{
+		UserId: userA,
+		Change: UserChangeTypeUpdated,
+		After:  &User{Id: userA, Country: "DE"},
+	}
+
+	tests := []struct {
+		name string
+		req  SubscriptionRequest
+		want bool
+	}{
+		{
+			name: "empty request matches all",
+			want: true,
+		},
+		{
+			name: "matching user and change",
+			req:  SubscriptionRequest{UserIds: []uuid.UUID{userB, userA}, Changes: []UserChangeType{UserChangeTypeUpdated}},
+			want: true,
+		},
+		{
+			name: "other user",
+			req:  SubscriptionRequest{UserIds: []uuid.UUID{userB}},
+		},
+		{
+			name: "other change",
+			req:  SubscriptionRequest{Changes: []UserChangeType{UserChangeTypeCreated, UserChangeTypeDeleted}},
+		},
+		{
+			name: "matching filter",
+			req:  SubscriptionRequest{Filter: UserFilter{Countries: []string{"DE"}}},
+			want: true,
+		},
+		{
+			name: "other filter",
+			req:  SubscriptionRequest{Filter: UserFilter{Countries: []string{"SE"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.req.Matches(payload))
+		})
+	}
 }
 
 func TestSubscriptionPayloadConversion(t *testing.T) {
@@ -60,15 +141,24 @@ func TestSubscriptionPayloadConversion(t *testing.T) {
 	changePb, ok := generated.UserChangeType_value[string(change)]
 	require.True(t, ok)
 
+	now := time.Now()
+	id := uuid.New().String()
 	pb := &generated.SubscriptionResponse{
-		Update: &generated.SubscriptionMessage{
-			UserId:     uuid.New().String(),
-			ChangeType: generated.UserChangeType(changePb),
-		},
+		Event: &generated.SubscriptionResponse_Update{Update: &generated.SubscriptionMessage{
+			UserId:        id,
+			ChangeType:    generated.UserChangeType(changePb),
+			ChangedFields: []string{"first_name"},
+			Revision:      2,
+			Timestamp:     convertTimeToTimestamppb(&now),
+			Before:        &generated.User{Id: id, FirstName: "before", CreatedAt: convertTimeToTimestamppb(&now), Revision: 1},
+			After:         &generated.User{Id: id, FirstName: "after", CreatedAt: convertTimeToTimestamppb(&now), Revision: 2},
+		}},
+		Sequence: 7,
 	}
 
 	t.Run("all fields get tested", func(t *testing.T) {
 		require.NoError(t, checkProtobufAllFieldsSet(pb))
+		require.NoError(t, checkProtobufAllFieldsSet(pb.GetUpdate()))
 	})
 
 	t.Run("fields set to correct value", func(t *testing.T) {
@@ -82,13 +172,52 @@ func TestSubscriptionPayloadConversion(t *testing.T) {
 	})
 
 	t.Run("sad case function fails on invalid uuid", func(t *testing.T) {
-		pbInner := &generated.SubscriptionResponse{Update: &generated.SubscriptionMessage{UserId: "invalid-uuid"}}
+		pbInner := &generated.SubscriptionResponse{Event: &generated.SubscriptionResponse_Update{Update: &generated.SubscriptionMessage{UserId: "invalid-uuid"}}}
 		_, err := SubscriptionPayloadFromProto(pbInner)
 		require.Error(t, err, "function should not accept invalid uuid")
 	})
 
 	t.Run("sad case empty id is invalid", func(t *testing.T) {
-		_, err := SubscriptionPayloadFromProto(&generated.SubscriptionResponse{Update: &generated.SubscriptionMessage{UserId: ""}})
+		_, err := SubscriptionPayloadFromProto(&generated.SubscriptionResponse{Event: &generated.SubscriptionResponse_Update{Update: &generated.SubscriptionMessage{UserId: ""}}})
 		require.Error(t, err)
 	})
 }
+
+func TestNewUserChangePayload(t *testing.T) {
+	before := User{Id: uuid.New(), FirstName: "before", Password: "secret", Revision: 1}
+	after := before
+	after.FirstName = "after"
+	after.Password = "new-secret"
+	after.Revision = 2
+
+	p := NewUserChangePayload(UserChangeTypeUpdated, &before, after)
+
+	require.Equal(t, before.Id, p.UserId)
+	require.Equal(t, []string{"first_name", "password"}, p.ChangedFields)
+	require.Equal(t, uint64(2), p.Revision)
+	require.False(t, p.Timestamp.IsZero(), "timestamp not set")
+
+	t.Run("password is never included in images", func(t *testing.T) {
+		require.Equal(t, "", p.Before.Password)
+		require.Equal(t, "", p.After.Password)
+		require.Equal(t, "secret", before.Password, "original user should not be modified")
+
+		pb, ok := p.Proto()
+		require.True(t, ok)
+		require.Equal(t, "", pb.GetUpdate().GetAfter().GetPassword())
+	})
+
+	t.Run("filter is evaluated against the user after the change", func(t *testing.T) {
+		require.True(t, p.MatchesFilter(UserFilter{}))
+		require.True(t, p.MatchesFilter(UserFilter{FirstName: "after"}))
+		require.False(t, p.MatchesFilter(UserFilter{FirstName: "before"}))
+		require.False(t, p.WithoutImages().MatchesFilter(UserFilter{FirstName: "after"}), "deletes carry no user and never match a non-empty filter")
+	})
+
+	t.Run("images can be removed", func(t *testing.T) {
+		stripped := p.WithoutImages()
+		require.Nil(t, stripped.Before)
+		require.Nil(t, stripped.After)
+		require.NotNil(t, p.After, "original payload should not be modified")
+	})
+}
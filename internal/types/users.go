@@ -5,6 +5,7 @@ import (
 	"github.com/google/uuid"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"log/slog"
+	"slices"
 	"time"
 )
 
@@ -19,6 +20,9 @@ type User struct {
 
 	CreatedAt time.Time  `bson:"created_at,omitempty"`
 	UpdatedAt *time.Time `bson:"updated_at,omitempty"`
+
+	// Revision is incremented on each change to the user
+	Revision uint64 `bson:"revision,omitempty"`
 }
 
 // LogValue is used to make sure we don't leak any PII in logs
@@ -44,6 +48,7 @@ func (u User) Proto() *generated.User {
 
 		CreatedAt: timestamppb.New(u.CreatedAt),
 		UpdatedAt: protoUpdatedAt,
+		Revision:  u.Revision,
 	}
 }
 
@@ -56,6 +61,7 @@ func UserFromProto(u *generated.User) (User, error) {
 		Password:  u.GetPassword(),
 		Country:   u.GetCountry(),
 		CreatedAt: u.CreatedAt.AsTime(),
+		Revision:  u.GetRevision(),
 	}
 
 	if u.Id != "" {
@@ -74,6 +80,69 @@ func UserFromProto(u *generated.User) (User, error) {
 	return user, nil
 }
 
+// changeImage returns a copy of the user suitable for change events, the password is always excluded
+func changeImage(u *User) *User {
+	if u == nil {
+		return nil
+	}
+
+	image := *u
+	image.Password = ""
+
+	return &image
+}
+
+// changedFields returns the paths of the user fields that differ between before and after
+// if before is nil all fields set on after are returned
+func changedFields(before, after *User) []string {
+	if before == nil {
+		before = &User{}
+	}
+	if after == nil {
+		after = &User{}
+	}
+
+	var changed []string
+	for _, f := range []struct {
+		path          string
+		before, after string
+	}{
+		{"first_name", before.FirstName, after.FirstName},
+		{"last_name", before.LastName, after.LastName},
+		{"nickname", before.Nickname, after.Nickname},
+		{"email", before.Email, after.Email},
+		{"password", before.Password, after.Password},
+		{"country", before.Country, after.Country},
+	} {
+		if f.before != f.after {
+			changed = append(changed, f.path)
+		}
+	}
+
+	return changed
+}
+
+// UpsertKey is the field used to match an existing user when upserting
+type UpsertKey string
+
+const (
+	UpsertKeyId    UpsertKey = "ID"
+	UpsertKeyEmail UpsertKey = "EMAIL"
+)
+
+// UpsertKeyFromString returns the matching UpsertKey, defaulting to UpsertKeyId for unknown values
+func UpsertKeyFromString(s string) UpsertKey {
+	if uk := UpsertKey(s); slices.Contains([]UpsertKey{UpsertKeyId, UpsertKeyEmail}, uk) {
+		return uk
+	}
+
+	return UpsertKeyId
+}
+
+func (uk UpsertKey) Proto() generated.UpsertKey {
+	return generated.UpsertKey(generated.UpsertKey_value[string(uk)])
+}
+
 type UpdateUserFields struct {
 	FirstName *string `bson:"first_name,omitempty" field_mask:"first_name"`
 	LastName  *string `bson:"last_name,omitempty" field_mask:"last_name"`
@@ -82,3 +151,37 @@ type UpdateUserFields struct {
 	Password  *string `bson:"password,omitempty" field_mask:"password"`
 	Country   *string `bson:"country,omitempty" field_mask:"country"`
 }
+
+// Apply returns a copy of the user with all non-nil fields set, a pointer to the zero-value unsets the field
+func (f UpdateUserFields) Apply(u User) User {
+	for _, field := range []struct {
+		value *string
+		dst   *string
+	}{
+		{f.FirstName, &u.FirstName},
+		{f.LastName, &u.LastName},
+		{f.Nickname, &u.Nickname},
+		{f.Email, &u.Email},
+		{f.Password, &u.Password},
+		{f.Country, &u.Country},
+	} {
+		if field.value != nil {
+			*field.dst = *field.value
+		}
+	}
+
+	return u
+}
+
+// DeleteManyResult describes the users matched (dry-run) or removed by a bulk delete
+type DeleteManyResult struct {
+	Count     uint64
+	SampleIds []uuid.UUID
+}
+
+func (dr DeleteManyResult) Proto() *generated.DeleteManyUsersResponse {
+	return &generated.DeleteManyUsersResponse{
+		Count:     dr.Count,
+		SampleIds: convertUUIDsToStrings(dr.SampleIds),
+	}
+}
@@ -23,6 +23,7 @@ func TestUserConversion(t *testing.T) {
 		Country:   text,
 		CreatedAt: convertTimeToTimestamppb(&now),
 		UpdatedAt: convertTimeToTimestamppb(&now),
+		Revision:  1,
 	}
 
 	t.Run("all fields get tested", func(t *testing.T) {
@@ -50,3 +51,65 @@ func TestUserConversion(t *testing.T) {
 		require.Equal(t, u.Id, uuid.Nil)
 	})
 }
+
+func TestDeleteManyResultConversion(t *testing.T) {
+	id := uuid.New()
+	res := DeleteManyResult{Count: 1, SampleIds: []uuid.UUID{id}}
+
+	pb := res.Proto()
+
+	t.Run("all fields get tested", func(t *testing.T) {
+		require.NoError(t, checkProtobufAllFieldsSet(pb))
+	})
+
+	t.Run("fields set to correct value", func(t *testing.T) {
+		want := &generated.DeleteManyUsersResponse{Count: 1, SampleIds: []string{id.String()}}
+		require.True(t, cmp.Equal(want, pb, protocmp.Transform()), "fields are not set correctly")
+	})
+}
+
+func TestUpsertKeyConversion(t *testing.T) {
+	for name, value := range generated.UpsertKey_value {
+		t.Run(name, func(t *testing.T) {
+			uk := UpsertKeyFromString(name)
+			require.Equal(t, generated.UpsertKey(value), uk.Proto(), "key does not survive conversion")
+		})
+	}
+
+	t.Run("unknown key defaults to id", func(t *testing.T) {
+		require.Equal(t, UpsertKeyId, UpsertKeyFromString("not-a-key"))
+	})
+}
+
+func TestUpdateUserFieldsApply(t *testing.T) {
+	user := User{Id: uuid.New(), FirstName: "first", LastName: "last", Nickname: "nick", Revision: 1}
+	updated := "updated"
+	empty := ""
+
+	got := UpdateUserFields{FirstName: &updated, LastName: &empty}.Apply(user)
+
+	require.Equal(t, updated, got.FirstName, "set field was not applied")
+	require.Equal(t, "", got.LastName, "zero-value field was not unset")
+	require.Equal(t, user.Nickname, got.Nickname, "nil field should be left untouched")
+	require.Equal(t, user.Id, got.Id)
+	require.Equal(t, "first", user.FirstName, "original user should not be modified")
+}
+
+func TestChangedFields(t *testing.T) {
+	before := User{FirstName: "first", LastName: "last", Password: "secret"}
+
+	t.Run("created user reports all set fields", func(t *testing.T) {
+		require.Equal(t, []string{"first_name", "last_name", "password"}, changedFields(nil, &before))
+	})
+
+	t.Run("updated user reports differing fields", func(t *testing.T) {
+		after := before
+		after.FirstName = "updated"
+		after.Password = ""
+		require.Equal(t, []string{"first_name", "password"}, changedFields(&before, &after))
+	})
+
+	t.Run("unchanged user reports nothing", func(t *testing.T) {
+		require.Empty(t, changedFields(&before, &before))
+	})
+}
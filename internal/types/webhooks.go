@@ -0,0 +1,99 @@
+package types
+
+import (
+	"github.com/captainlettuce/users-microservice/generated"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// Webhook is an endpoint user changes are posted to
+type Webhook struct {
+	Id  uuid.UUID
+	Url string
+
+	// Secret is the key deliveries are signed with, it is never returned after registration
+	Secret string
+
+	// Subscription selects the changes delivered to the webhook, its start point is ignored
+	Subscription SubscriptionRequest
+
+	CreatedAt time.Time
+}
+
+func (w Webhook) Proto() *generated.Webhook {
+	return &generated.Webhook{
+		Id:        w.Id.String(),
+		Url:       w.Url,
+		Params:    w.Subscription.ParamsProto(),
+		CreatedAt: timestamppb.New(w.CreatedAt),
+	}
+}
+
+// WebhookDelivery is a single attempt to deliver a change to a webhook
+type WebhookDelivery struct {
+	// Id identifies the delivered change, it is the same for all attempts
+	Id        uuid.UUID      `bson:"delivery_id"`
+	WebhookId uuid.UUID      `bson:"webhook_id"`
+	Sequence  uint64         `bson:"sequence"`
+	UserId    uuid.UUID      `bson:"user_id"`
+	Change    UserChangeType `bson:"change_type"`
+
+	// Attempt starts at 1
+	Attempt int `bson:"attempt"`
+
+	// StatusCode is 0 if no response was received
+	StatusCode int           `bson:"status_code"`
+	Error      string        `bson:"error,omitempty"`
+	Succeeded  bool          `bson:"succeeded"`
+	AttemptAt  time.Time     `bson:"attempted_at"`
+	Duration   time.Duration `bson:"duration"`
+}
+
+func (wd WebhookDelivery) Proto() *generated.WebhookDelivery {
+	return &generated.WebhookDelivery{
+		Id:          wd.Id.String(),
+		WebhookId:   wd.WebhookId.String(),
+		Sequence:    wd.Sequence,
+		UserId:      wd.UserId.String(),
+		ChangeType:  generated.UserChangeType(generated.UserChangeType_value[string(wd.Change)]),
+		Attempt:     uint32(wd.Attempt),
+		StatusCode:  int32(wd.StatusCode),
+		Error:       wd.Error,
+		Succeeded:   wd.Succeeded,
+		AttemptedAt: timestamppb.New(wd.AttemptAt),
+		Duration:    durationpb.New(wd.Duration),
+	}
+}
+
+// WebhookDeadLetter is a change that could not be delivered to a webhook after all attempts
+type WebhookDeadLetter struct {
+	// Id is the id of the failed delivery
+	Id        uuid.UUID      `bson:"_id"`
+	WebhookId uuid.UUID      `bson:"webhook_id"`
+	Sequence  uint64         `bson:"sequence"`
+	UserId    uuid.UUID      `bson:"user_id"`
+	Change    UserChangeType `bson:"change_type"`
+
+	// Body is the json posted to the webhook
+	Body []byte `bson:"body"`
+
+	Attempts  int       `bson:"attempts"`
+	LastError string    `bson:"last_error"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+func (wd WebhookDeadLetter) Proto() *generated.WebhookDeadLetter {
+	return &generated.WebhookDeadLetter{
+		Id:         wd.Id.String(),
+		WebhookId:  wd.WebhookId.String(),
+		Sequence:   wd.Sequence,
+		UserId:     wd.UserId.String(),
+		ChangeType: generated.UserChangeType(generated.UserChangeType_value[string(wd.Change)]),
+		Body:       wd.Body,
+		Attempts:   uint32(wd.Attempts),
+		LastError:  wd.LastError,
+		CreatedAt:  timestamppb.New(wd.CreatedAt),
+	}
+}
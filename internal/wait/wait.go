@@ -0,0 +1,19 @@
+package wait
+
+import (
+	"context"
+	"time"
+)
+
+// Sleep waits for d, returns false if ctx was cancelled before that
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
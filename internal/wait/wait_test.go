@@ -0,0 +1,19 @@
+package wait
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSleep(t *testing.T) {
+	require.True(t, Sleep(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	require.False(t, Sleep(ctx, time.Minute))
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,414 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/captainlettuce/users-microservice/internal/wait"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderWebhookId  = "X-Webhook-Id"
+	HeaderDeliveryId = "X-Webhook-Delivery"
+	HeaderTimestamp  = "X-Webhook-Timestamp"
+	HeaderSignature  = "X-Webhook-Signature"
+
+	// storeTimeout limits writes to the delivery log and dead letters, which are made even while shutting down
+	storeTimeout = 5 * time.Second
+
+	// maxResponseBody is how much of a response is read so the connection can be reused
+	maxResponseBody = 64 << 10
+
+	// queuePrefix starts the names of the webhook queues, followed by the webhook id
+	queuePrefix = "webhook-"
+)
+
+type Settings struct {
+	maxAttempts     int
+	initialBackoff  time.Duration
+	maxBackoff      time.Duration
+	timeout         time.Duration
+	refreshInterval time.Duration
+	client          *http.Client
+}
+
+type Option func(*Settings)
+
+// WithRetries sets how many times a change is posted before it is dead-lettered
+// the wait between attempts starts at initialBackoff and doubles up to maxBackoff
+func WithRetries(maxAttempts int, initialBackoff, maxBackoff time.Duration) Option {
+	return func(settings *Settings) {
+		settings.maxAttempts = maxAttempts
+		settings.initialBackoff = initialBackoff
+		settings.maxBackoff = maxBackoff
+	}
+}
+
+// WithTimeout sets how long to wait for a webhook to respond before the attempt fails
+func WithTimeout(timeout time.Duration) Option {
+	return func(settings *Settings) {
+		settings.timeout = timeout
+	}
+}
+
+// WithRefreshInterval sets how often registered webhooks are reloaded from the repository
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(settings *Settings) {
+		settings.refreshInterval = interval
+	}
+}
+
+// WithTargetPolicy only delivers to targets allowed by policy, by default only public addresses are allowed
+func WithTargetPolicy(policy *TargetPolicy) Option {
+	return func(settings *Settings) {
+		settings.client = policy.client()
+	}
+}
+
+// Dispatcher posts user changes to the registered webhooks
+// each webhook has its own durable queue shared by all replicas, so every change is delivered by one replica,
+// a slow or failing webhook doesn't hold up the others, and changes published while no replica runs are delivered later
+type Dispatcher struct {
+	settings Settings
+	logger   *slog.Logger
+	repo     internal.WebhookRepository
+	queues   internal.ChangeQueues
+
+	mu        sync.Mutex
+	consumers map[uuid.UUID]context.CancelFunc
+	workers   sync.WaitGroup
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewDispatcher(logger *slog.Logger, repo internal.WebhookRepository, queues internal.ChangeQueues, options ...Option) *Dispatcher {
+	settings := Settings{
+		maxAttempts:     5,
+		initialBackoff:  time.Second,
+		maxBackoff:      time.Minute,
+		timeout:         10 * time.Second,
+		refreshInterval: 10 * time.Second,
+		client:          NewTargetPolicy().client(),
+	}
+
+	for _, option := range options {
+		option(&settings)
+	}
+
+	return &Dispatcher{
+		settings:  settings,
+		logger:    logger.With(slog.String("component", "webhooks")),
+		repo:      repo,
+		queues:    queues,
+		consumers: make(map[uuid.UUID]context.CancelFunc),
+	}
+}
+
+// Start loads the registered webhooks and starts delivering changes until GracefulShutdown is called
+func (d *Dispatcher) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := d.refresh(ctx); err != nil {
+		cancel()
+		return fmt.Errorf("could not load webhooks: %w", err)
+	}
+
+	d.cancel = cancel
+	d.done = make(chan struct{})
+
+	go func() {
+		defer close(d.done)
+		d.run(ctx)
+	}()
+
+	return nil
+}
+
+// GracefulShutdown stops delivering changes, changes that were not delivered yet are left in their queues
+func (d *Dispatcher) GracefulShutdown(ctx context.Context) error {
+	if d.cancel == nil {
+		return nil
+	}
+
+	d.cancel()
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run reloads the webhooks periodically until ctx is cancelled
+func (d *Dispatcher) run(ctx context.Context) {
+	defer func() {
+		d.mu.Lock()
+		for id, cancel := range d.consumers {
+			cancel()
+			delete(d.consumers, id)
+		}
+		d.mu.Unlock()
+
+		d.workers.Wait()
+	}()
+
+	refresh := time.NewTicker(d.settings.refreshInterval)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-refresh.C:
+			if err := d.refresh(ctx); err != nil {
+				d.logger.With(slog.Any("error", err)).Warn("Could not reload webhooks")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh starts consuming the queues of newly registered webhooks, and stops consuming and removes the queues of
+// deleted ones, including those deleted while no replica was running
+func (d *Dispatcher) refresh(ctx context.Context) error {
+	webhooks, _, err := d.repo.ListWebhooks(ctx, types.Paging{})
+	if err != nil {
+		return err
+	}
+
+	registered := make(map[uuid.UUID]struct{}, len(webhooks))
+
+	d.mu.Lock()
+	for _, w := range webhooks {
+		registered[w.Id] = struct{}{}
+		if _, ok := d.consumers[w.Id]; ok {
+			continue
+		}
+
+		consumerCtx, cancel := context.WithCancel(ctx)
+		d.consumers[w.Id] = cancel
+
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			d.consume(consumerCtx, w)
+		}()
+	}
+
+	for id, cancel := range d.consumers {
+		if _, ok := registered[id]; !ok {
+			cancel()
+			delete(d.consumers, id)
+		}
+	}
+	d.mu.Unlock()
+
+	queues, err := d.queues.ListQueues(ctx, queuePrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range queues {
+		if id, err := uuid.Parse(strings.TrimPrefix(name, queuePrefix)); err == nil {
+			if _, ok := registered[id]; ok {
+				continue
+			}
+		}
+
+		if err := d.queues.DeleteQueue(ctx, name); err != nil {
+			d.logger.With(slog.Any("error", err), slog.String("queue", name)).Warn("Could not remove queue of deleted webhook")
+		}
+	}
+
+	return nil
+}
+
+// consume delivers the changes queued for webhook until ctx is cancelled, restarting the consumer if it fails
+func (d *Dispatcher) consume(ctx context.Context, webhook types.Webhook) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && !wait.Sleep(ctx, min(time.Duration(attempt)*time.Second, 10*time.Second)) {
+			return
+		}
+
+		err := d.queues.ConsumeQueue(ctx, queueName(webhook.Id), webhook.Subscription, webhook.CreatedAt, func(p types.SubscriptionPayload, attempt int) time.Duration {
+			return d.deliver(ctx, webhook, p, attempt)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		d.logger.With(slog.Any("error", err), slog.Any("webhookId", webhook.Id)).Warn("Could not consume webhook queue, retrying")
+	}
+}
+
+// deliver makes one attempt at posting p to the webhook, returns 0 once p is delivered or dead-lettered and otherwise
+// how long to wait before the next attempt
+func (d *Dispatcher) deliver(ctx context.Context, webhook types.Webhook, p types.SubscriptionPayload, attempt int) time.Duration {
+	if !webhook.Subscription.Matches(p) {
+		return 0
+	}
+
+	deliveryId := deliveryIdOf(webhook, p)
+
+	body, err := eventBody(webhook, p)
+	if err != nil {
+		d.logger.With(slog.Any("error", err), slog.Any("webhookId", webhook.Id)).Warn("Could not create webhook body")
+		return 0
+	}
+
+	delivery := d.post(ctx, webhook, deliveryId, body)
+	if ctx.Err() != nil {
+		// interrupted by a shutdown or the webhook being deleted, another replica retries it if it still exists
+		return d.settings.initialBackoff
+	}
+	delivery.Id = deliveryId
+	delivery.WebhookId = webhook.Id
+	delivery.Sequence = p.Sequence
+	delivery.UserId = p.UserId
+	delivery.Change = p.Change
+	delivery.Attempt = attempt
+
+	storeCtx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	if err := d.repo.AddDelivery(storeCtx, delivery); err != nil {
+		d.logger.With(slog.Any("error", err), slog.Any("webhookId", webhook.Id)).Warn("Could not log webhook delivery")
+	}
+	cancel()
+
+	if delivery.Succeeded {
+		return 0
+	}
+	if attempt < d.settings.maxAttempts {
+		return d.backoff(attempt)
+	}
+
+	if err := d.deadLetter(webhook, deliveryId, p, body, attempt, delivery.Error); err != nil {
+		// keep the change queued so it isn't lost
+		return d.backoff(attempt)
+	}
+	return 0
+}
+
+// post makes a single signed delivery attempt
+func (d *Dispatcher) post(ctx context.Context, webhook types.Webhook, deliveryId uuid.UUID, body []byte) types.WebhookDelivery {
+	start := time.Now()
+	delivery := types.WebhookDelivery{AttemptAt: start}
+
+	ctx, cancel := context.WithTimeout(ctx, d.settings.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookId, webhook.Id.String())
+	req.Header.Set(HeaderDeliveryId, deliveryId.String())
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, body))
+
+	resp, err := d.settings.client.Do(req)
+	delivery.Duration = time.Since(start)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBody))
+
+	delivery.StatusCode = resp.StatusCode
+	delivery.Succeeded = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !delivery.Succeeded {
+		delivery.Error = "unexpected response status " + resp.Status
+	}
+
+	return delivery
+}
+
+// deadLetter stores a change that could not be delivered, storing it again after a redelivery replaces it
+func (d *Dispatcher) deadLetter(webhook types.Webhook, deliveryId uuid.UUID, p types.SubscriptionPayload, body []byte, attempts int, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	err := d.repo.AddDeadLetter(ctx, types.WebhookDeadLetter{
+		Id:        deliveryId,
+		WebhookId: webhook.Id,
+		Sequence:  p.Sequence,
+		UserId:    p.UserId,
+		Change:    p.Change,
+		Body:      body,
+		Attempts:  attempts,
+		LastError: reason,
+		CreatedAt: time.Now(),
+	})
+
+	l := d.logger.With(slog.Any("webhookId", webhook.Id), slog.Any("deliveryId", deliveryId), slog.String("reason", reason))
+	if err != nil {
+		l.With(slog.Any("error", err)).Error("Could not dead-letter undeliverable webhook change, retrying")
+		return err
+	}
+	l.Warn("Dead-lettered undeliverable webhook change")
+	return nil
+}
+
+// backoff is the time to wait before the nth retry
+func (d *Dispatcher) backoff(retry int) time.Duration {
+	wait := d.settings.initialBackoff
+	for i := 1; i < retry && wait < d.settings.maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, d.settings.maxBackoff)
+}
+
+func queueName(webhookId uuid.UUID) string {
+	return queuePrefix + webhookId.String()
+}
+
+// deliveryIdOf derives the delivery id from the webhook and the stream sequence of the change,
+// so that every attempt shares it no matter which replica makes it
+func deliveryIdOf(webhook types.Webhook, p types.SubscriptionPayload) uuid.UUID {
+	return uuid.NewSHA1(webhook.Id, binary.BigEndian.AppendUint64(nil, p.Sequence))
+}
+
+// eventBody is the change as json, in the same format as subscription messages
+func eventBody(webhook types.Webhook, p types.SubscriptionPayload) ([]byte, error) {
+	if !webhook.Subscription.IncludeImages {
+		p = p.WithoutImages()
+	}
+
+	pb, ok := p.Proto()
+	if !ok {
+		return nil, errors.Join(types.ErrUnknownError, errors.New("invalid user change"))
+	}
+
+	return protojson.Marshal(pb)
+}
+
+// Sign creates the X-Webhook-Signature of a delivery, a hex encoded HMAC-SHA256 of "<timestamp>.<body>" keyed with secret
+// receivers should recompute it, compare in constant time and reject old timestamps to prevent replays
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,323 @@
+package webhook
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"github.com/captainlettuce/users-microservice/internal"
+	"github.com/captainlettuce/users-microservice/internal/pubsub"
+	"github.com/captainlettuce/users-microservice/internal/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// memoryRepository is a webhook repository keeping everything in memory
+type memoryRepository struct {
+	mu          sync.Mutex
+	webhooks    []types.Webhook
+	deliveries  []types.WebhookDelivery
+	deadLetters []types.WebhookDeadLetter
+}
+
+func (mr *memoryRepository) AddWebhook(_ context.Context, webhook types.Webhook) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.webhooks = append(mr.webhooks, webhook)
+	return nil
+}
+
+func (mr *memoryRepository) DeleteWebhook(_ context.Context, id uuid.UUID) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.webhooks = slices.DeleteFunc(mr.webhooks, func(w types.Webhook) bool { return w.Id == id })
+	return nil
+}
+
+func (mr *memoryRepository) ListWebhooks(context.Context, types.Paging) ([]types.Webhook, uint64, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	return slices.Clone(mr.webhooks), uint64(len(mr.webhooks)), nil
+}
+
+func (mr *memoryRepository) AddDelivery(_ context.Context, delivery types.WebhookDelivery) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.deliveries = append(mr.deliveries, delivery)
+	return nil
+}
+
+func (mr *memoryRepository) ListDeliveries(_ context.Context, webhookId uuid.UUID, _ types.Paging) ([]types.WebhookDelivery, uint64, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	var ret []types.WebhookDelivery
+	for _, d := range mr.deliveries {
+		if d.WebhookId == webhookId {
+			ret = append(ret, d)
+		}
+	}
+	return ret, uint64(len(ret)), nil
+}
+
+func (mr *memoryRepository) AddDeadLetter(_ context.Context, deadLetter types.WebhookDeadLetter) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.deadLetters = append(mr.deadLetters, deadLetter)
+	return nil
+}
+
+func (mr *memoryRepository) ListDeadLetters(_ context.Context, webhookId uuid.UUID, _ types.Paging) ([]types.WebhookDeadLetter, uint64, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	var ret []types.WebhookDeadLetter
+	for _, d := range mr.deadLetters {
+		if d.WebhookId == webhookId {
+			ret = append(ret, d)
+		}
+	}
+	return ret, uint64(len(ret)), nil
+}
+
+// startNats starts an embedded nats server for the duration of the test and returns a client to it
+func startNats(t *testing.T) internal.PubSubService {
+	embedded, err := pubsub.StartEmbeddedNats(t.TempDir(), 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = embedded.Shutdown(context.Background()) })
+
+	client, err := pubsub.NewNatsClient(discardLogger, embedded.ClientURL(), pubsub.WithInProcessServer(embedded))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.GracefulShutdown(context.Background()) })
+
+	return client
+}
+
+func TestDispatcher(t *testing.T) {
+	var (
+		repo   = &memoryRepository{}
+		ps     = startNats(t)
+		userId = uuid.New()
+
+		received  = make(chan *http.Request, 100)
+		bodies    = make(chan []byte, 100)
+		flakyHits atomic.Int32
+	)
+
+	// flaky fails the first attempt of every delivery
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flakyHits.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer flaky.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	createdOnly := types.Webhook{
+		Id:           uuid.New(),
+		Url:          flaky.URL,
+		Secret:       "secret",
+		Subscription: types.SubscriptionRequest{Changes: []types.UserChangeType{types.UserChangeTypeCreated}},
+		CreatedAt:    time.Now(),
+	}
+	broken := types.Webhook{Id: uuid.New(), Url: failing.URL, Secret: "other", CreatedAt: time.Now()}
+
+	require.NoError(t, repo.AddWebhook(context.Background(), createdOnly))
+	require.NoError(t, repo.AddWebhook(context.Background(), broken))
+
+	// changes are queued from the creation of a webhook, also before delivery starts
+	require.NoError(t, ps.PublishUserChange(types.NewUserChangePayload(types.UserChangeTypeUpdated, &types.User{Id: userId}, types.User{Id: userId})))
+	require.NoError(t, ps.PublishUserChange(types.NewUserChangePayload(types.UserChangeTypeCreated, nil, types.User{Id: userId})))
+
+	d := NewDispatcher(discardLogger, repo, ps.(internal.ChangeQueues), WithRetries(2, 10*time.Millisecond, 20*time.Millisecond), WithTimeout(time.Second), WithTargetPolicy(NewTargetPolicy(WithPrivateTargets())))
+	require.NoError(t, d.Start())
+	defer func() { _ = d.GracefulShutdown(context.Background()) }()
+
+	var (
+		req  *http.Request
+		body []byte
+	)
+	select {
+	case req = <-received:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+
+	t.Run("change is posted as signed json", func(t *testing.T) {
+		require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		require.Equal(t, createdOnly.Id.String(), req.Header.Get(HeaderWebhookId))
+		require.Equal(t, Sign("secret", req.Header.Get(HeaderTimestamp), body), req.Header.Get(HeaderSignature))
+
+		var event struct {
+			Update struct {
+				UserId     string `json:"userId"`
+				ChangeType string `json:"changeType"`
+			} `json:"update"`
+		}
+		require.NoError(t, json.Unmarshal(body, &event))
+		require.Equal(t, userId.String(), event.Update.UserId)
+		require.Equal(t, string(types.UserChangeTypeCreated), event.Update.ChangeType)
+	})
+
+	t.Run("retried attempts are logged with the same delivery id", func(t *testing.T) {
+		deliveryId := uuid.MustParse(req.Header.Get(HeaderDeliveryId))
+
+		var attempts []types.WebhookDelivery
+		require.Eventually(t, func() bool {
+			deliveries, _, _ := repo.ListDeliveries(context.Background(), createdOnly.Id, types.Paging{})
+			attempts = slices.DeleteFunc(deliveries, func(d types.WebhookDelivery) bool { return d.Id != deliveryId })
+			return len(attempts) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		require.Equal(t, 1, attempts[0].Attempt)
+		require.False(t, attempts[0].Succeeded)
+		require.Equal(t, http.StatusServiceUnavailable, attempts[0].StatusCode)
+		require.Equal(t, 2, attempts[1].Attempt)
+		require.True(t, attempts[1].Succeeded)
+	})
+
+	t.Run("only matching changes are delivered", func(t *testing.T) {
+		deliveries, _, _ := repo.ListDeliveries(context.Background(), createdOnly.Id, types.Paging{})
+		for _, d := range deliveries {
+			require.Equal(t, types.UserChangeTypeCreated, d.Change)
+		}
+	})
+
+	t.Run("failed deliveries are dead-lettered", func(t *testing.T) {
+		var deadLetters []types.WebhookDeadLetter
+		require.Eventually(t, func() bool {
+			deadLetters, _, _ = repo.ListDeadLetters(context.Background(), broken.Id, types.Paging{})
+			return len(deadLetters) > 0
+		}, 5*time.Second, 10*time.Millisecond)
+
+		require.Equal(t, 2, deadLetters[0].Attempts)
+		require.Contains(t, deadLetters[0].LastError, "500")
+		require.NotEmpty(t, deadLetters[0].Body)
+	})
+}
+
+func TestDispatcher_sharedQueues(t *testing.T) {
+	var (
+		repo = &memoryRepository{}
+		ps   = startNats(t)
+
+		mu          sync.Mutex
+		deliveryIds []string
+		sequences   []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event struct {
+			Sequence string `json:"sequence"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&event)
+
+		mu.Lock()
+		defer mu.Unlock()
+		deliveryIds = append(deliveryIds, r.Header.Get(HeaderDeliveryId))
+		sequences = append(sequences, event.Sequence)
+	}))
+	defer srv.Close()
+
+	hook := types.Webhook{Id: uuid.New(), Url: srv.URL, Secret: "secret", CreatedAt: time.Now()}
+	require.NoError(t, repo.AddWebhook(context.Background(), hook))
+
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			userId := uuid.New()
+			require.NoError(t, ps.PublishUserChange(types.NewUserChangePayload(types.UserChangeTypeCreated, nil, types.User{Id: userId})))
+		}
+	}
+	delivered := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(deliveryIds)
+	}
+	start := func() *Dispatcher {
+		d := NewDispatcher(discardLogger, repo, ps.(internal.ChangeQueues), WithTargetPolicy(NewTargetPolicy(WithPrivateTargets())))
+		require.NoError(t, d.Start())
+		return d
+	}
+
+	first, second := start(), start()
+	publish(10)
+	require.Eventually(t, func() bool { return delivered() == 10 }, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, first.GracefulShutdown(context.Background()))
+	require.NoError(t, second.GracefulShutdown(context.Background()))
+
+	t.Run("changes published while no dispatcher runs are delivered later", func(t *testing.T) {
+		publish(5)
+
+		d := start()
+		defer func() { _ = d.GracefulShutdown(context.Background()) }()
+
+		require.Eventually(t, func() bool { return delivered() == 15 }, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("every change is delivered once and in order", func(t *testing.T) {
+		// give duplicate deliveries a moment to arrive
+		time.Sleep(100 * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, deliveryIds, 15)
+		unique := slices.Clone(deliveryIds)
+		slices.Sort(unique)
+		require.Len(t, slices.Compact(unique), 15)
+		require.True(t, slices.IsSortedFunc(sequences, func(a, b string) int {
+			x, _ := strconv.ParseUint(a, 10, 64)
+			y, _ := strconv.ParseUint(b, 10, 64)
+			return cmp.Compare(x, y)
+		}))
+	})
+
+	t.Run("queues of deleted webhooks are removed", func(t *testing.T) {
+		require.NoError(t, repo.DeleteWebhook(context.Background(), hook.Id))
+
+		d := start()
+		defer func() { _ = d.GracefulShutdown(context.Background()) }()
+
+		queues, err := ps.(internal.ChangeQueues).ListQueues(context.Background(), queuePrefix)
+		require.NoError(t, err)
+		require.Empty(t, queues)
+	})
+}
+
+func TestDispatcher_backoff(t *testing.T) {
+	d := NewDispatcher(discardLogger, &memoryRepository{}, nil, WithRetries(10, time.Second, 5*time.Second))
+
+	var got []time.Duration
+	for retry := 1; retry <= 5; retry++ {
+		got = append(got, d.backoff(retry))
+	}
+
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, got)
+}
+
+func TestSign(t *testing.T) {
+	require.Equal(
+		t,
+		"sha256=c9baf7f06afbca0b8d5ed39dabc5bd1f29442229a4dbde696eb2de701f6dcd76",
+		Sign("secret", "1700000000", []byte(`{"sequence":"1"}`)),
+	)
+}
@@ -0,0 +1,171 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// nonPublicPrefixes are the ranges that are not private by netip but still don't reach the public internet
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade nat, used for pods and services by some clusters
+	netip.MustParsePrefix("192.0.0.0/24"),  // ietf protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // nat64, which may translate to private ipv4 addresses
+}
+
+// Resolver looks up the addresses of a host, *net.Resolver is a Resolver
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// TargetPolicy decides which hosts webhooks can be registered for and delivered to
+// by default hosts resolving to loopback, private, link-local and other non-public addresses are rejected so that
+// webhooks can't be used to reach the internal network, e.g. the cloud metadata service at 169.254.169.254
+type TargetPolicy struct {
+	allowedHosts []string
+	allowPrivate bool
+	resolver     Resolver
+}
+
+type TargetOption func(*TargetPolicy)
+
+// WithAllowedHosts only allows webhooks for hosts in hosts, "*.example.com" allows all subdomains of example.com
+func WithAllowedHosts(hosts ...string) TargetOption {
+	return func(policy *TargetPolicy) {
+		for _, host := range hosts {
+			policy.allowedHosts = append(policy.allowedHosts, strings.ToLower(strings.TrimSpace(host)))
+		}
+	}
+}
+
+// WithPrivateTargets allows hosts resolving to non-public addresses, e.g. receivers in the same cluster
+func WithPrivateTargets() TargetOption {
+	return func(policy *TargetPolicy) {
+		policy.allowPrivate = true
+	}
+}
+
+// WithResolver looks up hosts with resolver instead of net.DefaultResolver when webhooks are registered
+func WithResolver(resolver Resolver) TargetOption {
+	return func(policy *TargetPolicy) {
+		policy.resolver = resolver
+	}
+}
+
+func NewTargetPolicy(options ...TargetOption) *TargetPolicy {
+	policy := &TargetPolicy{resolver: net.DefaultResolver}
+
+	for _, option := range options {
+		option(policy)
+	}
+
+	return policy
+}
+
+// Check returns an error if webhooks may not be delivered to the host of u
+func (p *TargetPolicy) Check(ctx context.Context, u *url.URL) error {
+	host := u.Hostname()
+	if err := p.checkHost(host); err != nil {
+		return err
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddr(addr)
+	}
+
+	addrs, err := p.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("could not resolve host %q: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if err := p.checkAddr(addr); err != nil {
+			return fmt.Errorf("host %q: %w", host, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *TargetPolicy) checkHost(host string) error {
+	if len(p.allowedHosts) == 0 {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	for _, allowed := range p.allowedHosts {
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("host %q is not allowed", host)
+}
+
+func (p *TargetPolicy) checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if p.allowPrivate || isPublic(addr) {
+		return nil
+	}
+
+	return fmt.Errorf("address %s is not public", addr)
+}
+
+// client is an http client that only connects to allowed targets
+// the address is checked again when connecting, so hosts can't resolve to another address after being registered
+func (p *TargetPolicy) client() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return p.checkAddr(addrPort.Addr())
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be dialed instead of the webhook, bypassing the checks
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkHost(host); err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	return &http.Client{
+		Transport: transport,
+		// redirects could lead anywhere, webhooks are expected to respond themselves
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// isPublic reports whether addr is a unicast address on the public internet
+func isPublic(addr netip.Addr) bool {
+	// loopback, link-local, multicast and unspecified addresses are not global unicast
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func Test_isPublic(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "93.184.215.14", want: true},
+		{addr: "2606:2800:21f:cb07:6820:80da:af6b:8b2c", want: true},
+		{addr: "127.0.0.1"},
+		{addr: "::1"},
+		{addr: "10.1.2.3"},
+		{addr: "172.16.0.1"},
+		{addr: "192.168.1.1"},
+		{addr: "169.254.169.254"},
+		{addr: "fe80::1"},
+		{addr: "fd00::1"},
+		{addr: "100.64.0.1"},
+		{addr: "0.0.0.0"},
+		{addr: "224.0.0.1"},
+		{addr: "64:ff9b::a00:1"},
+		{addr: "::ffff:127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			require.Equal(t, tt.want, NewTargetPolicy().checkAddr(netip.MustParseAddr(tt.addr)) == nil)
+		})
+	}
+}
+
+func TestTargetPolicy_client(t *testing.T) {
+	redirected := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/target", http.StatusFound)
+			return
+		}
+		redirected = r.URL.Path == "/target"
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	t.Run("non-public addresses are not dialed", func(t *testing.T) {
+		_, err := NewTargetPolicy().client().Post(srv.URL, "application/json", nil)
+		require.ErrorContains(t, err, "not public")
+	})
+
+	t.Run("hosts outside the allowlist are not dialed", func(t *testing.T) {
+		_, err := NewTargetPolicy(WithPrivateTargets(), WithAllowedHosts("example.com")).client().Post(srv.URL, "application/json", nil)
+		require.ErrorContains(t, err, "not allowed")
+	})
+
+	t.Run("redirects are not followed", func(t *testing.T) {
+		resp, err := NewTargetPolicy(WithPrivateTargets()).client().Post(srv.URL+"/redirect", "application/json", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		require.False(t, redirected)
+	})
+}